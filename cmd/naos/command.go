@@ -12,89 +12,152 @@ var usage = `Networked Artifacts Operating System
 https://github.com/256dpi/naos
 
 Project Management:
-  create   Create a new naos project in the current directory.
-  install  Download required dependencies to the 'naos' subdirectory.
-  build    Build all source files.
-  flash    Flash the previously built binary to an attached device.
-  attach   Open a serial communication with an attached device.
-  run      Run 'build', 'flash' and 'attach' sequentially.
-  config   Write settings and parameters to an attached device.
-  format   Format all source files in the 'src' subdirectory.
+  create    Create a new naos project in the current directory.
+  install   Download required dependencies to the 'naos' subdirectory.
+  build     Build all source files.
+  flash     Flash the previously built binary to an attached device.
+  provision Flash and configure all attached devices in parallel.
+  attach    Open a serial communication with an attached device.
+  run       Run 'build', 'flash' and 'attach' sequentially.
+  config    Write or read settings and parameters of an attached device.
+  format    Format all source files in the 'src' subdirectory.
+  ports     List serial ports with attached boards.
 
 Fleet Management:
-  list     List all devices listed in the inventory.
-  collect  Collect devices and add them to the inventory.
-  ping     Ping devices.
-  send     Send a message to devices.
-  discover Discover all parameters of a device.
-  get      Read a parameter from devices.
-  set      Set a parameter on devices.
-  unset    Unset a parameter on devices.
-  monitor  Monitor heartbeats from devices.
-  record   Record log messages from devices.
-  debug    Gather debug information from devices.
-  update   Update devices over the air.
+  list      List all devices listed in the inventory.
+  collect   Collect devices and add them to the inventory.
+  ping      Ping devices and estimate the round trip time from heartbeats.
+  send      Send a message to devices and optionally await replies.
+  discover  Discover all parameters of a device.
+  get       Read a parameter from devices.
+  set       Set a parameter on devices.
+  unset     Unset a parameter on devices.
+  monitor   Monitor heartbeats from devices.
+  record    Record log messages from devices.
+  subscribe Subscribe to topics below the base topic of devices.
+  debug     Gather debug information from devices.
+  update    Update devices over the air.
+  deliver   Deliver queued operations once devices come online.
+  queue     List or clear queued operations.
+  history   Show the journal of operations performed on devices.
+  broker    Run a local MQTT broker for development.
+  serve     Serve an HTTP/JSON API for the project.
 
 Usage:
   naos create [--cmake --force]
-  naos install [--force]
+  naos install [--force --update --insecure]
   naos build [--clean --app-only]
-  naos flash [<device>] [--erase --app-only]
-  naos attach [<device>] [--simple]
-  naos run [<device>] [--clean --app-only --erase --simple]
-  naos config <file> [<device>]
+  naos flash [<device>] [--erase --app-only --baud=<rate> --flash-mode=<mode> --flash-freq=<freq> --before=<reset> --after=<reset>]
+  naos flash --all [--erase --app-only --baud=<rate> --flash-mode=<mode> --flash-freq=<freq> --before=<reset> --after=<reset>]
+  naos provision <file> [--erase --app-only --baud=<rate> --flash-mode=<mode> --flash-freq=<freq> --before=<reset> --after=<reset>]
+  naos attach [<device>] [--simple --timestamps --log=<path>]
+  naos run [<device>] [--clean --app-only --erase --simple --timestamps --log=<path> --baud=<rate> --flash-mode=<mode> --flash-freq=<freq> --before=<reset> --after=<reset>]
+  naos config <file> [<device>] [--output=<path>]
+  naos config --read [<device>] [--reveal]
   naos format
-  naos list
-  naos collect [--clear --duration=<time>]
-  naos ping [<pattern>] [--timeout=<time>]
-  naos send <topic> [--] <message> [<pattern>] [--timeout=<time>]
-  naos discover [<pattern>] [--timeout=<time>]
-  naos get <param> [<pattern>] [--timeout=<time>]
-  naos set <param> [--] <value> [<pattern>] [--timeout=<time>]
-  naos unset <param> [<pattern>] [--timeout=<time>]
-  naos monitor [<pattern>] [--timeout=<time>]
-  naos record [<pattern>] [--timeout=<time>]
-  naos debug [<pattern>] [--delete --duration=<time>]
-  naos update <version> [<pattern>] [--jobs=<count> --timeout=<time>]
+  naos ports [--output=<format>]
+  naos list [--output=<format>]
+  naos collect [--clear --duration=<time> --output=<format>]
+  naos ping [<pattern>] [--count=<n> --interval=<time> --timeout=<time> --output=<format>]
+  naos send <topic> [--] <message> [<pattern>] [--expect=<topic> --format=<format> --retries=<count> --timeout=<time> --dry-run --yes --output=<format>]
+  naos send <topic> --file=<path> [<pattern>] [--expect=<topic> --format=<format> --retries=<count> --timeout=<time> --dry-run --yes --output=<format>]
+  naos discover [<pattern>] [--retries=<count> --timeout=<time> --output=<format>]
+  naos get <param> [<pattern>] [--retries=<count> --timeout=<time> --output=<format>]
+  naos set <param> [--] <value> [<pattern>] [--retries=<count> --timeout=<time> --queue --dry-run --yes --output=<format>]
+  naos unset <param> [<pattern>] [--timeout=<time> --queue --dry-run --yes --output=<format>]
+  naos monitor [<pattern>] [--timeout=<time> --plain --output=<format>]
+  naos record [<pattern>] [--timeout=<time> --output=<format>]
+  naos subscribe <topic> [<pattern>] [--format=<format> --timeout=<time> --output=<format>]
+  naos debug [<pattern>] [--delete --duration=<time> --dry-run --yes --output=<format>]
+  naos update <version> [<pattern>] [--jobs=<count> --timeout=<time> --queue --dry-run --yes --output=<format>]
+  naos deliver [<pattern>] [--timeout=<time> --output=<format>]
+  naos queue [<pattern>] [--clear --output=<format>]
+  naos history [<pattern>] [--output=<format>]
+  naos broker [--address=<addr> --ws-address=<addr> --username=<name> --password=<pass> --cert=<file> --key=<file> --output=<format>]
+  naos serve [--listen=<addr> --token=<token>]
   naos help
 
+The flash options take precedence over the flash settings of the inventory,
+which apply to all devices of the project. Each flash option accepts a comma
+separated list of values that apply to all ports or per port overrides in the
+form "<port>=<value>", e.g. "--baud=460800,/dev/ttyUSB1=115200".
+
 Options:
   --cmake               Create required CMake files for IDEs like CLion.
   --force               Reinstall dependencies when they already exist.
+  --update              Ignore the lock file and install the latest versions.
+  --insecure            Install toolchains that cannot be verified with a checksum.
   --clean               Clean all build artifacts before building again.
   --erase               Erase completely before flashing new image.
   --app-only            Only build or flash the application.
-  --simple              Use simple serial tool.
-  --clear               Remove not available devices from inventory.
+  --all                 Flash all attached devices in parallel.
+  --baud=<rate>         Flash baud rate, lower rates are tried on failure (921600).
+  --flash-mode=<mode>   Flash mode: qio, qout, dio or dout (dio).
+  --flash-freq=<freq>   Flash frequency: 80m, 40m, 26m or 20m (40m).
+  --before=<reset>      Reset into the bootloader before flashing: reset or none (reset).
+  --after=<reset>       Reset into the application after flashing: reset or none (reset).
+  --simple              Do not decode backtraces.
+  --timestamps          Prefix serial output lines with the time received.
+  --log=<path>          Append the serial session to the specified file.
+  --plain               Print heartbeats instead of the interactive view.
+  --read                Read the settings and parameters from the device.
+  --reveal              Show passwords instead of masking them.
+  --clear               Remove not available devices from inventory or clear the queue.
+  --queue               Queue the operation for devices that did not respond.
   --delete              Delete loaded coredumps from the devices.
+  --dry-run             Show the devices and messages without performing the operation.
+  -y --yes              Skip the confirmation for operations on many devices.
   -d --duration=<time>  Operation duration [default: 2s].
   -t --timeout=<time>   Operation timeout [default: 5s].
   -j --jobs=<count>     Number of simultaneous update jobs [default: 10].
+  -r --retries=<count>  Number of retries for not responding devices [default: 0].
+  --file=<path>         Read the message from a file or '-' for stdin.
+  --expect=<topic>      Wait for a reply on the specified topic.
+  --format=<format>     Payload format: text, hex, base64 or json [default: text].
+  -c --count=<n>        Number of pings to send, zero pings until interrupted [default: 1].
+  -i --interval=<time>  Interval between pings [default: 1s].
+  --address=<addr>      The broker TCP address [default: 0.0.0.0:1883].
+  --ws-address=<addr>   The broker WebSocket address [default: 0.0.0.0:8080].
+  --username=<name>     The username required from broker clients.
+  --password=<pass>     The password required from broker clients.
+  --cert=<file>         The broker TLS certificate file.
+  --key=<file>          The broker TLS key file.
+  -o --output=<format>  Output format: text, json, jsonl, csv or yaml, or the image file for 'config'.
+  --listen=<addr>       The HTTP API address [default: localhost:8000].
+  --token=<token>       The HTTP API token, defaults to $NAOS_TOKEN or a random token.
 `
 
 type command struct {
 	// commands
-	cCreate   bool
-	cInstall  bool
-	cBuild    bool
-	cFlash    bool
-	cAttach   bool
-	cRun      bool
-	cConfig   bool
-	cFormat   bool
-	cList     bool
-	cCollect  bool
-	cPing     bool
-	cSend     bool
-	cDiscover bool
-	cGet      bool
-	cSet      bool
-	cUnset    bool
-	cMonitor  bool
-	cRecord   bool
-	cDebug    bool
-	cUpdate   bool
-	cHelp     bool
+	cCreate    bool
+	cInstall   bool
+	cBuild     bool
+	cFlash     bool
+	cProvision bool
+	cAttach    bool
+	cRun       bool
+	cConfig    bool
+	cFormat    bool
+	cPorts     bool
+	cList      bool
+	cCollect   bool
+	cPing      bool
+	cSend      bool
+	cDiscover  bool
+	cGet       bool
+	cSet       bool
+	cUnset     bool
+	cMonitor   bool
+	cRecord    bool
+	cSubscribe bool
+	cDebug     bool
+	cUpdate    bool
+	cDeliver   bool
+	cQueue     bool
+	cHistory   bool
+	cBroker    bool
+	cServe     bool
+	cHelp      bool
 
 	// arguments
 	aDevice  string
@@ -107,17 +170,48 @@ type command struct {
 	aVersion string
 
 	// options
-	oForce    bool
-	oCMake    bool
-	oClean    bool
-	oErase    bool
-	oAppOnly  bool
-	oSimple   bool
-	oClear    bool
-	oDelete   bool
-	oDuration time.Duration
-	oTimeout  time.Duration
-	oJobs     int
+	oForce     bool
+	oUpdate    bool
+	oInsecure  bool
+	oCMake     bool
+	oClean     bool
+	oErase     bool
+	oAppOnly   bool
+	oAll       bool
+	oBaud      string
+	oFlashMode string
+	oFlashFreq string
+	oBefore    string
+	oAfter     string
+	oSimple    bool
+	oTimestamp bool
+	oLog       string
+	oPlain     bool
+	oRead      bool
+	oReveal    bool
+	oClear     bool
+	oQueue     bool
+	oDelete    bool
+	oDryRun    bool
+	oYes       bool
+	oDuration  time.Duration
+	oTimeout   time.Duration
+	oJobs      int
+	oRetries   int
+	oCount     int
+	oInterval  time.Duration
+	oFile      string
+	oExpect    string
+	oFormat    string
+	oAddress   string
+	oWSAddress string
+	oUsername  string
+	oPassword  string
+	oCert      string
+	oKey       string
+	oListen    string
+	oToken     string
+	oOutput    string
 }
 
 func parseCommand() *command {
@@ -126,27 +220,35 @@ func parseCommand() *command {
 
 	return &command{
 		// commands
-		cCreate:   getBool(a["create"]),
-		cInstall:  getBool(a["install"]),
-		cBuild:    getBool(a["build"]),
-		cFlash:    getBool(a["flash"]),
-		cAttach:   getBool(a["attach"]),
-		cRun:      getBool(a["run"]),
-		cConfig:   getBool(a["config"]),
-		cFormat:   getBool(a["format"]),
-		cList:     getBool(a["list"]),
-		cCollect:  getBool(a["collect"]),
-		cPing:     getBool(a["ping"]),
-		cSend:     getBool(a["send"]),
-		cDiscover: getBool(a["discover"]),
-		cGet:      getBool(a["get"]),
-		cSet:      getBool(a["set"]),
-		cUnset:    getBool(a["unset"]),
-		cMonitor:  getBool(a["monitor"]),
-		cRecord:   getBool(a["record"]),
-		cDebug:    getBool(a["debug"]),
-		cUpdate:   getBool(a["update"]),
-		cHelp:     getBool(a["help"]),
+		cCreate:    getBool(a["create"]),
+		cInstall:   getBool(a["install"]),
+		cBuild:     getBool(a["build"]),
+		cFlash:     getBool(a["flash"]),
+		cProvision: getBool(a["provision"]),
+		cAttach:    getBool(a["attach"]),
+		cRun:       getBool(a["run"]),
+		cConfig:    getBool(a["config"]),
+		cFormat:    getBool(a["format"]),
+		cPorts:     getBool(a["ports"]),
+		cList:      getBool(a["list"]),
+		cCollect:   getBool(a["collect"]),
+		cPing:      getBool(a["ping"]),
+		cSend:      getBool(a["send"]),
+		cDiscover:  getBool(a["discover"]),
+		cGet:       getBool(a["get"]),
+		cSet:       getBool(a["set"]),
+		cUnset:     getBool(a["unset"]),
+		cMonitor:   getBool(a["monitor"]),
+		cRecord:    getBool(a["record"]),
+		cSubscribe: getBool(a["subscribe"]),
+		cDebug:     getBool(a["debug"]),
+		cUpdate:    getBool(a["update"]),
+		cDeliver:   getBool(a["deliver"]),
+		cQueue:     getBool(a["queue"]),
+		cHistory:   getBool(a["history"]),
+		cBroker:    getBool(a["broker"]),
+		cServe:     getBool(a["serve"]),
+		cHelp:      getBool(a["help"]),
 
 		// arguments
 		aDevice:  getString(a["<device>"]),
@@ -159,17 +261,48 @@ func parseCommand() *command {
 		aVersion: getString(a["<version>"]),
 
 		// options
-		oForce:    getBool(a["--force"]),
-		oCMake:    getBool(a["--cmake"]),
-		oClean:    getBool(a["--clean"]),
-		oErase:    getBool(a["--erase"]),
-		oAppOnly:  getBool(a["--app-only"]),
-		oSimple:   getBool(a["--simple"]),
-		oClear:    getBool(a["--clear"]),
-		oDelete:   getBool(a["--delete"]),
-		oDuration: getDuration(a["--duration"]),
-		oTimeout:  getDuration(a["--timeout"]),
-		oJobs:     getInt(a["--jobs"]),
+		oForce:     getBool(a["--force"]),
+		oUpdate:    getBool(a["--update"]),
+		oInsecure:  getBool(a["--insecure"]),
+		oCMake:     getBool(a["--cmake"]),
+		oClean:     getBool(a["--clean"]),
+		oErase:     getBool(a["--erase"]),
+		oAppOnly:   getBool(a["--app-only"]),
+		oAll:       getBool(a["--all"]),
+		oBaud:      getString(a["--baud"]),
+		oFlashMode: getString(a["--flash-mode"]),
+		oFlashFreq: getString(a["--flash-freq"]),
+		oBefore:    getString(a["--before"]),
+		oAfter:     getString(a["--after"]),
+		oSimple:    getBool(a["--simple"]),
+		oTimestamp: getBool(a["--timestamps"]),
+		oLog:       getString(a["--log"]),
+		oPlain:     getBool(a["--plain"]),
+		oRead:      getBool(a["--read"]),
+		oReveal:    getBool(a["--reveal"]),
+		oClear:     getBool(a["--clear"]),
+		oQueue:     getBool(a["--queue"]),
+		oDelete:    getBool(a["--delete"]),
+		oDryRun:    getBool(a["--dry-run"]),
+		oYes:       getBool(a["--yes"]),
+		oDuration:  getDuration(a["--duration"]),
+		oTimeout:   getDuration(a["--timeout"]),
+		oJobs:      getInt(a["--jobs"]),
+		oRetries:   getInt(a["--retries"]),
+		oCount:     getInt(a["--count"]),
+		oInterval:  getDuration(a["--interval"]),
+		oFile:      getString(a["--file"]),
+		oExpect:    getString(a["--expect"]),
+		oFormat:    getString(a["--format"]),
+		oAddress:   getString(a["--address"]),
+		oWSAddress: getString(a["--ws-address"]),
+		oUsername:  getString(a["--username"]),
+		oPassword:  getString(a["--password"]),
+		oCert:      getString(a["--cert"]),
+		oKey:       getString(a["--key"]),
+		oListen:    getString(a["--listen"]),
+		oToken:     getString(a["--token"]),
+		oOutput:    getString(a["--output"]),
 	}
 }
 
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+type planRecord struct {
+	Device  string `json:"device"`
+	Broker  string `json:"broker"`
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+}
+
+// guard will print the devices and messages of a mutating operation and exit if
+// a dry run has been requested. Otherwise, it will ask for a confirmation if the
+// operation targets more devices than the inventory threshold allows, unless
+// the confirmation has been skipped.
+func guard(cmd *command, p *naos.Project, action string, devices []*naos.Device, message func(*naos.Device) (string, string)) {
+	// sort devices
+	devices = sortDevices(devices)
+
+	// print plan and exit if requested
+	if cmd.oDryRun {
+		// print records if requested
+		if out := newPrinter(cmd); out != nil {
+			for _, d := range devices {
+				topic, payload := message(d)
+				out.print(planRecord{Device: d.Name, Broker: formatBroker(d), Topic: topic, Payload: payload})
+			}
+
+			out.close()
+			os.Exit(0)
+		}
+
+		// print summary
+		fmt.Printf("Would %s on %d device(s) matching '%s':\n\n", action, len(devices), cmd.aPattern)
+
+		// prepare table
+		tbl := newTable("DEVICE NAME", "BROKER", "TOPIC", "PAYLOAD")
+
+		// add rows
+		for _, d := range devices {
+			topic, payload := message(d)
+			tbl.add(d.Name, formatBroker(d), topic, payload)
+		}
+
+		// show table
+		tbl.show(0)
+		os.Exit(0)
+	}
+
+	// check if confirmation is needed
+	if cmd.oYes || !p.Inventory.RequiresConfirmation(len(devices)) {
+		return
+	}
+
+	// check terminal
+	if !isTerminal(os.Stdin) {
+		exitWithError(fmt.Sprintf("refusing to %s on %d devices without confirmation, use --yes to skip", action, len(devices)))
+	}
+
+	// ask for confirmation
+	fmt.Fprintf(os.Stderr, "About to %s on %d devices matching '%s'. Continue? [y/N] ", action, len(devices), cmd.aPattern)
+
+	// read answer
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		exitWithError("aborted")
+	}
+}
+
+func formatBroker(d *naos.Device) string {
+	// check broker
+	if d.Broker == "" {
+		return "default"
+	}
+
+	return d.Broker
+}
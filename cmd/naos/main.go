@@ -1,15 +1,26 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/bytefmt"
+	"gopkg.in/yaml.v2"
+
 	"github.com/256dpi/naos/pkg/fleet"
 	"github.com/256dpi/naos/pkg/naos"
+	"github.com/256dpi/naos/pkg/server"
+	"github.com/256dpi/naos/pkg/utils"
 )
 
 func main() {
@@ -30,6 +41,8 @@ func main() {
 		build(cmd, getProject())
 	} else if cmd.cFlash {
 		flash(cmd, getProject())
+	} else if cmd.cProvision {
+		provision(cmd, getProject())
 	} else if cmd.cAttach {
 		attach(cmd, getProject())
 	} else if cmd.cRun {
@@ -38,6 +51,8 @@ func main() {
 		config(cmd, getProject())
 	} else if cmd.cFormat {
 		format(cmd, getProject())
+	} else if cmd.cPorts {
+		ports(cmd, getProject())
 	} else if cmd.cList {
 		list(cmd, getProject())
 	} else if cmd.cCollect {
@@ -58,10 +73,22 @@ func main() {
 		monitor(cmd, getProject())
 	} else if cmd.cRecord {
 		record(cmd, getProject())
+	} else if cmd.cSubscribe {
+		subscribe(cmd, getProject())
 	} else if cmd.cDebug {
 		debug(cmd, getProject())
 	} else if cmd.cUpdate {
 		update(cmd, getProject())
+	} else if cmd.cDeliver {
+		deliver(cmd, getProject())
+	} else if cmd.cQueue {
+		queue(cmd, getProject())
+	} else if cmd.cHistory {
+		history(cmd, getProject())
+	} else if cmd.cBroker {
+		runBroker(cmd)
+	} else if cmd.cServe {
+		serve(cmd, getProject())
 	} else if cmd.cHelp {
 		fmt.Print(usage)
 	}
@@ -78,7 +105,7 @@ func create(cmd *command) {
 
 func install(cmd *command, p *naos.Project) {
 	// install dependencies
-	exitIfSet(p.Install(cmd.oForce, os.Stdout))
+	exitIfSet(p.Install(cmd.oForce, cmd.oUpdate, cmd.oInsecure, os.Stdout))
 }
 
 func build(cmd *command, p *naos.Project) {
@@ -87,13 +114,150 @@ func build(cmd *command, p *naos.Project) {
 }
 
 func flash(cmd *command, p *naos.Project) {
+	// flash all devices if requested
+	if cmd.oAll {
+		provision(cmd, p)
+		return
+	}
+
 	// flash project
-	exitIfSet(p.Flash(cmd.aDevice, cmd.oErase, cmd.oAppOnly, os.Stdout))
+	exitIfSet(p.Flash(cmd.aDevice, cmd.oErase, cmd.oAppOnly, flashOverrides(cmd), os.Stdout))
+}
+
+func flashOverrides(cmd *command) naos.FlashOverrides {
+	// parse overrides
+	overrides, err := parseFlashOverrides(cmd.oBaud, cmd.oFlashMode, cmd.oFlashFreq, cmd.oBefore, cmd.oAfter)
+	exitIfSet(err)
+
+	return overrides
+}
+
+func parseFlashOverrides(baud, mode, freq, before, after string) (naos.FlashOverrides, error) {
+	// prepare overrides
+	overrides := naos.FlashOverrides{}
+
+	// prepare parser
+	parse := func(value string, fn func(config *naos.FlashConfig, value string) error) error {
+		if value == "" {
+			return nil
+		}
+
+		// handle entries in the form "value" or "port=value"
+		for _, entry := range strings.Split(value, ",") {
+			var port string
+			if i := strings.LastIndex(entry, "="); i >= 0 {
+				port, entry = entry[:i], entry[i+1:]
+			}
+
+			// update config
+			config := overrides[port]
+			err := fn(&config, entry)
+			if err != nil {
+				return err
+			}
+			overrides[port] = config
+		}
+
+		return nil
+	}
+
+	// parse options
+	err := parse(baud, func(config *naos.FlashConfig, value string) error {
+		rate, err := strconv.Atoi(value)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid baud rate '%s'", value)
+		}
+		config.BaudRate = rate
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parse(mode, func(config *naos.FlashConfig, value string) error {
+		config.Mode = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parse(freq, func(config *naos.FlashConfig, value string) error {
+		config.Frequency = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parse(before, func(config *naos.FlashConfig, value string) error {
+		config.Before = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parse(after, func(config *naos.FlashConfig, value string) error {
+		config.After = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+func provision(cmd *command, p *naos.Project) {
+	// prepare table
+	tbl := newTable("PORT", "MAC", "DEVICE NAME", "STEP", "PROGRESS", "ERROR")
+
+	// prepare list
+	var list []naos.BoardStatus
+
+	// provision boards
+	err := p.Provision(cmd.aFile, cmd.oErase, cmd.oAppOnly, flashOverrides(cmd), func(status *naos.BoardStatus) {
+		// update list
+		found := false
+		for i := range list {
+			if list[i].Port == status.Port {
+				list[i] = *status
+				found = true
+			}
+		}
+		if !found {
+			list = append(list, *status)
+		}
+
+		// clear previously printed table
+		tbl.clear()
+
+		// add rows
+		for _, s := range list {
+			// get device name and error string if set
+			name, errStr := "", ""
+			if s.Device != nil {
+				name = s.Device.Name
+			}
+			if s.Error != nil {
+				errStr = s.Error.Error()
+			}
+
+			// add row
+			tbl.add(s.Port, s.MAC, name, s.Step, fmt.Sprintf("%.0f%%", s.Progress*100), errStr)
+		}
+
+		// show table
+		tbl.show(0)
+	})
+
+	// save inventory
+	exitIfSet(p.SaveInventory())
+
+	// check error
+	exitIfSet(err)
 }
 
 func attach(cmd *command, p *naos.Project) {
 	// attach to device
-	exitIfSet(p.Attach(cmd.aDevice, cmd.oSimple, os.Stdout, os.Stdin))
+	exitIfSet(p.Attach(cmd.aDevice, cmd.oSimple, cmd.oTimestamp, cmd.oLog, os.Stdout, os.Stdin))
 }
 
 func run(cmd *command, p *naos.Project) {
@@ -101,15 +265,36 @@ func run(cmd *command, p *naos.Project) {
 	exitIfSet(p.Build(cmd.oClean, cmd.oAppOnly, os.Stdout))
 
 	// flash project
-	exitIfSet(p.Flash(cmd.aDevice, cmd.oErase, cmd.oAppOnly, os.Stdout))
+	exitIfSet(p.Flash(cmd.aDevice, cmd.oErase, cmd.oAppOnly, flashOverrides(cmd), os.Stdout))
 
 	// attach to device
-	exitIfSet(p.Attach(cmd.aDevice, cmd.oSimple, os.Stdout, os.Stdin))
+	exitIfSet(p.Attach(cmd.aDevice, cmd.oSimple, cmd.oTimestamp, cmd.oLog, os.Stdout, os.Stdin))
 }
 
 func config(cmd *command, p *naos.Project) {
-	// configure device
-	exitIfSet(p.Config(cmd.aFile, cmd.aDevice, os.Stdout))
+	// configure device if not reading
+	if !cmd.oRead {
+		exitIfSet(p.Config(cmd.aFile, cmd.aDevice, cmd.oOutput, os.Stdout))
+		return
+	}
+
+	// read configuration
+	values, err := p.ReadConfig(cmd.aDevice, os.Stderr)
+	exitIfSet(err)
+
+	// mask passwords unless requested
+	if !cmd.oReveal {
+		for key, value := range values {
+			if strings.Contains(key, "password") && value != "" {
+				values[key] = "********"
+			}
+		}
+	}
+
+	// print values
+	data, err := yaml.Marshal(values)
+	exitIfSet(err)
+	fmt.Print(string(data))
 }
 
 func format(_ *command, p *naos.Project) {
@@ -117,7 +302,56 @@ func format(_ *command, p *naos.Project) {
 	exitIfSet(p.Format(os.Stdout))
 }
 
-func list(_ *command, p *naos.Project) {
+func ports(cmd *command, p *naos.Project) {
+	// find ports
+	list, err := p.Ports()
+	exitIfSet(err)
+
+	// print ports if requested
+	if out := newPrinter(cmd); out != nil {
+		for _, port := range list {
+			out.print(port)
+		}
+
+		out.close()
+		return
+	}
+
+	// check ports
+	if len(list) == 0 {
+		exitWithError(utils.ErrNoPort.Error())
+	}
+
+	// prepare table
+	tbl := newTable("PORT", "ADAPTER", "VID:PID", "SERIAL", "PRODUCT")
+
+	// add rows
+	for _, port := range list {
+		id := ""
+		if port.VID != "" {
+			id = port.VID + ":" + port.PID
+		}
+		tbl.add(port.Name, port.Adapter, id, port.Serial, port.Product)
+	}
+
+	// show table
+	tbl.show(0)
+}
+
+func list(cmd *command, p *naos.Project) {
+	// print devices if requested
+	if out := newPrinter(cmd); out != nil {
+		for _, d := range sortDevices(p.Inventory.FilterDevices("*")) {
+			out.print(d)
+		}
+
+		out.close()
+		return
+	}
+
+	// show broker
+	fmt.Printf("Broker: %s\n\n", p.Inventory.Redact(p.Inventory.Broker))
+
 	// prepare table
 	tbl := newTable("DEVICE NAME", "DEVICE TYPE", "FIRMWARE VERSION", "BASE TOPIC")
 
@@ -131,15 +365,23 @@ func list(_ *command, p *naos.Project) {
 }
 
 func collect(cmd *command, p *naos.Project) {
-	// clear all previously collected devices
-	if cmd.oClear {
-		p.Inventory.Devices = make(map[string]*naos.Device)
-	}
-
 	// collect devices
-	list, err := p.Inventory.Collect(cmd.oDuration)
+	list, err := p.Inventory.Collect(cmd.oDuration, cmd.oClear)
 	exitIfSet(err)
 
+	// save inventory
+	exitIfSet(p.SaveInventory())
+
+	// print devices if requested
+	if out := newPrinter(cmd); out != nil {
+		for _, d := range sortDevices(list) {
+			out.print(d)
+		}
+
+		out.close()
+		return
+	}
+
 	// prepare table
 	tbl := newTable("DEVICE NAME", "DEVICE TYPE", "FIRMWARE VERSION", "BASE TOPIC")
 
@@ -150,31 +392,273 @@ func collect(cmd *command, p *naos.Project) {
 
 	// show table
 	tbl.show(0)
-
-	// save inventory
-	exitIfSet(p.SaveInventory())
 }
 
 func ping(cmd *command, p *naos.Project) {
-	// send message
-	exitIfSet(p.Inventory.Ping(cmd.aPattern, cmd.oTimeout))
+	// get printer
+	out := newPrinter(cmd)
+
+	// prepare channel
+	quit := make(chan struct{})
+
+	// close channel on interrupt
+	go func() {
+		exit := make(chan os.Signal, 1)
+		signal.Notify(exit, os.Interrupt)
+		<-exit
+		close(quit)
+	}()
+
+	// prepare statistics
+	type statistics struct {
+		sent, received int
+		min, max, sum  time.Duration
+	}
+
+	// prepare table
+	stats := make(map[*naos.Device]*statistics)
+
+	// send pings until count is reached or interrupted
+loop:
+	for seq := 1; cmd.oCount <= 0 || seq <= cmd.oCount; seq++ {
+		// wait for interval or quit
+		if seq > 1 {
+			select {
+			case <-time.After(cmd.oInterval):
+			case <-quit:
+				break loop
+			}
+		}
+
+		// ping devices
+		result, err := p.Inventory.Ping(cmd.aPattern, cmd.oTimeout)
+		exitIfSet(err)
+
+		// handle answering devices
+		for _, device := range result.Answering {
+			// get statistics
+			s := stats[device]
+			if s == nil {
+				s = &statistics{}
+				stats[device] = s
+			}
+
+			// get latency
+			latency := result.Latencies[device]
+
+			// update statistics
+			s.sent++
+			s.received++
+			s.sum += latency
+			if s.min == 0 || latency < s.min {
+				s.min = latency
+			}
+			if latency > s.max {
+				s.max = latency
+			}
+
+			// show response
+			infof(out, "[%s] seq=%d time=%s\n", device.Name, seq, formatLatency(latency))
+		}
+
+		// handle missing devices
+		for _, device := range result.Missing {
+			// get statistics
+			s := stats[device]
+			if s == nil {
+				s = &statistics{}
+				stats[device] = s
+			}
+
+			// update statistics
+			s.sent++
+
+			// show missing response
+			infof(out, "[%s] seq=%d no response\n", device.Name, seq)
+		}
+	}
+
+	// prepare table
+	tbl := newTable("DEVICE NAME", "SENT", "RECEIVED", "LOSS", "MIN", "AVG", "MAX")
+
+	// prepare counter
+	unreachable := 0
+
+	// prepare records
+	var records []pingRecord
+
+	// sort devices
+	devices := make([]*naos.Device, 0, len(stats))
+	for device := range stats {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+
+	// add rows
+	for _, device := range devices {
+		// get statistics
+		s := stats[device]
+
+		// prepare loss
+		loss := fmt.Sprintf("%.0f%%", float64(s.sent-s.received)/float64(s.sent)*100)
+
+		// count unreachable device
+		if s.received == 0 {
+			unreachable++
+		}
+
+		// add record if requested
+		if out != nil {
+			record := pingRecord{
+				Device:   device.Name,
+				Sent:     s.sent,
+				Received: s.received,
+				Loss:     float64(s.sent-s.received) / float64(s.sent),
+			}
+			if s.received > 0 {
+				record.Min = milliseconds(s.min)
+				record.Avg = milliseconds(s.sum / time.Duration(s.received))
+				record.Max = milliseconds(s.max)
+			}
+			records = append(records, record)
+			continue
+		}
+
+		// add unreachable device
+		if s.received == 0 {
+			tbl.add(device.Name, strconv.Itoa(s.sent), "0", loss, "-", "-", "-")
+			continue
+		}
+
+		// add row
+		avg := s.sum / time.Duration(s.received)
+		tbl.add(device.Name, strconv.Itoa(s.sent), strconv.Itoa(s.received), loss, formatLatency(s.min), formatLatency(avg), formatLatency(s.max))
+	}
+
+	// print records if requested
+	if out != nil {
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].Device < records[j].Device
+		})
+		for _, record := range records {
+			out.print(record)
+		}
+		out.close()
+	} else {
+		fmt.Println()
+		tbl.show(0)
+	}
+
+	// check unreachable devices
+	if unreachable > 0 {
+		exitWithError(fmt.Sprintf("%d device(s) are unreachable", unreachable))
+	}
 }
 
 func send(cmd *command, p *naos.Project) {
-	// send message
-	exitIfSet(p.Inventory.Send(cmd.aPattern, cmd.aTopic, cmd.aMessage, cmd.oTimeout))
+	// check format
+	checkFormat(cmd.oFormat)
+
+	// prepare message
+	message := []byte(cmd.aMessage)
+
+	// read message from file or stdin if requested
+	if cmd.oFile != "" {
+		message = readInput(cmd.oFile)
+	}
+
+	// prepare payload
+	payload := string(message)
+	if cmd.oFormat == "hex" || cmd.oFormat == "base64" {
+		payload = formatPayload(message, cmd.oFormat)
+	}
+
+	// check devices
+	guard(cmd, p, fmt.Sprintf("send a message to '%s'", cmd.aTopic), p.Inventory.FilterDevices(cmd.aPattern), func(d *naos.Device) (string, string) {
+		return d.BaseTopic + "/" + strings.Trim(cmd.aTopic, "/"), payload
+	})
+
+	// send message only if no reply is expected
+	if cmd.oExpect == "" {
+		exitIfSet(p.Inventory.Send(cmd.aPattern, cmd.aTopic, message, cmd.oTimeout))
+		return
+	}
+
+	// send message and await replies
+	result, err := p.Inventory.Request(cmd.aPattern, cmd.aTopic, message, cmd.oExpect, cmd.oRetries, cmd.oTimeout)
+	exitIfSet(err)
+
+	// print replies if requested
+	if out := newPrinter(cmd); out != nil {
+		for _, device := range sortDevices(result.Answering) {
+			out.print(replyRecord{Device: device.Name, Reply: formatPayload(result.Replies[device], cmd.oFormat)})
+		}
+		for _, device := range sortDevices(result.Missing) {
+			out.print(replyRecord{Device: device.Name, Missing: true})
+		}
+
+		out.close()
+		exitIfMissing(&result.Result)
+		return
+	}
+
+	// prepare table
+	tbl := newTable("DEVICE NAME", "REPLY")
+
+	// add rows
+	for _, device := range result.Answering {
+		tbl.add(device.Name, formatPayload(result.Replies[device], cmd.oFormat))
+	}
+
+	// add missing devices
+	for _, device := range result.Missing {
+		tbl.add(device.Name, "no response")
+	}
+
+	// show table
+	tbl.show(0)
+
+	// show info
+	fmt.Printf("\nGot reply from %d devices (%d missing).\n", len(result.Answering), len(result.Missing))
+
+	// check missing
+	exitIfMissing(&result.Result)
 }
 
 func discover(cmd *command, p *naos.Project) {
 	// discover parameters
-	list, err := p.Inventory.Discover(cmd.aPattern, cmd.oTimeout)
+	result, err := p.Inventory.Discover(cmd.aPattern, cmd.oRetries, cmd.oTimeout)
 	exitIfSet(err)
 
+	// print parameters if requested
+	if out := newPrinter(cmd); out != nil {
+		exitIfSet(p.SaveInventory())
+
+		for _, device := range sortDevices(result.Answering) {
+			var list []string
+			for p := range device.Parameters {
+				list = append(list, p)
+			}
+			sort.Strings(list)
+
+			out.print(parametersRecord{Device: device.Name, Parameters: list})
+		}
+		for _, device := range sortDevices(result.Missing) {
+			out.print(parametersRecord{Device: device.Name, Missing: true})
+		}
+
+		out.close()
+		exitIfMissing(result)
+		return
+	}
+
 	// prepare table
 	tbl := newTable("DEVICE NAME", "PARAMETERS")
 
 	// add rows
-	for _, device := range list {
+	for _, device := range result.Answering {
 		var list []string
 		for p := range device.Parameters {
 			list = append(list, p)
@@ -183,78 +667,179 @@ func discover(cmd *command, p *naos.Project) {
 		tbl.add(device.Name, strings.Join(list, ", "))
 	}
 
+	// add missing devices
+	for _, device := range result.Missing {
+		tbl.add(device.Name, "no response")
+	}
+
 	// show table
 	tbl.show(0)
 
 	// show info
-	fmt.Printf("\nGot parameters from %d devices.\n", len(list))
+	fmt.Printf("\nGot parameters from %d devices (%d missing).\n", len(result.Answering), len(result.Missing))
 
 	// save inventory
 	exitIfSet(p.SaveInventory())
+
+	// check missing
+	exitIfMissing(result)
 }
 
 func get(cmd *command, p *naos.Project) {
 	// get parameter
-	list, err := p.Inventory.GetParams(cmd.aPattern, cmd.aParam, cmd.oTimeout)
+	result, err := p.Inventory.GetParams(cmd.aPattern, cmd.aParam, cmd.oRetries, cmd.oTimeout)
 	exitIfSet(err)
 
-	// prepare table
-	tbl := newTable("DEVICE NAME", "VALUE")
+	// get printer
+	out := newPrinter(cmd)
 
-	// add rows
-	for _, device := range list {
-		tbl.add(device.Name, device.Parameters[cmd.aParam])
+	// print values if requested
+	if out != nil {
+		printValues(out, cmd.aParam, result)
+	} else {
+		showValues(cmd.aParam, result)
 	}
 
-	// show table
-	tbl.show(0)
-
 	// show info
-	fmt.Printf("\nGot parameter from %d devices.\n", len(list))
+	infof(out, "\nGot parameter from %d devices (%d missing).\n", len(result.Answering), len(result.Missing))
 
 	// save inventory
 	exitIfSet(p.SaveInventory())
+
+	// check missing
+	exitIfMissing(result)
 }
 
 func set(cmd *command, p *naos.Project) {
+	// check devices
+	guard(cmd, p, fmt.Sprintf("set '%s' to '%s'", cmd.aParam, cmd.aValue), p.Inventory.FilterDevices(cmd.aPattern), func(d *naos.Device) (string, string) {
+		return d.BaseTopic + "/naos/set/" + cmd.aParam, cmd.aValue
+	})
+
 	// set parameter
-	list, err := p.Inventory.SetParams(cmd.aPattern, cmd.aParam, cmd.aValue, cmd.oTimeout)
+	result, err := p.Inventory.SetParams(cmd.aPattern, cmd.aParam, cmd.aValue, cmd.oRetries, cmd.oTimeout)
 	exitIfSet(err)
 
+	// get printer
+	out := newPrinter(cmd)
+
+	// print values if requested
+	if out != nil {
+		printValues(out, cmd.aParam, result)
+	} else {
+		showValues(cmd.aParam, result)
+	}
+
+	// show info
+	infof(out, "\nSet parameter on %d devices (%d missing).\n", len(result.Answering), len(result.Missing))
+
+	// save inventory
+	exitIfSet(p.SaveInventory())
+
+	// queue operation for missing devices if requested
+	if cmd.oQueue {
+		for _, device := range result.Missing {
+			p.Queue.Add(&naos.Operation{
+				Device: device.Name,
+				Action: naos.SetAction,
+				Param:  cmd.aParam,
+				Value:  cmd.aValue,
+			})
+		}
+
+		exitIfSet(p.SaveQueue())
+		infof(out, "Queued operation for %d devices.\n", len(result.Missing))
+		return
+	}
+
+	// check missing
+	exitIfMissing(result)
+}
+
+func showValues(param string, result *naos.Result) {
 	// prepare table
 	tbl := newTable("DEVICE NAME", "VALUE")
 
 	// add rows
-	for _, device := range list {
-		tbl.add(device.Name, device.Parameters[cmd.aParam])
+	for _, device := range result.Answering {
+		tbl.add(device.Name, device.Parameters[param])
+	}
+
+	// add missing devices
+	for _, device := range result.Missing {
+		tbl.add(device.Name, "no response")
 	}
 
 	// show table
 	tbl.show(0)
+}
 
-	// show info
-	fmt.Printf("\nSet parameter on %d devices.\n", len(list))
+func printValues(out *printer, param string, result *naos.Result) {
+	// print answering devices
+	for _, device := range sortDevices(result.Answering) {
+		out.print(valueRecord{Device: device.Name, Param: param, Value: device.Parameters[param]})
+	}
 
-	// save inventory
-	exitIfSet(p.SaveInventory())
+	// print missing devices
+	for _, device := range sortDevices(result.Missing) {
+		out.print(valueRecord{Device: device.Name, Param: param, Missing: true})
+	}
+
+	out.close()
 }
 
 func unset(cmd *command, p *naos.Project) {
+	// check devices
+	guard(cmd, p, fmt.Sprintf("unset '%s'", cmd.aParam), p.Inventory.FilterDevices(cmd.aPattern), func(d *naos.Device) (string, string) {
+		return d.BaseTopic + "/naos/unset/" + cmd.aParam, ""
+	})
+
+	// ping devices to find offline devices if requested
+	var missing []*naos.Device
+	if cmd.oQueue {
+		result, err := p.Inventory.Ping(cmd.aPattern, cmd.oTimeout)
+		exitIfSet(err)
+		missing = result.Missing
+	}
+
 	// unset parameter
 	_, err := p.Inventory.UnsetParams(cmd.aPattern, cmd.aParam, cmd.oTimeout)
 	exitIfSet(err)
 
 	// save inventory
 	exitIfSet(p.SaveInventory())
+
+	// queue operation for missing devices if requested
+	if cmd.oQueue {
+		for _, device := range missing {
+			p.Queue.Add(&naos.Operation{
+				Device: device.Name,
+				Action: naos.UnsetAction,
+				Param:  cmd.aParam,
+			})
+		}
+
+		exitIfSet(p.SaveQueue())
+		fmt.Printf("Queued operation for %d devices.\n", len(missing))
+	}
 }
 
 func monitor(cmd *command, p *naos.Project) {
+	// get printer
+	out := newPrinter(cmd)
+
+	// run interactive monitor if possible
+	if out == nil && !cmd.oPlain && isTerminal(os.Stdout) {
+		runMonitorUI(cmd, p)
+		return
+	}
+
 	// prepare channel
 	quit := make(chan struct{})
 
 	// close channel on interrupt
 	go func() {
-		exit := make(chan os.Signal)
+		exit := make(chan os.Signal, 1)
 		signal.Notify(exit, os.Interrupt)
 		<-exit
 		close(quit)
@@ -267,7 +852,13 @@ func monitor(cmd *command, p *naos.Project) {
 	list := make(map[*naos.Device]*fleet.Heartbeat)
 
 	// monitor devices
-	exitIfSet(p.Inventory.Monitor(cmd.aPattern, quit, cmd.oTimeout, func(d *naos.Device, hb *fleet.Heartbeat) {
+	exitIfSet(p.Inventory.Monitor(cmd.aPattern, nil, quit, cmd.oTimeout, func(d *naos.Device, hb *fleet.Heartbeat) {
+		// print heartbeat if requested
+		if out != nil {
+			out.print(hb)
+			return
+		}
+
 		// set latest heartbeat for device
 		list[d] = hb
 
@@ -279,35 +870,19 @@ func monitor(cmd *command, p *naos.Project) {
 			// prepare free heap size
 			freeHeapSize := bytefmt.ByteSize(uint64(heartbeat.FreeHeapSize))
 
-			// prepare battery level
-			var batteryLevel string
-			if heartbeat.BatteryLevel >= 0 {
-				batteryLevel = strconv.FormatInt(int64(heartbeat.BatteryLevel*100), 10) + "%"
-			}
-
-			// prepare signal strength
-			var signalStrength string
-			if heartbeat.SignalStrength < 0 {
-				// map signal strength to percentage
-				ss := (100 - (heartbeat.SignalStrength * -1)) * 2
-				if ss > 100 {
-					ss = 100
-				} else if ss < 0 {
-					ss = 0
-				}
-
-				// format strength
-				signalStrength = strconv.FormatInt(ss, 10) + "%"
-			}
-
 			// add entry
-			tbl.add(device.Name, device.Type, device.FirmwareVersion, freeHeapSize, heartbeat.UpTime.String(), heartbeat.StartPartition, batteryLevel, signalStrength)
+			tbl.add(device.Name, device.Type, device.FirmwareVersion, freeHeapSize, heartbeat.UpTime.String(), heartbeat.StartPartition, formatBattery(heartbeat.BatteryLevel), formatSignal(heartbeat.SignalStrength))
 		}
 
 		// show table
 		tbl.show(0)
 	}))
 
+	// finish output
+	if out != nil {
+		out.close()
+	}
+
 	// save inventory
 	exitIfSet(p.SaveInventory())
 }
@@ -318,36 +893,123 @@ func record(cmd *command, p *naos.Project) {
 
 	// close channel on interrupt
 	go func() {
-		exit := make(chan os.Signal)
+		exit := make(chan os.Signal, 1)
 		signal.Notify(exit, os.Interrupt)
 		<-exit
 		close(quit)
 	}()
 
+	// get printer
+	out := newPrinter(cmd)
+
 	// record devices
 	exitIfSet(p.Inventory.Record(cmd.aPattern, quit, cmd.oTimeout, func(d *naos.Device, msg string) {
+		// print log message if requested
+		if out != nil {
+			out.print(logRecord{Time: time.Now(), Device: d.Name, Message: msg})
+			return
+		}
+
 		// show log message
 		fmt.Printf("[%s] %s\n", d.Name, msg)
 	}))
+
+	// finish output
+	if out != nil {
+		out.close()
+	}
+}
+
+func subscribe(cmd *command, p *naos.Project) {
+	// check format
+	checkFormat(cmd.oFormat)
+
+	// prepare channel
+	quit := make(chan struct{})
+
+	// close channel on interrupt
+	go func() {
+		exit := make(chan os.Signal, 1)
+		signal.Notify(exit, os.Interrupt)
+		<-exit
+		close(quit)
+	}()
+
+	// get printer
+	out := newPrinter(cmd)
+
+	// subscribe to devices
+	exitIfSet(p.Inventory.Subscribe(cmd.aPattern, cmd.aTopic, quit, cmd.oTimeout, func(d *naos.Device, msg *fleet.Message) {
+		// print message if requested
+		if out != nil {
+			out.print(messageRecord{Time: msg.ReceivedAt, Device: d.Name, Topic: msg.Topic, Payload: formatPayload(msg.Payload, cmd.oFormat)})
+			return
+		}
+
+		// show message
+		fmt.Printf("%s [%s] %s: %s\n", msg.ReceivedAt.Format("15:04:05.000"), d.Name, msg.Topic, formatPayload(msg.Payload, cmd.oFormat))
+	}))
+
+	// finish output
+	if out != nil {
+		out.close()
+	}
 }
 
 func debug(cmd *command, p *naos.Project) {
+	// check devices if coredumps are deleted
+	if cmd.oDelete {
+		guard(cmd, p, "delete coredumps", p.Inventory.FilterDevices(cmd.aPattern), func(d *naos.Device) (string, string) {
+			return d.BaseTopic + "/naos/debug", "delete"
+		})
+	}
+
 	// debug devices
 	exitIfSet(p.Debug(cmd.aPattern, cmd.oDelete, cmd.oDuration, os.Stdout))
 }
 
 func update(cmd *command, p *naos.Project) {
+	// get outdated devices
+	var devices []*naos.Device
+	for _, d := range p.Inventory.FilterDevices(cmd.aPattern) {
+		if d.FirmwareVersion != cmd.aVersion {
+			devices = append(devices, d)
+		}
+	}
+
+	// check devices
+	guard(cmd, p, fmt.Sprintf("update to '%s'", cmd.aVersion), devices, func(d *naos.Device) (string, string) {
+		return d.BaseTopic + "/naos/update/begin", fmt.Sprintf("firmware %s (from %s)", cmd.aVersion, d.FirmwareVersion)
+	})
+
 	// prepare table
 	tbl := newTable("DEVICE NAME", "PROGRESS", "ERROR")
 
 	// prepare list
 	list := make(map[*naos.Device]*fleet.UpdateStatus)
 
+	// snapshot image to queue the update for failed devices if requested
+	var image, checksum string
+	if cmd.oQueue {
+		var err error
+		image, checksum, err = p.SnapshotImage()
+		exitIfSet(err)
+	}
+
+	// get printer
+	out := newPrinter(cmd)
+
 	// update devices
 	err := p.Update(cmd.aVersion, cmd.aPattern, cmd.oJobs, cmd.oTimeout, func(d *naos.Device, us *fleet.UpdateStatus) {
 		// save status
 		list[d] = us
 
+		// print status if requested
+		if out != nil {
+			out.print(us)
+			return
+		}
+
 		// clear previously printed table
 		tbl.clear()
 
@@ -367,9 +1029,262 @@ func update(cmd *command, p *naos.Project) {
 		tbl.show(0)
 	})
 
+	// finish output
+	if out != nil {
+		out.close()
+	}
+
 	// save inventory
 	exitIfSet(p.SaveInventory())
 
+	// queue update for failed devices if requested
+	if cmd.oQueue {
+		queued, err := p.QueueUpdate(cmd.aVersion, image, checksum, devices, list)
+		exitIfSet(err)
+		infof(out, "\nQueued update for %d devices.\n", queued)
+	}
+
 	// check error
 	exitIfSet(err)
 }
+
+func deliver(cmd *command, p *naos.Project) {
+	// prepare channel
+	quit := make(chan struct{})
+
+	// close channel on interrupt
+	go func() {
+		exit := make(chan os.Signal, 1)
+		signal.Notify(exit, os.Interrupt)
+		<-exit
+		close(quit)
+	}()
+
+	// get printer
+	out := newPrinter(cmd)
+
+	// show info
+	infof(out, "Waiting for devices to deliver %d operations (press Ctrl+C to exit)...\n", len(p.Queue.Filter(cmd.aPattern)))
+
+	// deliver operations
+	err := p.Deliver(cmd.aPattern, quit, cmd.oTimeout, func(d *naos.Device, op *naos.Operation, err error) {
+		// print result if requested
+		if out != nil {
+			record := deliveryRecord{Device: d.Name, Action: op.Action, Details: formatDetails(op)}
+			if err != nil {
+				record.Error = err.Error()
+			}
+			out.print(record)
+			return
+		}
+
+		// get state
+		state := "delivered"
+		if err != nil {
+			state = "failed: " + err.Error()
+		}
+
+		// show result
+		fmt.Printf("[%s] %s: %s\n", d.Name, formatOperation(op), state)
+	})
+
+	// finish output
+	if out != nil {
+		out.close()
+	}
+
+	// save inventory
+	exitIfSet(p.SaveInventory())
+
+	// check error
+	exitIfSet(err)
+
+	// show info
+	infof(out, "%d operations remaining.\n", len(p.Queue.Filter(cmd.aPattern)))
+}
+
+func queue(cmd *command, p *naos.Project) {
+	// get operations
+	ops := p.Queue.Filter(cmd.aPattern)
+
+	// get printer
+	out := newPrinter(cmd)
+
+	// clear queue if requested
+	if cmd.oClear {
+		for _, op := range ops {
+			p.Queue.Remove(op)
+		}
+
+		exitIfSet(p.SaveQueue())
+
+		// print removed operations if requested
+		if out != nil {
+			for _, op := range ops {
+				out.print(op)
+			}
+			out.close()
+		}
+
+		infof(out, "Removed %d operations.\n", len(ops))
+		return
+	}
+
+	// print operations if requested
+	if out != nil {
+		for _, op := range ops {
+			out.print(op)
+		}
+
+		out.close()
+		return
+	}
+
+	// prepare table
+	tbl := newTable("DEVICE NAME", "ACTION", "DETAILS", "QUEUED AT")
+
+	// add rows
+	for _, op := range ops {
+		tbl.add(op.Device, op.Action, formatDetails(op), op.QueuedAt.Format(time.RFC3339))
+	}
+
+	// show table
+	tbl.show(0)
+}
+
+func history(cmd *command, p *naos.Project) {
+	// read journal
+	entries, err := p.History(cmd.aPattern)
+	exitIfSet(err)
+
+	// print entries if requested
+	if out := newPrinter(cmd); out != nil {
+		for _, e := range entries {
+			for _, d := range e.Devices {
+				out.print(historyRecord{
+					Time:    e.Time,
+					User:    e.User,
+					Action:  formatAction(e),
+					Device:  d.Name,
+					Before:  d.Before,
+					After:   d.After,
+					Outcome: d.Outcome,
+					Error:   d.Error,
+				})
+			}
+		}
+
+		out.close()
+		return
+	}
+
+	// prepare table
+	tbl := newTable("TIME", "USER", "ACTION", "DEVICE NAME", "BEFORE", "AFTER", "OUTCOME")
+
+	// add rows
+	for _, e := range entries {
+		for _, d := range e.Devices {
+			tbl.add(e.Time.Format(time.RFC3339), e.User, formatAction(e), d.Name, d.Before, d.After, d.Outcome)
+		}
+	}
+
+	// show table
+	tbl.show(0)
+}
+
+func runBroker(cmd *command) {
+	// prepare channel
+	quit := make(chan struct{})
+
+	// close channel on interrupt
+	go func() {
+		exit := make(chan os.Signal, 1)
+		signal.Notify(exit, os.Interrupt)
+		<-exit
+		close(quit)
+	}()
+
+	// prepare config
+	config := fleet.BrokerConfig{
+		TCPAddress:       cmd.oAddress,
+		WebSocketAddress: cmd.oWSAddress,
+		Username:         cmd.oUsername,
+		Password:         cmd.oPassword,
+		CertFile:         cmd.oCert,
+		KeyFile:          cmd.oKey,
+	}
+
+	// get host and port
+	_, port, err := net.SplitHostPort(cmd.oAddress)
+	exitIfSet(err)
+	host := localAddress()
+
+	// prepare url
+	brokerURL := url.URL{Scheme: "mqtt", Host: net.JoinHostPort(host, port)}
+	if cmd.oCert != "" {
+		brokerURL.Scheme = "mqtts"
+	}
+	if cmd.oUsername != "" {
+		brokerURL.User = url.UserPassword(cmd.oUsername, cmd.oPassword)
+	}
+
+	// get printer
+	out := newPrinter(cmd)
+
+	// show info
+	infof(out, "Broker URL: %s\n\n", brokerURL.String())
+	infof(out, "Device settings:\n")
+	infof(out, "  mqtt-host: %s\n", host)
+	infof(out, "  mqtt-port: %s\n", port)
+	if cmd.oUsername != "" {
+		infof(out, "  mqtt-username: %s\n", cmd.oUsername)
+		infof(out, "  mqtt-password: %s\n", cmd.oPassword)
+	}
+	infof(out, "\nRunning broker (press Ctrl+C to exit)...\n")
+
+	// run broker
+	exitIfSet(fleet.Broker(config, quit, func(e *fleet.BrokerEvent) {
+		// print event if requested
+		if out != nil {
+			out.print(e)
+			return
+		}
+
+		// get state
+		state := "disconnected"
+		if e.Online {
+			state = "connected"
+		}
+
+		// show event
+		fmt.Printf("%s [%s] %s (%s)\n", e.Time.Format("15:04:05.000"), e.ClientID, state, e.Remote)
+	}))
+
+	// finish output
+	if out != nil {
+		out.close()
+	}
+}
+
+func serve(cmd *command, p *naos.Project) {
+	// get token
+	token := cmd.oToken
+	if token == "" {
+		token = os.Getenv("NAOS_TOKEN")
+	}
+
+	// generate token if missing
+	if token == "" {
+		buf := make([]byte, 16)
+		_, err := rand.Read(buf)
+		exitIfSet(err)
+		token = hex.EncodeToString(buf)
+		fmt.Printf("Generated token: %s\n", token)
+	}
+
+	// show info
+	fmt.Printf("Serving API on http://%s/api (press Ctrl+C to exit)...\n", cmd.oListen)
+
+	// run server
+	exitIfSet(http.ListenAndServe(cmd.oListen, server.New(p, token)))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+func TestParseFlashOverrides(t *testing.T) {
+	overrides, err := parseFlashOverrides("", "", "", "", "")
+	assert.NoError(t, err)
+	assert.Empty(t, overrides)
+
+	overrides, err = parseFlashOverrides("460800,/dev/ttyUSB1=115200", "/dev/ttyUSB1=dout", "40m", "", "COM3=none")
+	assert.NoError(t, err)
+	assert.Equal(t, naos.FlashOverrides{
+		"":             {BaudRate: 460800, Frequency: "40m"},
+		"/dev/ttyUSB1": {BaudRate: 115200, Mode: "dout"},
+		"COM3":         {After: "none"},
+	}, overrides)
+
+	_, err = parseFlashOverrides("/dev/ttyUSB1=fast", "", "", "", "")
+	assert.EqualError(t, err, "invalid baud rate 'fast'")
+}
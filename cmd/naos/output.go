@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+type pingRecord struct {
+	Device   string  `json:"device"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"`
+	Min      float64 `json:"min_ms"`
+	Avg      float64 `json:"avg_ms"`
+	Max      float64 `json:"max_ms"`
+}
+
+type replyRecord struct {
+	Device  string `json:"device"`
+	Reply   string `json:"reply"`
+	Missing bool   `json:"missing"`
+}
+
+type parametersRecord struct {
+	Device     string   `json:"device"`
+	Parameters []string `json:"parameters"`
+	Missing    bool     `json:"missing"`
+}
+
+type valueRecord struct {
+	Device  string `json:"device"`
+	Param   string `json:"param"`
+	Value   string `json:"value"`
+	Missing bool   `json:"missing"`
+}
+
+type logRecord struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	Message string    `json:"message"`
+}
+
+type messageRecord struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device"`
+	Topic   string    `json:"topic"`
+	Payload string    `json:"payload"`
+}
+
+type deliveryRecord struct {
+	Device  string `json:"device"`
+	Action  string `json:"action"`
+	Details string `json:"details"`
+	Error   string `json:"error"`
+}
+
+type historyRecord struct {
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	Action  string    `json:"action"`
+	Device  string    `json:"device"`
+	Before  string    `json:"before"`
+	After   string    `json:"after"`
+	Outcome string    `json:"outcome"`
+	Error   string    `json:"error"`
+}
+
+// A printer writes records in a machine-readable format. Records are written
+// as they are printed which allows streaming commands to use the same formats
+// as commands that print a fixed list. The field names are taken from the
+// JSON tags of the records.
+type printer struct {
+	format string
+	writer io.Writer
+	csv    *csv.Writer
+	header []string
+	count  int
+}
+
+// newPrinter returns a printer for the requested output format or nil if the
+// default text output has been requested.
+func newPrinter(cmd *command) *printer {
+	// check format
+	switch cmd.oOutput {
+	case "", "text":
+		return nil
+	case "json", "jsonl", "csv", "yaml":
+	default:
+		exitWithError(fmt.Sprintf("unknown output format '%s'", cmd.oOutput))
+	}
+
+	return &printer{
+		format: cmd.oOutput,
+		writer: os.Stdout,
+		csv:    csv.NewWriter(os.Stdout),
+	}
+}
+
+// print will write the provided record.
+func (p *printer) print(record interface{}) {
+	// encode record
+	data, err := json.Marshal(record)
+	exitIfSet(err)
+
+	// write record
+	switch p.format {
+	case "json":
+		// write separator
+		sep := ",\n"
+		if p.count == 0 {
+			sep = "[\n"
+		}
+
+		// indent record
+		var buf bytes.Buffer
+		exitIfSet(json.Indent(&buf, data, "  ", "  "))
+
+		// write record
+		_, err = fmt.Fprintf(p.writer, "%s  %s", sep, buf.String())
+		exitIfSet(err)
+	case "jsonl":
+		_, err = fmt.Fprintf(p.writer, "%s\n", data)
+		exitIfSet(err)
+	case "csv":
+		// get fields
+		keys, values, err := orderedFields(data)
+		exitIfSet(err)
+
+		// write header for first record
+		if p.count == 0 {
+			p.header = keys
+			exitIfSet(p.csv.Write(keys))
+		}
+
+		// prepare row in header order
+		row := make([]string, 0, len(p.header))
+		for _, key := range p.header {
+			row = append(row, csvValue(values[key]))
+		}
+
+		// write row
+		exitIfSet(p.csv.Write(row))
+		p.csv.Flush()
+		exitIfSet(p.csv.Error())
+	case "yaml":
+		// convert record, JSON is valid YAML and the map slice retains the
+		// order of the fields
+		var item yaml.MapSlice
+		exitIfSet(yaml.Unmarshal(data, &item))
+
+		// encode record as list item
+		out, err := yaml.Marshal([]yaml.MapSlice{item})
+		exitIfSet(err)
+
+		// write record
+		_, err = p.writer.Write(out)
+		exitIfSet(err)
+	}
+
+	// increment counter
+	p.count++
+}
+
+// close will finish the output.
+func (p *printer) close() {
+	// finish output
+	switch p.format {
+	case "json":
+		if p.count == 0 {
+			_, _ = fmt.Fprint(p.writer, "[]\n")
+		} else {
+			_, _ = fmt.Fprint(p.writer, "\n]\n")
+		}
+	case "yaml":
+		if p.count == 0 {
+			_, _ = fmt.Fprint(p.writer, "[]\n")
+		}
+	}
+}
+
+func orderedFields(data []byte) ([]string, map[string]json.RawMessage, error) {
+	// prepare decoder
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// read opening delimiter
+	_, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// prepare result
+	var keys []string
+	values := make(map[string]json.RawMessage)
+
+	// read fields
+	for dec.More() {
+		// read key
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// read value
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// add field
+		key := fmt.Sprint(tok)
+		keys = append(keys, key)
+		values[key] = value
+	}
+
+	return keys, values, nil
+}
+
+func csvValue(raw json.RawMessage) string {
+	// handle missing and null values
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+
+	// unquote strings
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return str
+	}
+
+	// keep numbers, booleans, objects and arrays as JSON
+	return string(raw)
+}
+
+// infof will print informational output. The output is written to stderr if a
+// printer is used to keep stdout machine-readable.
+func infof(out *printer, format string, args ...interface{}) {
+	if out != nil {
+		fmt.Fprintf(os.Stderr, format, args...)
+	} else {
+		fmt.Printf(format, args...)
+	}
+}
+
+func sortDevices(devices []*naos.Device) []*naos.Device {
+	// sort devices by name
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+
+	return devices
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/nsf/termbox-go"
+
+	"github.com/256dpi/naos/pkg/fleet"
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+// The thresholds used to highlight devices.
+const (
+	staleAfter = 30 * time.Second
+	lowHeap    = 20 * 1024
+	lowBattery = 0.2
+	lowSignal  = 30
+)
+
+// The number of retained heap samples and log lines per device.
+const (
+	heapSamples = 60
+	heapWidth   = 20
+	logLines    = 200
+)
+
+type level int
+
+const (
+	normal level = iota
+	warning
+	critical
+)
+
+type deviceState struct {
+	device    *naos.Device
+	heartbeat *fleet.Heartbeat
+	heap      []int64
+	params    map[string]string
+	logs      []string
+}
+
+func (s *deviceState) stale() bool {
+	return s.heartbeat == nil || time.Since(s.heartbeat.ReceivedAt) > staleAfter
+}
+
+type column struct {
+	title string
+	width int
+	value func(*fleet.Heartbeat) string
+	key   func(*fleet.Heartbeat) float64
+	level func(*fleet.Heartbeat) level
+}
+
+// text returns the cell text for the device.
+func (c *column) text(s *deviceState) string {
+	// handle name
+	if c.value == nil {
+		return s.device.Name
+	}
+
+	// handle missing heartbeat
+	if s.heartbeat == nil {
+		return "-"
+	}
+
+	return c.value(s.heartbeat)
+}
+
+// less reports whether device a sorts before device b. Devices without
+// heartbeats are sorted first.
+func (c *column) less(a, b *deviceState) bool {
+	// compare text if no key is available
+	if c.key == nil || a.heartbeat == nil || b.heartbeat == nil {
+		return c.text(a) < c.text(b)
+	}
+
+	return c.key(a.heartbeat) < c.key(b.heartbeat)
+}
+
+var columns = []column{
+	{
+		title: "DEVICE NAME",
+		width: 20,
+	},
+	{
+		title: "TYPE",
+		width: 12,
+		value: func(hb *fleet.Heartbeat) string { return hb.DeviceType },
+	},
+	{
+		title: "VERSION",
+		width: 10,
+		value: func(hb *fleet.Heartbeat) string { return hb.FirmwareVersion },
+	},
+	{
+		title: "FREE HEAP",
+		width: 10,
+		value: func(hb *fleet.Heartbeat) string { return bytefmt.ByteSize(uint64(hb.FreeHeapSize)) },
+		key:   func(hb *fleet.Heartbeat) float64 { return float64(hb.FreeHeapSize) },
+		level: func(hb *fleet.Heartbeat) level {
+			if hb.FreeHeapSize < lowHeap {
+				return critical
+			}
+			return normal
+		},
+	},
+	{
+		title: "UP TIME",
+		width: 14,
+		value: func(hb *fleet.Heartbeat) string { return hb.UpTime.String() },
+		key:   func(hb *fleet.Heartbeat) float64 { return float64(hb.UpTime) },
+	},
+	{
+		title: "PARTITION",
+		width: 10,
+		value: func(hb *fleet.Heartbeat) string { return hb.StartPartition },
+	},
+	{
+		title: "BATTERY",
+		width: 8,
+		value: func(hb *fleet.Heartbeat) string { return formatBattery(hb.BatteryLevel) },
+		key:   func(hb *fleet.Heartbeat) float64 { return hb.BatteryLevel },
+		level: func(hb *fleet.Heartbeat) level {
+			if hb.BatteryLevel >= 0 && hb.BatteryLevel < lowBattery {
+				return critical
+			}
+			return normal
+		},
+	},
+	{
+		title: "SIGNAL",
+		width: 7,
+		value: func(hb *fleet.Heartbeat) string { return formatSignal(hb.SignalStrength) },
+		key:   func(hb *fleet.Heartbeat) float64 { return float64(signalPercentage(hb.SignalStrength)) },
+		level: func(hb *fleet.Heartbeat) level {
+			if hb.SignalStrength < 0 && signalPercentage(hb.SignalStrength) < lowSignal {
+				return warning
+			}
+			return normal
+		},
+	},
+	{
+		title: "LAST SEEN",
+		width: 10,
+		value: func(hb *fleet.Heartbeat) string { return time.Since(hb.ReceivedAt).Truncate(time.Second).String() },
+		key:   func(hb *fleet.Heartbeat) float64 { return -float64(hb.ReceivedAt.UnixNano()) },
+	},
+}
+
+type paramsUpdate struct {
+	device *naos.Device
+	params map[string]string
+	err    error
+}
+
+type logUpdate struct {
+	device *naos.Device
+	line   string
+}
+
+type monitorUI struct {
+	cmd     *command
+	project *naos.Project
+	states  map[*naos.Device]*deviceState
+	rows    []*deviceState
+
+	sortColumn int
+	reverse    bool
+	filter     string
+	filtering  bool
+	selected   *deviceState
+	offset     int
+	detail     *deviceState
+	recording  chan struct{}
+	status     string
+
+	heartbeats chan *fleet.Heartbeat
+	params     chan paramsUpdate
+	logs       chan logUpdate
+	quit       chan struct{}
+	mutex      sync.Mutex
+	refreshing sync.WaitGroup
+}
+
+func runMonitorUI(cmd *command, p *naos.Project) {
+	// prepare ui
+	ui := &monitorUI{
+		cmd:        cmd,
+		project:    p,
+		states:     make(map[*naos.Device]*deviceState),
+		heartbeats: make(chan *fleet.Heartbeat, 64),
+		params:     make(chan paramsUpdate, 1),
+		logs:       make(chan logUpdate, 64),
+		quit:       make(chan struct{}),
+	}
+
+	// add devices, parameters are copied as refreshed parameters are only
+	// applied to the inventory on the ui goroutine
+	for _, device := range p.Inventory.FilterDevices(cmd.aPattern) {
+		params := make(map[string]string)
+		for key, value := range device.Parameters {
+			params[key] = value
+		}
+
+		ui.states[device] = &deviceState{device: device, params: params}
+	}
+
+	// check devices
+	if len(ui.states) == 0 {
+		exitWithError("no matching devices")
+	}
+
+	// prepare lookup
+	lookup := make(map[string]*naos.Device)
+	for device := range ui.states {
+		lookup[device.BaseTopic] = device
+	}
+
+	// initialize terminal
+	exitIfSet(termbox.Init())
+
+	// poll events
+	events := make(chan termbox.Event)
+	go func() {
+		for {
+			ev := termbox.PollEvent()
+			if ev.Type == termbox.EventInterrupt {
+				return
+			}
+
+			events <- ev
+		}
+	}()
+
+	// monitor devices
+	quit := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- p.Inventory.Monitor(cmd.aPattern, &ui.mutex, quit, cmd.oTimeout, func(_ *naos.Device, hb *fleet.Heartbeat) {
+			select {
+			case ui.heartbeats <- hb:
+			case <-quit:
+			}
+		})
+	}()
+
+	// prepare ticker to refresh ages
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// run loop
+	var err error
+loop:
+	for {
+		// draw screen
+		ui.draw()
+
+		select {
+		case ev := <-events:
+			if !ui.handle(ev) {
+				break loop
+			}
+		case hb := <-ui.heartbeats:
+			if device, ok := lookup[hb.BaseTopic]; ok {
+				ui.heartbeat(ui.states[device], hb)
+			}
+		case update := <-ui.params:
+			if update.err != nil {
+				ui.status = "error: " + update.err.Error()
+			} else {
+				ui.applyParams(update)
+				ui.status = "parameters refreshed"
+			}
+		case update := <-ui.logs:
+			state := ui.states[update.device]
+			state.logs = append(state.logs, update.line)
+			if len(state.logs) > logLines {
+				state.logs = state.logs[len(state.logs)-logLines:]
+			}
+		case <-ticker.C:
+		case err = <-errs:
+			break loop
+		}
+	}
+
+	// stop recording
+	ui.stopRecording()
+
+	// stop and wait for parameter refreshes
+	close(ui.quit)
+	ui.refreshing.Wait()
+
+	// restore terminal
+	termbox.Interrupt()
+	termbox.Close()
+
+	// stop monitor and wait for it unless it already failed
+	if err == nil {
+		close(quit)
+		err = <-errs
+	}
+
+	// check error
+	exitIfSet(err)
+
+	// save inventory
+	exitIfSet(p.SaveInventory())
+}
+
+func (ui *monitorUI) heartbeat(state *deviceState, hb *fleet.Heartbeat) {
+	// set heartbeat
+	state.heartbeat = hb
+
+	// add heap sample
+	state.heap = append(state.heap, hb.FreeHeapSize)
+	if len(state.heap) > heapSamples {
+		state.heap = state.heap[len(state.heap)-heapSamples:]
+	}
+}
+
+func (ui *monitorUI) handle(ev termbox.Event) bool {
+	// handle resize
+	if ev.Type != termbox.EventKey {
+		return true
+	}
+
+	// handle filter input
+	if ui.filtering {
+		switch ev.Key {
+		case termbox.KeyEnter:
+			ui.filtering = false
+		case termbox.KeyEsc:
+			ui.filtering = false
+			ui.filter = ""
+		case termbox.KeyBackspace, termbox.KeyBackspace2:
+			if len(ui.filter) > 0 {
+				ui.filter = ui.filter[:len(ui.filter)-1]
+			}
+		case termbox.KeySpace:
+			ui.filter += " "
+		default:
+			if ev.Ch != 0 {
+				ui.filter += string(ev.Ch)
+			}
+		}
+
+		return true
+	}
+
+	// handle quit
+	if ev.Key == termbox.KeyCtrlC || ev.Ch == 'q' {
+		return false
+	}
+
+	// handle detail view
+	if ui.detail != nil {
+		switch {
+		case ev.Key == termbox.KeyEsc || ev.Key == termbox.KeyBackspace || ev.Key == termbox.KeyBackspace2:
+			ui.stopRecording()
+			ui.detail = nil
+			ui.status = ""
+		case ev.Ch == 'p':
+			ui.refreshParams(ui.detail.device)
+		}
+
+		return true
+	}
+
+	// handle list view
+	switch {
+	case ev.Key == termbox.KeyArrowUp || ev.Ch == 'k':
+		ui.move(-1)
+	case ev.Key == termbox.KeyArrowDown || ev.Ch == 'j':
+		ui.move(1)
+	case ev.Key == termbox.KeyPgup:
+		ui.move(-ui.pageSize())
+	case ev.Key == termbox.KeyPgdn:
+		ui.move(ui.pageSize())
+	case ev.Key == termbox.KeyHome:
+		ui.move(-len(ui.rows))
+	case ev.Key == termbox.KeyEnd:
+		ui.move(len(ui.rows))
+	case ev.Key == termbox.KeyArrowLeft:
+		ui.sortColumn = (ui.sortColumn + len(columns) - 1) % len(columns)
+	case ev.Key == termbox.KeyArrowRight:
+		ui.sortColumn = (ui.sortColumn + 1) % len(columns)
+	case ev.Ch >= '1' && ev.Ch <= '9' && int(ev.Ch-'1') < len(columns):
+		ui.sortColumn = int(ev.Ch - '1')
+	case ev.Ch == 'r':
+		ui.reverse = !ui.reverse
+	case ev.Ch == '/':
+		ui.filtering = true
+	case ev.Key == termbox.KeyEsc:
+		ui.filter = ""
+	case ev.Key == termbox.KeyEnter:
+		if ui.selected != nil {
+			ui.detail = ui.selected
+			ui.startRecording(ui.detail.device)
+		}
+	}
+
+	return true
+}
+
+func (ui *monitorUI) move(delta int) {
+	// check rows
+	if len(ui.rows) == 0 {
+		return
+	}
+
+	// get new index
+	index := ui.index() + delta
+	if index < 0 {
+		index = 0
+	} else if index >= len(ui.rows) {
+		index = len(ui.rows) - 1
+	}
+
+	// select row
+	ui.selected = ui.rows[index]
+}
+
+func (ui *monitorUI) index() int {
+	// find selected row
+	for i, row := range ui.rows {
+		if row == ui.selected {
+			return i
+		}
+	}
+
+	return 0
+}
+
+func (ui *monitorUI) pageSize() int {
+	// get height
+	_, height := termbox.Size()
+
+	// subtract title, header and status line
+	if height-3 < 1 {
+		return 1
+	}
+
+	return height - 3
+}
+
+func (ui *monitorUI) startRecording(device *naos.Device) {
+	// stop previous recording
+	ui.stopRecording()
+
+	// prepare channel
+	quit := make(chan struct{})
+	ui.recording = quit
+
+	// record logs of device
+	go func() {
+		err := ui.project.Inventory.Record(device.Name, quit, ui.cmd.oTimeout, func(_ *naos.Device, msg string) {
+			select {
+			case ui.logs <- logUpdate{device: device, line: time.Now().Format("15:04:05.000") + " " + msg}:
+			case <-quit:
+			}
+		})
+		if err != nil {
+			select {
+			case ui.logs <- logUpdate{device: device, line: "error: " + err.Error()}:
+			case <-quit:
+			}
+		}
+	}()
+}
+
+func (ui *monitorUI) stopRecording() {
+	// close channel
+	if ui.recording != nil {
+		close(ui.recording)
+		ui.recording = nil
+	}
+}
+
+func (ui *monitorUI) refreshParams(device *naos.Device) {
+	// set status
+	ui.status = "refreshing parameters..."
+
+	// copy inventory as the refresh updates the parameters of its devices
+	ui.mutex.Lock()
+	inv := ui.project.Inventory.Copy()
+	ui.mutex.Unlock()
+
+	// discover and read parameters
+	ui.refreshing.Add(1)
+	go func() {
+		defer ui.refreshing.Done()
+
+		// prepare update
+		update := paramsUpdate{device: device}
+
+		// discover parameters
+		_, update.err = inv.Discover(device.Name, 0, ui.cmd.oTimeout)
+
+		// read parameters
+		if update.err == nil {
+			for param := range inv.Devices[device.Name].Parameters {
+				_, update.err = inv.GetParams(device.Name, param, 0, ui.cmd.oTimeout)
+				if update.err != nil {
+					break
+				}
+			}
+		}
+
+		// set parameters
+		if update.err == nil {
+			update.params = inv.Devices[device.Name].Parameters
+		}
+
+		// send update
+		select {
+		case ui.params <- update:
+		case <-ui.quit:
+		}
+	}()
+}
+
+func (ui *monitorUI) applyParams(update paramsUpdate) {
+	// update inventory
+	if update.device.Parameters == nil {
+		update.device.Parameters = make(map[string]string)
+	}
+	for key, value := range update.params {
+		update.device.Parameters[key] = value
+	}
+
+	// copy parameters
+	params := make(map[string]string, len(update.params))
+	for key, value := range update.params {
+		params[key] = value
+	}
+
+	// set parameters
+	ui.states[update.device].params = params
+}
+
+func (ui *monitorUI) update() {
+	// filter devices
+	ui.rows = ui.rows[:0]
+	for _, state := range ui.states {
+		if ui.matches(state) {
+			ui.rows = append(ui.rows, state)
+		}
+	}
+
+	// sort devices
+	col := &columns[ui.sortColumn]
+	sort.SliceStable(ui.rows, func(i, j int) bool {
+		a, b := ui.rows[i], ui.rows[j]
+		if ui.reverse {
+			a, b = b, a
+		}
+		if col.less(a, b) {
+			return true
+		} else if col.less(b, a) {
+			return false
+		}
+		return a.device.Name < b.device.Name
+	})
+
+	// ensure selection
+	if len(ui.rows) > 0 && (ui.selected == nil || !ui.matches(ui.selected)) {
+		ui.selected = ui.rows[0]
+	}
+}
+
+func (ui *monitorUI) matches(state *deviceState) bool {
+	// check filter
+	if ui.filter == "" {
+		return true
+	}
+
+	// match any column
+	filter := strings.ToLower(ui.filter)
+	for _, col := range columns {
+		if strings.Contains(strings.ToLower(col.text(state)), filter) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ui *monitorUI) draw() {
+	// clear screen
+	_ = termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+
+	// draw view
+	if ui.detail != nil {
+		ui.drawDetail()
+	} else {
+		ui.drawList()
+	}
+
+	// flush screen
+	_ = termbox.Flush()
+}
+
+func (ui *monitorUI) drawList() {
+	// update rows
+	ui.update()
+
+	// get size
+	width, height := termbox.Size()
+
+	// draw title
+	title := fmt.Sprintf(" naos monitor - %d devices, %d shown", len(ui.states), len(ui.rows))
+	if ui.filter != "" {
+		title += fmt.Sprintf(" - filter: %s", ui.filter)
+	}
+	drawLine(0, width, title, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+
+	// draw header
+	x := 0
+	for i, col := range columns {
+		// prepare title
+		text := col.title
+		if i == ui.sortColumn {
+			if ui.reverse {
+				text += " ▼"
+			} else {
+				text += " ▲"
+			}
+		}
+
+		// draw title
+		drawText(x, 1, pad(text, col.width), termbox.AttrBold, termbox.ColorDefault)
+		x += col.width + 2
+	}
+	drawText(x, 1, "HEAP HISTORY", termbox.AttrBold, termbox.ColorDefault)
+
+	// adjust offset to keep selection visible
+	page := ui.pageSize()
+	index := ui.index()
+	if index < ui.offset {
+		ui.offset = index
+	} else if index >= ui.offset+page {
+		ui.offset = index - page + 1
+	}
+	if ui.offset > len(ui.rows)-page {
+		ui.offset = len(ui.rows) - page
+	}
+	if ui.offset < 0 {
+		ui.offset = 0
+	}
+
+	// draw rows
+	for i := 0; i < page && ui.offset+i < len(ui.rows); i++ {
+		// get state
+		state := ui.rows[ui.offset+i]
+		y := i + 2
+
+		// prepare background
+		bg := termbox.ColorDefault
+		if state == ui.selected {
+			bg = termbox.ColorBlue
+		}
+
+		// draw cells
+		x := 0
+		for _, col := range columns {
+			// get color
+			fg := termbox.ColorDefault
+			if state.stale() {
+				fg = termbox.ColorDarkGray
+			}
+			if col.level != nil && state.heartbeat != nil {
+				switch col.level(state.heartbeat) {
+				case warning:
+					fg = termbox.ColorYellow
+				case critical:
+					fg = termbox.ColorRed
+				}
+			}
+
+			// draw cell
+			drawText(x, y, pad(col.text(state), col.width+2), fg, bg)
+			x += col.width + 2
+		}
+
+		// draw heap history
+		drawText(x, y, pad(sparkline(state.heap, heapWidth), heapWidth+2), termbox.ColorGreen, bg)
+		x += heapWidth + 2
+
+		// fill rest of line
+		drawText(x, y, strings.Repeat(" ", max(0, width-x)), termbox.ColorDefault, bg)
+	}
+
+	// draw status line
+	if ui.filtering {
+		drawLine(height-1, width, "/"+ui.filter+"_", termbox.ColorDefault, termbox.ColorDefault)
+	} else {
+		drawLine(height-1, width, " ↑↓ select  ←→/1-9 sort  r reverse  / filter  enter details  q quit", termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+	}
+}
+
+func (ui *monitorUI) drawDetail() {
+	// get state
+	state := ui.detail
+
+	// get size
+	width, height := termbox.Size()
+
+	// draw title
+	drawLine(0, width, " naos monitor - "+state.device.Name, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+
+	// prepare info
+	info := [][2]string{
+		{"Base Topic", state.device.BaseTopic},
+	}
+	for _, col := range columns[1:] {
+		info = append(info, [2]string{col.title, col.text(state)})
+	}
+	info = append(info, [2]string{"HEAP HISTORY", sparkline(state.heap, width-20)})
+
+	// draw info
+	y := 2
+	for _, line := range info {
+		drawText(1, y, pad(line[0], 16), termbox.AttrBold, termbox.ColorDefault)
+		drawText(18, y, line[1], termbox.ColorDefault, termbox.ColorDefault)
+		y++
+	}
+
+	// draw parameters
+	y++
+	drawText(1, y, "Parameters", termbox.AttrBold, termbox.ColorDefault)
+	y++
+
+	// sort parameters
+	var keys []string
+	for key := range state.params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// draw parameters
+	for _, key := range keys {
+		if y >= height-4 {
+			break
+		}
+		drawText(3, y, pad(key, 20)+" "+state.params[key], termbox.ColorDefault, termbox.ColorDefault)
+		y++
+	}
+
+	// draw logs
+	y++
+	drawText(1, y, "Logs", termbox.AttrBold, termbox.ColorDefault)
+	y++
+
+	// get visible logs
+	logs := state.logs
+	if available := height - 1 - y; available < len(logs) {
+		if available < 0 {
+			available = 0
+		}
+		logs = logs[len(logs)-available:]
+	}
+
+	// draw logs
+	for _, line := range logs {
+		drawText(3, y, line, termbox.ColorDefault, termbox.ColorDefault)
+		y++
+	}
+
+	// draw status line
+	status := " esc back  p refresh parameters  q quit"
+	if ui.status != "" {
+		status += "  -  " + ui.status
+	}
+	drawLine(height-1, width, status, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+}
+
+func drawText(x, y int, text string, fg, bg termbox.Attribute) {
+	for _, r := range text {
+		termbox.SetCell(x, y, r, fg, bg)
+		x++
+	}
+}
+
+func drawLine(y, width int, text string, fg, bg termbox.Attribute) {
+	drawText(0, y, pad(text, width), fg, bg)
+}
+
+func pad(text string, width int) string {
+	// check width
+	if width <= 0 {
+		return ""
+	}
+
+	// get length
+	runes := []rune(text)
+
+	// truncate text
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
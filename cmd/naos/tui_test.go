@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/naos/pkg/fleet"
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+func TestSparkline(t *testing.T) {
+	assert.Equal(t, "", sparkline(nil, 10))
+	assert.Equal(t, "██", sparkline([]int64{5, 5}, 10))
+	assert.Equal(t, "▁▄█", sparkline([]int64{0, 50, 100}, 10))
+	assert.Equal(t, "▁█", sparkline([]int64{100, 0, 100}, 2))
+}
+
+func TestPad(t *testing.T) {
+	assert.Equal(t, "", pad("foo", 0))
+	assert.Equal(t, "fo", pad("foo", 2))
+	assert.Equal(t, "foo  ", pad("foo", 5))
+	assert.Equal(t, "ä ", pad("ä", 2))
+}
+
+func TestMonitorUIMatches(t *testing.T) {
+	state := &deviceState{
+		device:    &naos.Device{Name: "Foo"},
+		heartbeat: &fleet.Heartbeat{DeviceType: "sensor", FirmwareVersion: "1.2.3", ReceivedAt: time.Now()},
+	}
+
+	ui := &monitorUI{}
+	assert.True(t, ui.matches(state))
+
+	ui.filter = "foo"
+	assert.True(t, ui.matches(state))
+
+	ui.filter = "SENS"
+	assert.True(t, ui.matches(state))
+
+	ui.filter = "1.2.3"
+	assert.True(t, ui.matches(state))
+
+	ui.filter = "bar"
+	assert.False(t, ui.matches(state))
+}
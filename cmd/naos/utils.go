@@ -1,25 +1,116 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/256dpi/naos/pkg/naos"
 )
 
 func exitIfSet(errs ...error) {
 	for _, err := range errs {
+		// only warn if the operation succeeded but the journal failed
+		if err != nil && !naos.OperationFailed(err) {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", redact(err.Error()))
+			continue
+		}
+
 		if err != nil {
 			exitWithError(err.Error())
 		}
 	}
 }
 
+var redact = func(str string) string {
+	return str
+}
+
 func exitWithError(str string) {
-	fmt.Fprintf(os.Stderr, "Error: %s\n", str)
+	fmt.Fprintf(os.Stderr, "Error: %s\n", redact(str))
 	os.Exit(1)
 }
 
+func exitIfMissing(result *naos.Result) {
+	if len(result.Missing) > 0 {
+		exitWithError(fmt.Sprintf("%d device(s) did not respond", len(result.Missing)))
+	}
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+func readInput(path string) []byte {
+	// read from stdin
+	if path == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		exitIfSet(err)
+		return data
+	}
+
+	// read from file
+	data, err := ioutil.ReadFile(path)
+	exitIfSet(err)
+
+	return data
+}
+
+var payloadFormats = []string{"text", "hex", "base64", "json"}
+
+func checkFormat(format string) {
+	// check format
+	for _, f := range payloadFormats {
+		if f == format {
+			return
+		}
+	}
+
+	exitWithError(fmt.Sprintf("unknown payload format '%s' (valid formats: %s)", format, strings.Join(payloadFormats, ", ")))
+}
+
+func formatPayload(payload []byte, format string) string {
+	switch format {
+	case "hex":
+		return hex.EncodeToString(payload)
+	case "base64":
+		return base64.StdEncoding.EncodeToString(payload)
+	case "json":
+		// indent payload if valid
+		var buf bytes.Buffer
+		if json.Indent(&buf, payload, "", "  ") == nil {
+			return "\n" + buf.String()
+		}
+
+		return string(payload)
+	default:
+		return string(payload)
+	}
+}
+
+func localAddress() string {
+	// get addresses
+	addrs, err := net.InterfaceAddrs()
+	exitIfSet(err)
+
+	// find first non loopback ipv4 address
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+
+	return "localhost"
+}
+
 func workingDirectory() string {
 	wd, err := os.Getwd()
 	exitIfSet(err)
@@ -31,5 +122,113 @@ func getProject() *naos.Project {
 	p, err := naos.OpenProject(workingDirectory())
 	exitIfSet(err)
 
+	// redact broker secrets in errors
+	redact = p.Inventory.Redact
+
 	return p
 }
+
+func formatOperation(op *naos.Operation) string {
+	return strings.TrimSpace(op.Action + " " + formatDetails(op))
+}
+
+func formatDetails(op *naos.Operation) string {
+	switch op.Action {
+	case naos.SetAction:
+		return op.Param + "=" + op.Value
+	case naos.UnsetAction:
+		return op.Param
+	case naos.UpdateAction:
+		return op.Version
+	default:
+		return ""
+	}
+}
+
+func formatAction(e *naos.JournalEntry) string {
+	// append parameter or topic
+	if e.Param != "" {
+		return e.Action + " " + e.Param
+	} else if e.Topic != "" {
+		return e.Action + " " + e.Topic
+	}
+
+	return e.Action
+}
+
+func formatBattery(level float64) string {
+	// check level
+	if level < 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(int64(level*100), 10) + "%"
+}
+
+func signalPercentage(strength int64) int64 {
+	// map signal strength to percentage
+	ss := (100 - (strength * -1)) * 2
+	if ss > 100 {
+		ss = 100
+	} else if ss < 0 {
+		ss = 0
+	}
+
+	return ss
+}
+
+func formatSignal(strength int64) string {
+	// check strength
+	if strength >= 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(signalPercentage(strength), 10) + "%"
+}
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+func sparkline(values []int64, width int) string {
+	// use most recent values
+	if len(values) > width {
+		values = values[len(values)-width:]
+	}
+
+	// check values
+	if len(values) == 0 {
+		return ""
+	}
+
+	// get range
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+
+	// build line
+	line := make([]rune, 0, len(values))
+	for _, v := range values {
+		index := len(sparks) - 1
+		if max > min {
+			index = int((v - min) * int64(len(sparks)-1) / (max - min))
+		}
+		line = append(line, sparks[index])
+	}
+
+	return string(line)
+}
+
+func isTerminal(file *os.File) bool {
+	// get info
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,82 @@
+package esp
+
+import "fmt"
+
+// chipMagicRegister is the ROM address that identifies the chip family.
+const chipMagicRegister = 0x40001000
+
+// A Chip describes a supported chip family.
+type Chip struct {
+	// The name as used by ESP-IDF.
+	Name string
+
+	magics      []uint32
+	macRegister uint32
+	encryption  bool
+	spi         spiRegisters
+}
+
+// spiRegisters describes the SPI peripheral used to talk to the flash.
+type spiRegisters struct {
+	base     uint32
+	usr      uint32
+	usr1     uint32
+	usr2     uint32
+	mosiDlen uint32
+	misoDlen uint32
+	w0       uint32
+}
+
+// The SPI register layouts.
+var (
+	spiESP32   = spiRegisters{base: 0x3FF42000, usr: 0x1C, usr1: 0x20, usr2: 0x24, mosiDlen: 0x28, misoDlen: 0x2C, w0: 0x80}
+	spiESP32S2 = spiRegisters{base: 0x3F402000, usr: 0x18, usr1: 0x1C, usr2: 0x20, mosiDlen: 0x24, misoDlen: 0x28, w0: 0x58}
+	spiESP32S3 = spiRegisters{base: 0x60002000, usr: 0x18, usr1: 0x1C, usr2: 0x20, mosiDlen: 0x24, misoDlen: 0x28, w0: 0x58}
+)
+
+// The supported chips.
+var (
+	ESP32 = &Chip{
+		Name:        "esp32",
+		magics:      []uint32{0x00F01D83},
+		macRegister: 0x3FF5A004,
+		spi:         spiESP32,
+	}
+	ESP32S2 = &Chip{
+		Name:        "esp32s2",
+		magics:      []uint32{0x000007C6},
+		macRegister: 0x3F41A044,
+		encryption:  true,
+		spi:         spiESP32S2,
+	}
+	ESP32S3 = &Chip{
+		Name:        "esp32s3",
+		magics:      []uint32{0x00000009},
+		macRegister: 0x60007044,
+		encryption:  true,
+		spi:         spiESP32S3,
+	}
+	ESP32C3 = &Chip{
+		Name:        "esp32c3",
+		magics:      []uint32{0x6921506F, 0x1B31506F, 0x4881606F, 0x4361606F},
+		macRegister: 0x60008844,
+		encryption:  true,
+		spi:         spiESP32S3,
+	}
+)
+
+// Chips lists all supported chips.
+var Chips = []*Chip{ESP32, ESP32S2, ESP32S3, ESP32C3}
+
+func chipByMagic(magic uint32) (*Chip, error) {
+	// find chip
+	for _, chip := range Chips {
+		for _, m := range chip.magics {
+			if m == magic {
+				return chip, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("unknown chip magic 0x%08x", magic)
+}
@@ -0,0 +1,739 @@
+// Package esp implements the serial protocol of the ESP ROM bootloader to flash,
+// erase and read the flash of attached devices.
+package esp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// DefaultBaudRate is the baud rate used by the ROM bootloader after reset.
+const DefaultBaudRate = 115200
+
+// DefaultFlashSize is the flash size configured if not specified otherwise and
+// the size of the flash cannot be detected.
+const DefaultFlashSize = 4 * 1024 * 1024
+
+// The ROM bootloader commands.
+const (
+	cmdFlashBegin    = 0x02
+	cmdSync          = 0x08
+	cmdWriteReg      = 0x09
+	cmdReadReg       = 0x0A
+	cmdSPISetParams  = 0x0B
+	cmdSPIAttach     = 0x0D
+	cmdReadFlashSlow = 0x0E
+	cmdChangeBaud    = 0x0F
+	cmdDeflBegin     = 0x10
+	cmdDeflData      = 0x11
+	cmdFlashMD5      = 0x13
+)
+
+// The protocol parameters.
+const (
+	blockSize     = 0x400
+	readBlockSize = 64
+	statusLength  = 4
+	checksumSeed  = 0xEF
+	syncTimeout   = 100 * time.Millisecond
+	eraseTimeout  = 30 * time.Second
+	writeTimeout  = 40 * time.Second
+	md5Timeout    = 8 * time.Second
+	connectTries  = 7
+	syncTries     = 5
+)
+
+// The SPI flash command parameters.
+const (
+	spiCmdUsr     = 1 << 18
+	spiUsrCommand = 1 << 31
+	spiUsrMISO    = 1 << 28
+	spiFlashRDID  = 0x9F
+)
+
+// flashSizes maps the size byte of flash IDs to flash sizes.
+var flashSizes = map[byte]int{
+	0x12: 256 * 1024,
+	0x13: 512 * 1024,
+	0x14: 1024 * 1024,
+	0x15: 2 * 1024 * 1024,
+	0x16: 4 * 1024 * 1024,
+	0x17: 8 * 1024 * 1024,
+	0x18: 16 * 1024 * 1024,
+	0x19: 32 * 1024 * 1024,
+	0x1A: 64 * 1024 * 1024,
+	0x39: 32 * 1024 * 1024,
+}
+
+var errorMessages = map[byte]string{
+	0x05: "received message is invalid",
+	0x06: "failed to act on received message",
+	0x07: "invalid CRC in message",
+	0x08: "flash write error",
+	0x09: "flash read error",
+	0x0A: "flash read length error",
+	0x0B: "deflate error",
+}
+
+// A Port is a serial port that is connected to a device. It is implemented by
+// the ports returned by serial.Open.
+type Port interface {
+	io.ReadWriteCloser
+	SetMode(mode *serial.Mode) error
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+	ResetInputBuffer() error
+}
+
+// A Flasher talks to the ROM bootloader of a device.
+type Flasher struct {
+	port    Port
+	chip    *Chip
+	baud    int
+	frames  chan []byte
+	done    chan struct{}
+	err     error
+	timeout time.Duration
+	size    int
+}
+
+// Open will open the named serial port and return a flasher.
+func Open(name string) (*Flasher, error) {
+	// open port
+	port, err := serial.Open(name, &serial.Mode{BaudRate: DefaultBaudRate})
+	if err != nil {
+		return nil, err
+	}
+
+	return New(port), nil
+}
+
+// New will return a flasher that uses the provided port. The port is expected
+// to be configured with the default baud rate.
+func New(port Port) *Flasher {
+	// prepare flasher
+	f := &Flasher{
+		port:    port,
+		baud:    DefaultBaudRate,
+		frames:  make(chan []byte, 64),
+		done:    make(chan struct{}),
+		timeout: 3 * time.Second,
+	}
+
+	// run reader
+	go f.reader()
+
+	return f
+}
+
+// Connect will reset the device into the bootloader, synchronize with it and
+// detect the chip. If reset is false, the device is expected to already run the
+// bootloader.
+func (f *Flasher) Connect(reset bool) error {
+	// attempt connection
+	var err error
+	for i := 0; i < connectTries; i++ {
+		// reset into bootloader if requested
+		if reset {
+			err = f.resetIntoBootloader()
+			if err != nil {
+				return err
+			}
+		}
+
+		// attempt sync
+		for j := 0; j < syncTries; j++ {
+			err = f.sync()
+			if err == nil {
+				return f.detect()
+			}
+		}
+	}
+
+	return fmt.Errorf("failed to connect: %w", err)
+}
+
+// Chip returns the chip detected while connecting.
+func (f *Flasher) Chip() *Chip {
+	return f.chip
+}
+
+// ChangeBaud will change the baud rate of the bootloader and the port. The
+// connection is verified at the new baud rate.
+func (f *Flasher) ChangeBaud(baud int) error {
+	// check baud
+	if baud == f.baud {
+		return nil
+	}
+
+	// send command, the ROM expects zero as the old baud rate
+	_, _, err := f.command(cmdChangeBaud, words(uint32(baud), 0), 0, f.timeout)
+	if err != nil {
+		return err
+	}
+
+	// change port mode
+	err = f.port.SetMode(&serial.Mode{BaudRate: baud})
+	if err != nil {
+		return err
+	}
+
+	// wait for the change and flush garbage
+	time.Sleep(50 * time.Millisecond)
+	f.flush()
+	f.baud = baud
+
+	// verify connection
+	_, err = f.readReg(chipMagicRegister)
+	if err != nil {
+		return fmt.Errorf("no response at %d baud: %w", baud, err)
+	}
+
+	return nil
+}
+
+// Attach will attach the SPI flash and configure its size. If the size is not
+// specified, it is detected using the flash ID and falls back to the default
+// size if the ID is unknown.
+func (f *Flasher) Attach(flashSize int) error {
+	// attach flash
+	_, _, err := f.command(cmdSPIAttach, make([]byte, 8), 0, f.timeout)
+	if err != nil {
+		return err
+	}
+
+	// detect size
+	if flashSize <= 0 {
+		id, err := f.FlashID()
+		if err != nil {
+			return err
+		}
+		flashSize = flashSizes[byte(id>>16)]
+	}
+
+	// use default size
+	if flashSize <= 0 {
+		flashSize = DefaultFlashSize
+	}
+
+	// set parameters
+	_, _, err = f.command(cmdSPISetParams, words(0, uint32(flashSize), 64*1024, 4*1024, 256, 0xFFFF), 0, f.timeout)
+	if err != nil {
+		return err
+	}
+
+	// set size
+	f.size = flashSize
+
+	return nil
+}
+
+// FlashSize returns the flash size configured by Attach.
+func (f *Flasher) FlashSize() int {
+	return f.size
+}
+
+// FlashID will read the JEDEC ID of the SPI flash. The manufacturer is returned
+// in the lowest byte and the size in the highest byte.
+func (f *Flasher) FlashID() (uint32, error) {
+	// get registers
+	spi := f.chip.spi
+	reg := func(offset uint32) uint32 {
+		return spi.base + offset
+	}
+
+	// save user registers
+	usr, err := f.readReg(reg(spi.usr))
+	if err != nil {
+		return 0, err
+	}
+	usr2, err := f.readReg(reg(spi.usr2))
+	if err != nil {
+		return 0, err
+	}
+
+	// configure a command that reads 24 bits
+	for _, w := range [][2]uint32{
+		{reg(spi.misoDlen), 23},
+		{reg(spi.usr), spiUsrCommand | spiUsrMISO},
+		{reg(spi.usr2), 7<<28 | spiFlashRDID},
+		{reg(spi.w0), 0},
+	} {
+		err = f.writeReg(w[0], w[1])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// run command
+	err = f.writeReg(spi.base, spiCmdUsr)
+	if err != nil {
+		return 0, err
+	}
+
+	// wait for completion
+	for i := 0; ; i++ {
+		cmd, err := f.readReg(spi.base)
+		if err != nil {
+			return 0, err
+		} else if cmd&spiCmdUsr == 0 {
+			break
+		} else if i >= 10 {
+			return 0, fmt.Errorf("flash ID command did not complete")
+		}
+	}
+
+	// read result
+	id, err := f.readReg(reg(spi.w0))
+	if err != nil {
+		return 0, err
+	}
+
+	// restore user registers
+	err = f.writeReg(reg(spi.usr), usr)
+	if err != nil {
+		return 0, err
+	}
+	err = f.writeReg(reg(spi.usr2), usr2)
+	if err != nil {
+		return 0, err
+	}
+
+	return id & 0xFFFFFF, nil
+}
+
+// Erase will erase the specified region of the flash.
+func (f *Flasher) Erase(offset, size int) error {
+	// the ROM erases the region when a write begins
+	blocks := (size + blockSize - 1) / blockSize
+	_, _, err := f.command(cmdFlashBegin, f.begin(size, blocks, offset), 0, perMegabyte(eraseTimeout, size))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Write will compress and write the data to the flash at the specified offset
+// and verify the written data afterwards. The optional callback is called with
+// the progress of the write.
+func (f *Flasher) Write(offset int, data []byte, progress func(float64)) error {
+	// compress data
+	var buf bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&buf, zlib.BestCompression)
+	_, err := zw.Write(data)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	compressed := buf.Bytes()
+
+	// begin write, the ROM expects the erase size rounded up to full blocks
+	blocks := (len(compressed) + blockSize - 1) / blockSize
+	eraseSize := (len(data) + blockSize - 1) / blockSize * blockSize
+	_, _, err = f.command(cmdDeflBegin, f.begin(eraseSize, blocks, offset), 0, perMegabyte(eraseTimeout, eraseSize))
+	if err != nil {
+		return err
+	}
+
+	// get inflated block sizes
+	inflated := inflatedSizes(compressed, blocks)
+
+	// write blocks
+	for seq := 0; seq < blocks; seq++ {
+		// get block
+		block := compressed[seq*blockSize:]
+		if len(block) > blockSize {
+			block = block[:blockSize]
+		}
+
+		// write block, the timeout is scaled by the data the block inflates to
+		payload := append(words(uint32(len(block)), uint32(seq), 0, 0), block...)
+		_, _, err = f.command(cmdDeflData, payload, checksum(block), perMegabyte(writeTimeout, inflated[seq]))
+		if err != nil {
+			return err
+		}
+
+		// report progress
+		if progress != nil {
+			progress(float64(seq+1) / float64(blocks))
+		}
+	}
+
+	// verify data
+	sum, err := f.MD5(offset, len(data))
+	if err != nil {
+		return err
+	}
+	expected := md5.Sum(data)
+	if !bytes.Equal(sum, expected[:]) {
+		return fmt.Errorf("verification failed at 0x%x: expected %x, got %x", offset, expected, sum)
+	}
+
+	return nil
+}
+
+// Read will read the specified region of the flash.
+func (f *Flasher) Read(offset, size int, progress func(float64)) ([]byte, error) {
+	// prepare data
+	data := make([]byte, 0, size)
+
+	// read blocks
+	for len(data) < size {
+		// get length
+		length := size - len(data)
+		if length > readBlockSize {
+			length = readBlockSize
+		}
+
+		// read block
+		_, block, err := f.command(cmdReadFlashSlow, words(uint32(offset+len(data)), uint32(length)), 0, f.timeout)
+		if err != nil {
+			return nil, err
+		} else if len(block) < length {
+			return nil, fmt.Errorf("expected %d bytes, got %d", length, len(block))
+		}
+
+		// add data
+		data = append(data, block[:length]...)
+
+		// report progress
+		if progress != nil {
+			progress(float64(len(data)) / float64(size))
+		}
+	}
+
+	return data, nil
+}
+
+// MD5 will return the MD5 hash of the specified flash region.
+func (f *Flasher) MD5(offset, size int) ([]byte, error) {
+	// compute hash
+	_, res, err := f.command(cmdFlashMD5, words(uint32(offset), uint32(size), 0, 0), 0, perMegabyte(md5Timeout, size))
+	if err != nil {
+		return nil, err
+	}
+
+	// the ROM returns the hash as hex and the stub as raw bytes
+	switch len(res) {
+	case 32:
+		return hex.DecodeString(string(res))
+	case 16:
+		return res, nil
+	default:
+		return nil, fmt.Errorf("invalid MD5 response length %d", len(res))
+	}
+}
+
+// ReadMAC will read the factory MAC address from the eFuses.
+func (f *Flasher) ReadMAC() (string, error) {
+	// read eFuse words
+	var words [2]uint32
+	for i, reg := range []uint32{f.chip.macRegister + 4, f.chip.macRegister} {
+		value, err := f.readReg(reg)
+		if err != nil {
+			return "", err
+		}
+		words[i] = value
+	}
+
+	// assemble address without the checksum byte
+	mac := make([]byte, 8)
+	binary.BigEndian.PutUint32(mac[0:], words[0])
+	binary.BigEndian.PutUint32(mac[4:], words[1])
+
+	return hex.EncodeToString(mac[2:]), nil
+}
+
+// Reset will perform a hard reset of the device to run the application.
+func (f *Flasher) Reset() error {
+	// pull enable low
+	err := f.port.SetRTS(true)
+	if err != nil {
+		return err
+	}
+
+	// wait
+	time.Sleep(100 * time.Millisecond)
+
+	// release enable
+	return f.port.SetRTS(false)
+}
+
+// Close will close the port.
+func (f *Flasher) Close() error {
+	return f.port.Close()
+}
+
+func (f *Flasher) detect() error {
+	// read magic
+	magic, err := f.readReg(chipMagicRegister)
+	if err != nil {
+		return err
+	}
+
+	// get chip
+	f.chip, err = chipByMagic(magic)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (f *Flasher) begin(size, blocks, offset int) []byte {
+	// prepare parameters
+	params := words(uint32(size), uint32(blocks), blockSize, uint32(offset))
+
+	// newer ROMs expect the encryption flag
+	if f.chip.encryption {
+		params = append(params, words(0)...)
+	}
+
+	return params
+}
+
+func (f *Flasher) readReg(addr uint32) (uint32, error) {
+	// read register
+	value, _, err := f.command(cmdReadReg, words(addr), 0, f.timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+func (f *Flasher) writeReg(addr, value uint32) error {
+	// write register
+	_, _, err := f.command(cmdWriteReg, words(addr, value, 0xFFFFFFFF, 0), 0, f.timeout)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (f *Flasher) resetIntoBootloader() error {
+	// set IO0 high and enable low
+	err := f.port.SetDTR(false)
+	if err != nil {
+		return err
+	}
+	err = f.port.SetRTS(true)
+	if err != nil {
+		return err
+	}
+
+	// wait
+	time.Sleep(100 * time.Millisecond)
+
+	// set IO0 low and enable high
+	err = f.port.SetDTR(true)
+	if err != nil {
+		return err
+	}
+	err = f.port.SetRTS(false)
+	if err != nil {
+		return err
+	}
+
+	// wait
+	time.Sleep(50 * time.Millisecond)
+
+	// set IO0 high
+	return f.port.SetDTR(false)
+}
+
+func (f *Flasher) sync() error {
+	// flush input
+	f.flush()
+
+	// prepare payload
+	payload := append([]byte{0x07, 0x07, 0x12, 0x20}, bytes.Repeat([]byte{0x55}, 32)...)
+
+	// send sync
+	_, _, err := f.command(cmdSync, payload, 0, syncTimeout)
+	if err != nil {
+		return err
+	}
+
+	// drain additional responses
+	time.Sleep(syncTimeout)
+	f.flush()
+
+	return nil
+}
+
+func (f *Flasher) command(cmd byte, data []byte, check uint32, timeout time.Duration) (uint32, []byte, error) {
+	// prepare packet
+	packet := make([]byte, 8, 8+len(data))
+	packet[0] = 0x00
+	packet[1] = cmd
+	binary.LittleEndian.PutUint16(packet[2:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(packet[4:], check)
+	packet = append(packet, data...)
+
+	// write packet
+	_, err := f.port.Write(slipEncode(packet))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// prepare timeout
+	deadline := time.After(timeout)
+
+	for {
+		// await response
+		var frame []byte
+		select {
+		case frame = <-f.frames:
+		case <-f.done:
+			return 0, nil, f.err
+		case <-deadline:
+			return 0, nil, fmt.Errorf("timeout waiting for response to command 0x%02x", cmd)
+		}
+
+		// skip unrelated frames
+		if len(frame) < 8 || frame[0] != 0x01 || frame[1] != cmd {
+			continue
+		}
+
+		// get data
+		data := frame[8:]
+		if len(data) < statusLength {
+			return 0, nil, errors.New("invalid response")
+		}
+
+		// check status
+		status := data[len(data)-statusLength:]
+		if status[0] != 0 {
+			msg, ok := errorMessages[status[1]]
+			if !ok {
+				msg = fmt.Sprintf("unknown error 0x%02x", status[1])
+			}
+			return 0, nil, fmt.Errorf("command 0x%02x failed: %s", cmd, msg)
+		}
+
+		return binary.LittleEndian.Uint32(frame[4:]), data[:len(data)-statusLength], nil
+	}
+}
+
+func (f *Flasher) reader() {
+	// prepare decoder and buffer
+	var dec slipDecoder
+	buf := make([]byte, 1024)
+
+	for {
+		// read data
+		n, err := f.port.Read(buf)
+		if err != nil {
+			f.err = err
+			close(f.done)
+			return
+		}
+
+		// decode frames
+		for _, b := range buf[:n] {
+			if frame := dec.feed(b); frame != nil {
+				select {
+				case f.frames <- frame:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (f *Flasher) flush() {
+	// reset port buffer
+	_ = f.port.ResetInputBuffer()
+
+	// drain frames
+	for {
+		select {
+		case <-f.frames:
+		default:
+			return
+		}
+	}
+}
+
+func words(values ...uint32) []byte {
+	// encode values
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(buf[i*4:], v)
+	}
+
+	return buf
+}
+
+func checksum(data []byte) uint32 {
+	// compute checksum
+	sum := byte(checksumSeed)
+	for _, b := range data {
+		sum ^= b
+	}
+
+	return uint32(sum)
+}
+
+// inflatedSizes returns the number of bytes each block of the compressed data
+// inflates to.
+func inflatedSizes(compressed []byte, blocks int) []int {
+	// prepare sizes
+	sizes := make([]int, blocks)
+
+	// prepare reader, the decompressor reads exactly the required input as the
+	// reader implements io.ByteReader
+	r := bytes.NewReader(compressed)
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return sizes
+	}
+
+	// inflate data
+	buf := make([]byte, blockSize)
+	for {
+		// read data
+		n, err := zr.Read(buf)
+
+		// attribute data to the block being consumed
+		seq := (len(compressed) - r.Len() - 1) / blockSize
+		if seq < 0 {
+			seq = 0
+		} else if seq >= blocks {
+			seq = blocks - 1
+		}
+		sizes[seq] += n
+
+		// check error
+		if err != nil {
+			break
+		}
+	}
+
+	return sizes
+}
+
+func perMegabyte(timeout time.Duration, size int) time.Duration {
+	// scale timeout by size
+	t := time.Duration(float64(timeout) * float64(size) / 1e6)
+	if t < 3*time.Second {
+		return 3 * time.Second
+	}
+
+	return t
+}
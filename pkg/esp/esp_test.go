@@ -0,0 +1,274 @@
+package esp
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.bug.st/serial"
+)
+
+// fakePort emulates the ROM bootloader of a device with a small flash.
+type fakePort struct {
+	flash   []byte
+	decoder slipDecoder
+	output  chan []byte
+	buffer  []byte
+	signals []string
+	baud    int
+	offset  int
+	pending []byte
+	failMD5 bool
+	regs    map[uint32]uint32
+	flashID uint32
+}
+
+func newFakePort(size int) *fakePort {
+	return &fakePort{
+		flash:  bytes.Repeat([]byte{0xFF}, size),
+		output: make(chan []byte, 256),
+		baud:   DefaultBaudRate,
+		regs:   map[uint32]uint32{},
+	}
+}
+
+func (p *fakePort) Read(buf []byte) (int, error) {
+	if len(p.buffer) == 0 {
+		data, ok := <-p.output
+		if !ok {
+			return 0, io.EOF
+		}
+		p.buffer = data
+	}
+
+	n := copy(buf, p.buffer)
+	p.buffer = p.buffer[n:]
+
+	return n, nil
+}
+
+func (p *fakePort) Write(data []byte) (int, error) {
+	for _, b := range data {
+		if packet := p.decoder.feed(b); packet != nil {
+			p.handle(packet[1], packet[8:])
+		}
+	}
+
+	return len(data), nil
+}
+
+func (p *fakePort) handle(cmd byte, data []byte) {
+	// prepare response
+	var value uint32
+	var res []byte
+
+	switch cmd {
+	case cmdSync:
+		// respond multiple times like the ROM
+		for i := 0; i < 7; i++ {
+			p.respond(cmd, 0, nil)
+		}
+	case cmdChangeBaud:
+		p.baud = int(binary.LittleEndian.Uint32(data))
+	case cmdFlashBegin:
+		size := int(binary.LittleEndian.Uint32(data))
+		offset := int(binary.LittleEndian.Uint32(data[12:]))
+		copy(p.flash[offset:], bytes.Repeat([]byte{0xFF}, size))
+	case cmdDeflBegin:
+		p.offset = int(binary.LittleEndian.Uint32(data[12:]))
+		p.pending = nil
+	case cmdDeflData:
+		p.pending = append(p.pending, data[16:]...)
+	case cmdFlashMD5:
+		if p.pending != nil {
+			zr, _ := zlib.NewReader(bytes.NewReader(p.pending))
+			plain, _ := ioutil.ReadAll(zr)
+			copy(p.flash[p.offset:], plain)
+			p.pending = nil
+		}
+		offset := binary.LittleEndian.Uint32(data)
+		size := binary.LittleEndian.Uint32(data[4:])
+		sum := md5.Sum(p.flash[offset : offset+size])
+		if p.failMD5 {
+			sum[0]++
+		}
+		res = []byte(hex.EncodeToString(sum[:]))
+	case cmdReadFlashSlow:
+		offset := binary.LittleEndian.Uint32(data)
+		res = make([]byte, readBlockSize)
+		copy(res, p.flash[offset:])
+	case cmdReadReg:
+		value = p.regs[binary.LittleEndian.Uint32(data)]
+	case cmdWriteReg:
+		addr := binary.LittleEndian.Uint32(data)
+		p.regs[addr] = binary.LittleEndian.Uint32(data[4:])
+		if addr == spiESP32.base {
+			p.regs[addr] = 0
+			p.regs[spiESP32.base+spiESP32.w0] = p.flashID
+		}
+	case cmdSPIAttach, cmdSPISetParams:
+	default:
+		p.output <- slipEncode(append([]byte{0x01, cmd, 4, 0, 0, 0, 0, 0}, 1, 0x05, 0, 0))
+		return
+	}
+
+	p.respond(cmd, value, res)
+}
+
+func (p *fakePort) respond(cmd byte, value uint32, data []byte) {
+	data = append(data, 0, 0, 0, 0)
+	packet := []byte{0x01, cmd, byte(len(data)), byte(len(data) >> 8)}
+	packet = append(packet, words(value)...)
+	packet = append(packet, data...)
+	p.output <- append([]byte("boot garbage"), slipEncode(packet)...)
+}
+
+func (p *fakePort) SetMode(mode *serial.Mode) error {
+	p.signals = append(p.signals, "baud")
+	return nil
+}
+
+func (p *fakePort) SetDTR(dtr bool) error {
+	p.signals = append(p.signals, map[bool]string{true: "DTR", false: "dtr"}[dtr])
+	return nil
+}
+
+func (p *fakePort) SetRTS(rts bool) error {
+	p.signals = append(p.signals, map[bool]string{true: "RTS", false: "rts"}[rts])
+	return nil
+}
+
+func (p *fakePort) ResetInputBuffer() error {
+	return nil
+}
+
+func (p *fakePort) Close() error {
+	close(p.output)
+	return nil
+}
+
+func TestSLIP(t *testing.T) {
+	packet := []byte{0x01, slipEnd, 0x02, slipEsc, 0x03}
+	frame := slipEncode(packet)
+	assert.Equal(t, []byte{slipEnd, 0x01, slipEsc, slipEscEnd, 0x02, slipEsc, slipEscEsc, 0x03, slipEnd}, frame)
+
+	var dec slipDecoder
+	var frames [][]byte
+	for _, b := range append([]byte("noise"), frame...) {
+		if f := dec.feed(b); f != nil {
+			frames = append(frames, f)
+		}
+	}
+	assert.Equal(t, [][]byte{packet}, frames)
+}
+
+func TestFlasher(t *testing.T) {
+	port := newFakePort(64 * 1024)
+	f := New(port)
+	defer f.Close()
+
+	port.regs[chipMagicRegister] = 0x00F01D83
+	assert.NoError(t, f.Connect(true))
+	assert.Equal(t, []string{"dtr", "RTS", "DTR", "rts", "dtr"}, port.signals)
+	assert.Equal(t, ESP32, f.Chip())
+
+	assert.NoError(t, f.ChangeBaud(921600))
+	assert.Equal(t, 921600, port.baud)
+
+	port.flashID = 0x1740C8
+	port.regs[spiESP32.base+spiESP32.usr2] = 0x70000003
+	assert.NoError(t, f.Attach(0))
+	assert.Equal(t, 8*1024*1024, f.FlashSize())
+	assert.Equal(t, uint32(0x70000003), port.regs[spiESP32.base+spiESP32.usr2])
+
+	port.regs[ESP32.macRegister+4] = 0x0000A4CF
+	port.regs[ESP32.macRegister] = 0x12345678
+	mac, err := f.ReadMAC()
+	assert.NoError(t, err)
+	assert.Equal(t, "a4cf12345678", mac)
+
+	data := bytes.Repeat([]byte("naos"), 3000)
+	var progress []float64
+	assert.NoError(t, f.Write(0x1000, data, func(p float64) {
+		progress = append(progress, p)
+	}))
+	assert.Equal(t, data, port.flash[0x1000:0x1000+len(data)])
+	assert.Equal(t, 1.0, progress[len(progress)-1])
+
+	read, err := f.Read(0x1000, 100, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, data[:100], read)
+
+	assert.NoError(t, f.Erase(0x1000, 0x1000))
+	assert.Equal(t, bytes.Repeat([]byte{0xFF}, 0x1000), port.flash[0x1000:0x2000])
+
+	port.failMD5 = true
+	assert.Error(t, f.Write(0x2000, data, nil))
+}
+
+func TestChipByMagic(t *testing.T) {
+	chip, err := chipByMagic(0x1B31506F)
+	assert.NoError(t, err)
+	assert.Equal(t, ESP32C3, chip)
+
+	_, err = chipByMagic(0x12345678)
+	assert.Error(t, err)
+}
+
+func TestPatchImage(t *testing.T) {
+	image := make([]byte, 64)
+	image[0] = imageMagic
+	image[imageSpeedOffset] = 0x2F
+	image[imageHashedOffset] = 1
+	sum := sha256.Sum256(image[:32])
+	copy(image[32:], sum[:])
+
+	patched, err := PatchImage(image, "dio", "40m", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), patched[imageModeOffset])
+	assert.Equal(t, byte(0x20), patched[imageSpeedOffset])
+	sum = sha256.Sum256(patched[:32])
+	assert.Equal(t, sum[:], patched[32:])
+
+	patched, err = PatchImage(patched, "", "", 16*1024*1024)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(2), patched[imageModeOffset])
+	assert.Equal(t, byte(0x40), patched[imageSpeedOffset])
+	sum = sha256.Sum256(patched[:32])
+	assert.Equal(t, sum[:], patched[32:])
+	assert.Equal(t, byte(0x2F), image[imageSpeedOffset])
+
+	_, err = PatchImage(image, "foo", "", 0)
+	assert.Error(t, err)
+
+	_, err = PatchImage(image, "", "", 3*1024*1024)
+	assert.Error(t, err)
+
+	_, err = PatchImage([]byte("foo"), "", "", 0)
+	assert.Error(t, err)
+}
+
+func TestInflatedSizes(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	data := append(bytes.Repeat([]byte{0xFF}, 256*1024), bytes.Repeat([]byte("naos"), 1024)...)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+
+	blocks := (buf.Len() + blockSize - 1) / blockSize
+	sizes := inflatedSizes(buf.Bytes(), blocks)
+	assert.Len(t, sizes, blocks)
+
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	assert.Equal(t, len(data), total)
+}
@@ -0,0 +1,99 @@
+package esp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// The image header layout.
+const (
+	imageMagic        = 0xE9
+	imageModeOffset   = 2
+	imageSpeedOffset  = 3
+	imageHashedOffset = 23
+	imageHeaderLength = 24
+	imageDigestLength = sha256.Size
+)
+
+// The flash modes and frequencies as encoded in the image header.
+var (
+	flashModes = map[string]byte{
+		"qio":  0,
+		"qout": 1,
+		"dio":  2,
+		"dout": 3,
+	}
+	flashFrequencies = map[string]byte{
+		"40m": 0x0,
+		"26m": 0x1,
+		"20m": 0x2,
+		"80m": 0xF,
+	}
+	flashSizeValues = map[int]byte{
+		1 * 1024 * 1024:   0x00,
+		2 * 1024 * 1024:   0x10,
+		4 * 1024 * 1024:   0x20,
+		8 * 1024 * 1024:   0x30,
+		16 * 1024 * 1024:  0x40,
+		32 * 1024 * 1024:  0x50,
+		64 * 1024 * 1024:  0x60,
+		128 * 1024 * 1024: 0x70,
+	}
+)
+
+// PatchImage will set the flash mode, frequency and size in the header of the
+// bootloader image. Empty values and a zero size keep the current configuration.
+// An appended digest is updated if it matches the original image.
+func PatchImage(image []byte, mode, frequency string, size int) ([]byte, error) {
+	// check image
+	if len(image) < imageHeaderLength || image[0] != imageMagic {
+		return nil, errors.New("invalid image")
+	}
+
+	// copy image
+	image = append([]byte(nil), image...)
+
+	// check digest
+	hashed := image[imageHashedOffset] == 1 && len(image) >= imageHeaderLength+imageDigestLength
+	if hashed {
+		sum := sha256.Sum256(image[:len(image)-imageDigestLength])
+		hashed = bytes.Equal(sum[:], image[len(image)-imageDigestLength:])
+	}
+
+	// set mode
+	if mode != "" {
+		value, ok := flashModes[mode]
+		if !ok {
+			return nil, fmt.Errorf("invalid flash mode '%s'", mode)
+		}
+		image[imageModeOffset] = value
+	}
+
+	// set frequency
+	if frequency != "" {
+		value, ok := flashFrequencies[frequency]
+		if !ok {
+			return nil, fmt.Errorf("invalid flash frequency '%s'", frequency)
+		}
+		image[imageSpeedOffset] = image[imageSpeedOffset]&0xF0 | value
+	}
+
+	// set size
+	if size != 0 {
+		value, ok := flashSizeValues[size]
+		if !ok {
+			return nil, fmt.Errorf("invalid flash size %d", size)
+		}
+		image[imageSpeedOffset] = image[imageSpeedOffset]&0x0F | value
+	}
+
+	// update digest
+	if hashed {
+		sum := sha256.Sum256(image[:len(image)-imageDigestLength])
+		copy(image[len(image)-imageDigestLength:], sum[:])
+	}
+
+	return image, nil
+}
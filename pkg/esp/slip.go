@@ -0,0 +1,91 @@
+package esp
+
+// The SLIP special bytes.
+const (
+	slipEnd     = 0xC0
+	slipEsc     = 0xDB
+	slipEscEnd  = 0xDC
+	slipEscEsc  = 0xDD
+	maxFrameLen = 16 * 1024
+)
+
+// slipEncode will encode the packet as a SLIP frame.
+func slipEncode(packet []byte) []byte {
+	// prepare frame
+	frame := make([]byte, 0, len(packet)+2)
+	frame = append(frame, slipEnd)
+
+	// escape bytes
+	for _, b := range packet {
+		switch b {
+		case slipEnd:
+			frame = append(frame, slipEsc, slipEscEnd)
+		case slipEsc:
+			frame = append(frame, slipEsc, slipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+
+	return append(frame, slipEnd)
+}
+
+// A slipDecoder extracts SLIP frames from a byte stream. Bytes outside of
+// frames like the boot messages of the ROM are ignored.
+type slipDecoder struct {
+	frame   []byte
+	inFrame bool
+	escaped bool
+}
+
+// feed will process the byte and return a frame when completed.
+func (d *slipDecoder) feed(b byte) []byte {
+	// wait for frame start
+	if !d.inFrame {
+		if b == slipEnd {
+			d.inFrame = true
+			d.frame = d.frame[:0]
+		}
+		return nil
+	}
+
+	// handle escaped byte
+	if d.escaped {
+		d.escaped = false
+		switch b {
+		case slipEscEnd:
+			d.frame = append(d.frame, slipEnd)
+		case slipEscEsc:
+			d.frame = append(d.frame, slipEsc)
+		default:
+			// drop invalid frame
+			d.inFrame = false
+		}
+		return nil
+	}
+
+	// handle byte
+	switch b {
+	case slipEnd:
+		// treat empty frames as the start of a new frame
+		if len(d.frame) == 0 {
+			return nil
+		}
+
+		// return frame
+		d.inFrame = false
+		return append([]byte(nil), d.frame...)
+	case slipEsc:
+		d.escaped = true
+	default:
+		// drop oversized frames
+		if len(d.frame) >= maxFrameLen {
+			d.inFrame = false
+			return nil
+		}
+
+		d.frame = append(d.frame, b)
+	}
+
+	return nil
+}
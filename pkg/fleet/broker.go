@@ -0,0 +1,186 @@
+package fleet
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/broker"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport"
+)
+
+// A BrokerConfig is used to configure a local broker.
+type BrokerConfig struct {
+	// The address used to accept MQTT connections e.g. "0.0.0.0:1883".
+	TCPAddress string
+
+	// The address used to accept WebSocket connections e.g. "0.0.0.0:8080".
+	// WebSocket connections are disabled if empty.
+	WebSocketAddress string
+
+	// The credentials required from clients. Authentication is disabled if
+	// the username is empty.
+	Username string
+	Password string
+
+	// The certificate and key files used to secure connections. TLS is
+	// disabled if the certificate file is empty.
+	CertFile string
+	KeyFile  string
+}
+
+// BrokerEvent is emitted by Broker.
+type BrokerEvent struct {
+	Time     time.Time `json:"time"`
+	ClientID string    `json:"client_id"`
+	Remote   string    `json:"remote"`
+	Online   bool      `json:"online"`
+}
+
+// Broker will run a local MQTT broker using the provided configuration until
+// the specified quit channel is closed. The optional callback is called
+// whenever a client connects or disconnects.
+func Broker(config BrokerConfig, quit chan struct{}, cb func(*BrokerEvent)) error {
+	// check address
+	if config.TCPAddress == "" {
+		return errors.New("missing tcp address")
+	}
+
+	// prepare launch config
+	var launchConfig transport.LaunchConfig
+
+	// prepare schemes
+	tcpScheme, wsScheme := "tcp", "ws"
+
+	// load certificate if available
+	if config.CertFile != "" {
+		// load key pair
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		// set tls config
+		launchConfig.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+
+		// set secure schemes
+		tcpScheme, wsScheme = "mqtts", "wss"
+	}
+
+	// create launcher
+	launcher := transport.NewLauncher(launchConfig)
+
+	// prepare backend
+	backend := broker.NewMemoryBackend()
+
+	// set credentials if available
+	if config.Username != "" {
+		backend.Credentials = map[string]string{
+			config.Username: config.Password,
+		}
+	}
+
+	// prepare table of connected clients
+	connected := make(map[*broker.Client]bool)
+	var mutex sync.Mutex
+
+	// set logger
+	backend.Logger = func(event broker.LogEvent, client *broker.Client, pkt packet.Generic, _ *packet.Message, _ error) {
+		// check callback
+		if cb == nil {
+			return
+		}
+
+		// acquire mutex
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// determine state, clients are online once the connection has been
+		// acknowledged and offline once the connection has been lost
+		var online bool
+		switch event {
+		case broker.PacketSent:
+			connack, ok := pkt.(*packet.Connack)
+			if !ok || connack.ReturnCode != packet.ConnectionAccepted {
+				return
+			}
+
+			connected[client] = true
+			online = true
+		case broker.LostConnection:
+			if !connected[client] {
+				return
+			}
+
+			delete(connected, client)
+		default:
+			return
+		}
+
+		// call callback
+		cb(&BrokerEvent{
+			Time:     time.Now(),
+			ClientID: client.ID(),
+			Remote:   client.Conn().RemoteAddr().String(),
+			Online:   online,
+		})
+	}
+
+	// prepare channels
+	errs := make(chan error, 2)
+
+	// create engine
+	engine := broker.NewEngine(backend)
+	engine.OnError = func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+
+	// prepare servers
+	var servers []transport.Server
+
+	// make sure servers and engine get closed
+	defer func() {
+		for _, server := range servers {
+			_ = server.Close()
+		}
+
+		engine.Close()
+	}()
+
+	// launch tcp server
+	server, err := launcher.Launch(tcpScheme + "://" + config.TCPAddress)
+	if err != nil {
+		return err
+	}
+
+	// accept connections
+	servers = append(servers, server)
+	engine.Accept(server)
+
+	// launch websocket server if requested
+	if config.WebSocketAddress != "" {
+		server, err := launcher.Launch(wsScheme + "://" + config.WebSocketAddress)
+		if err != nil {
+			return err
+		}
+
+		// accept connections
+		servers = append(servers, server)
+		engine.Accept(server)
+	}
+
+	// wait for error or quit
+	select {
+	case err = <-errs:
+		return err
+	case <-quit:
+		return nil
+	}
+}
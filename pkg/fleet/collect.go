@@ -21,7 +21,7 @@ type Announcement struct {
 // MQTT broker and sending the 'collect' command.
 //
 // Note: Not correctly formatted announcements are ignored.
-func Collect(url string, duration time.Duration) ([]*Announcement, error) {
+func Collect(config *Config, duration time.Duration) ([]*Announcement, error) {
 	// prepare channels
 	errs := make(chan error)
 	anns := make(chan *Announcement)
@@ -37,28 +37,26 @@ func Collect(url string, duration time.Duration) ([]*Announcement, error) {
 			return nil
 		}
 
-		// get data from payload
-		data := strings.Split(string(msg.Payload), ",")
-
-		// check length
-		if len(data) < 4 {
+		// parse announcement
+		ann := parseAnnouncement(msg.Payload)
+		if ann == nil {
 			return nil
 		}
 
 		// add announcement
-		anns <- &Announcement{
-			ReceivedAt:      time.Now(),
-			BaseTopic:       data[3],
-			DeviceType:      data[0],
-			FirmwareVersion: data[1],
-			DeviceName:      data[2],
-		}
+		anns <- ann
 
 		return nil
 	}
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return nil, err
 	}
@@ -115,3 +113,101 @@ exit:
 
 	return list, nil
 }
+
+// Listen will connect to the specified MQTT broker and call the supplied callback
+// for every announcement until the specified quit channel is closed. Unlike
+// Collect it will not send the 'collect' command and only yield announcements
+// that are published by the devices on their own or requested by others.
+//
+// Note: Not correctly formatted announcements are ignored.
+func Listen(config *Config, quit chan struct{}, timeout time.Duration, cb func(*Announcement)) error {
+	// prepare channels
+	errs := make(chan error, 1)
+
+	// create client
+	cl := client.New()
+
+	// set callback
+	cl.Callback = func(msg *packet.Message, err error) error {
+		// send errors
+		if err != nil {
+			errs <- err
+			return nil
+		}
+
+		// parse announcement
+		ann := parseAnnouncement(msg.Payload)
+		if ann == nil {
+			return nil
+		}
+
+		// call callback
+		cb(ann)
+
+		return nil
+	}
+
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
+	if err != nil {
+		return err
+	}
+
+	// wait for ack
+	err = cf.Wait(timeout)
+	if err != nil {
+		return err
+	}
+
+	// make sure client gets closed
+	defer cl.Close()
+
+	// subscribe to announcement topic
+	sf, err := cl.Subscribe("naos/announcement", 0)
+	if err != nil {
+		return err
+	}
+
+	// wait for ack
+	err = sf.Wait(timeout)
+	if err != nil {
+		return err
+	}
+
+	// wait for error or quit
+	select {
+	case err = <-errs:
+		return err
+	case <-quit:
+		// move on
+	}
+
+	// disconnect client
+	cl.Disconnect()
+
+	return nil
+}
+
+func parseAnnouncement(payload []byte) *Announcement {
+	// get data from payload
+	data := strings.Split(string(payload), ",")
+
+	// check length
+	if len(data) < 4 {
+		return nil
+	}
+
+	return &Announcement{
+		ReceivedAt:      time.Now(),
+		BaseTopic:       data[3],
+		DeviceType:      data[0],
+		FirmwareVersion: data[1],
+		DeviceName:      data[2],
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 // Debug will request coredump debug information from the specified devices.
-func Debug(url string, baseTopics []string, delete bool, duration time.Duration) (map[string][]byte, error) {
+func Debug(config *Config, baseTopics []string, delete bool, duration time.Duration) (map[string][]byte, error) {
 	// check base topics
 	if len(baseTopics) == 0 {
 		return nil, errors.New("zero base topics")
@@ -49,8 +49,14 @@ func Debug(url string, baseTopics []string, delete bool, duration time.Duration)
 		return nil
 	}
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return nil, err
 	}
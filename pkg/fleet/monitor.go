@@ -12,16 +12,16 @@ import (
 
 // A Heartbeat is emitted by Monitor.
 type Heartbeat struct {
-	ReceivedAt      time.Time
-	BaseTopic       string
-	DeviceName      string
-	DeviceType      string
-	FirmwareVersion string
-	FreeHeapSize    int64
-	UpTime          time.Duration
-	StartPartition  string
-	BatteryLevel    float64 // -1, 0 - 1
-	SignalStrength  int64   // -50 - -100
+	ReceivedAt      time.Time     `json:"received_at"`
+	BaseTopic       string        `json:"base_topic"`
+	DeviceName      string        `json:"device_name"`
+	DeviceType      string        `json:"device_type"`
+	FirmwareVersion string        `json:"firmware_version"`
+	FreeHeapSize    int64         `json:"free_heap_size"`
+	UpTime          time.Duration `json:"up_time"`
+	StartPartition  string        `json:"start_partition"`
+	BatteryLevel    float64       `json:"battery_level"`   // -1, 0 - 1
+	SignalStrength  int64         `json:"signal_strength"` // -50 - -100
 }
 
 // Monitor will connect to the specified MQTT broker and listen on the passed
@@ -29,7 +29,7 @@ type Heartbeat struct {
 // quit channel is closed.
 //
 // Note: Not correctly formatted heartbeats are ignored.
-func Monitor(url string, baseTopics []string, quit chan struct{}, timeout time.Duration, cb func(*Heartbeat)) error {
+func Monitor(config *Config, baseTopics []string, quit chan struct{}, timeout time.Duration, cb func(*Heartbeat)) error {
 	// check base topics
 	if len(baseTopics) == 0 {
 		return errors.New("zero base topics")
@@ -85,7 +85,7 @@ func Monitor(url string, baseTopics []string, quit chan struct{}, timeout time.D
 
 		// set base topic
 		for _, baseTopic := range baseTopics {
-			if strings.HasPrefix(msg.Topic, baseTopic) {
+			if msg.Topic == baseTopic+"/naos/heartbeat" {
 				hb.BaseTopic = baseTopic
 			}
 		}
@@ -96,8 +96,14 @@ func Monitor(url string, baseTopics []string, quit chan struct{}, timeout time.D
 		return nil
 	}
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return err
 	}
@@ -6,37 +6,41 @@ import (
 	"time"
 
 	"github.com/256dpi/gomqtt/client"
-	"github.com/256dpi/gomqtt/packet"
 )
 
-// Discover will connect to the specified MQTT broker and publish the 'discover'
-// command to receive a list of available parameters.
-func Discover(url string, baseTopics []string, timeout time.Duration) (map[string][]string, error) {
-	// check base topics
-	if len(baseTopics) == 0 {
-		return nil, errors.New("zero base topics")
-	}
+// A DiscoverResult is returned by Discover.
+type DiscoverResult struct {
+	// The reported parameters by base topic.
+	Parameters map[string][]string
 
-	// prepare channels
-	errs := make(chan error, 1)
-	response := make(chan struct{}, len(baseTopics))
-
-	// prepare table
-	table := make(map[string][]string)
+	// The base topics that did not respond.
+	Missing []string
+}
 
-	// create client
-	cl := client.New()
+// Discover will connect to the specified MQTT broker and publish the 'discover'
+// command to receive a list of available parameters. Devices that do not respond
+// within the timeout are asked again up to the specified amount of retries.
+func Discover(config *Config, baseTopics []string, retries int, timeout time.Duration) (*DiscoverResult, error) {
+	// request parameters
+	table, missing, err := request(config, baseTopics, func(baseTopic string) (string, []byte) {
+		return baseTopic + "/naos/discover", nil
+	}, func(baseTopic string) string {
+		return baseTopic + "/naos/parameters"
+	}, retries, timeout)
+	if err != nil {
+		return nil, err
+	}
 
-	// set callback
-	cl.Callback = func(msg *packet.Message, err error) error {
-		// send errors
-		if err != nil {
-			errs <- err
-			return nil
-		}
+	// prepare result
+	result := &DiscoverResult{
+		Parameters: make(map[string][]string, len(table)),
+		Missing:    missing,
+	}
 
+	// parse responses
+	for baseTopic, res := range table {
 		// parse message
-		segments := strings.Split(string(msg.Payload), ",")
+		segments := strings.Split(string(res.Payload), ",")
 
 		// create parameters
 		list := make([]string, 0, len(segments))
@@ -46,105 +50,40 @@ func Discover(url string, baseTopics []string, timeout time.Duration) (map[strin
 		}
 
 		// update table
-		for _, baseTopic := range baseTopics {
-			if msg.Topic == baseTopic+"/naos/parameters" {
-				table[baseTopic] = list
-				response <- struct{}{}
-			}
-		}
-
-		return nil
-	}
-
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
-	if err != nil {
-		return nil, err
-	}
-
-	// wait for ack
-	err = cf.Wait(timeout)
-	if err != nil {
-		return nil, err
-	}
-
-	// make sure client gets closed
-	defer cl.Close()
-
-	// prepare subscriptions
-	var subs []packet.Subscription
-
-	// add subscriptions
-	for _, baseTopic := range baseTopics {
-		subs = append(subs, packet.Subscription{
-			Topic: baseTopic + "/naos/parameters",
-			QOS:   0,
-		})
-	}
-
-	// subscribe to next chunk topic
-	sf, err := cl.SubscribeMultiple(subs)
-	if err != nil {
-		return nil, err
-	}
-
-	// wait for ack
-	err = sf.Wait(timeout)
-	if err != nil {
-		return nil, err
-	}
-
-	// send get or set commands
-	for _, baseTopic := range baseTopics {
-		// publish discover
-		pf, err := cl.Publish(baseTopic+"/naos/discover", nil, 0, false)
-		if err != nil {
-			return nil, err
-		}
-
-		// wait for ack
-		err = pf.Wait(timeout)
-		if err != nil {
-			return nil, err
-		}
+		result.Parameters[baseTopic] = list
 	}
 
-	// prepare counter
-	counter := len(baseTopics)
+	return result, nil
+}
 
-	// prepare timeout
-	deadline := time.After(timeout)
+// A ParamsResult is returned by GetParams and SetParams.
+type ParamsResult struct {
+	// The reported values by base topic.
+	Values map[string]string
 
-	// wait for errors, counter or timeout
-	for {
-		select {
-		case err = <-errs:
-			return table, err
-		case <-response:
-			if counter--; counter == 0 {
-				return table, cl.Disconnect()
-			}
-		case <-deadline:
-			return table, cl.Disconnect()
-		}
-	}
+	// The base topics that did not respond.
+	Missing []string
 }
 
 // GetParams will connect to the specified MQTT broker and publish the 'get'
 // command to receive the provided parameter for all specified base topics.
-func GetParams(url, param string, baseTopics []string, timeout time.Duration) (map[string]string, error) {
-	return commonGetSet(url, param, "", false, baseTopics, timeout)
+// Devices that do not respond within the timeout are asked again up to the
+// specified amount of retries.
+func GetParams(config *Config, param string, baseTopics []string, retries int, timeout time.Duration) (*ParamsResult, error) {
+	return commonGetSet(config, param, "", false, baseTopics, retries, timeout)
 }
 
 // SetParams will connect to the specified MQTT broker and publish the 'set'
 // command to receive the provided updated parameter for all specified base topics.
-func SetParams(url, param, value string, baseTopics []string, timeout time.Duration) (map[string]string, error) {
-	return commonGetSet(url, param, value, true, baseTopics, timeout)
+// Devices that do not respond within the timeout are asked again up to the
+// specified amount of retries.
+func SetParams(config *Config, param, value string, baseTopics []string, retries int, timeout time.Duration) (*ParamsResult, error) {
+	return commonGetSet(config, param, value, true, baseTopics, retries, timeout)
 }
 
 // UnsetParams will connect to the specified MQTT broker and publish the 'unset'
 // command to unset the provided parameter for all specified base topics.
-func UnsetParams(url, param string, baseTopics []string, timeout time.Duration) error {
+func UnsetParams(config *Config, param string, baseTopics []string, timeout time.Duration) error {
 	// check base topics
 	if len(baseTopics) == 0 {
 		return errors.New("zero base topics")
@@ -153,8 +92,14 @@ func UnsetParams(url, param string, baseTopics []string, timeout time.Duration)
 	// create client
 	cl := client.New()
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return err
 	}
@@ -195,121 +140,32 @@ func UnsetParams(url, param string, baseTopics []string, timeout time.Duration)
 	return nil
 }
 
-func commonGetSet(url, param, value string, set bool, baseTopics []string, timeout time.Duration) (map[string]string, error) {
-	// check base topics
-	if len(baseTopics) == 0 {
-		return nil, errors.New("zero base topics")
-	}
-
-	// prepare channels
-	errs := make(chan error, 1)
-	response := make(chan struct{}, len(baseTopics))
-
-	// prepare table
-	table := make(map[string]string)
-
-	// create client
-	cl := client.New()
-
-	// set callback
-	cl.Callback = func(msg *packet.Message, err error) error {
-		// send errors
-		if err != nil {
-			errs <- err
-			return nil
-		}
-
-		// update table
-		for _, baseTopic := range baseTopics {
-			if msg.Topic == baseTopic+"/naos/value/"+param {
-				table[baseTopic] = string(msg.Payload)
-				response <- struct{}{}
-			}
+func commonGetSet(config *Config, param, value string, set bool, baseTopics []string, retries int, timeout time.Duration) (*ParamsResult, error) {
+	// send get or set commands
+	table, missing, err := request(config, baseTopics, func(baseTopic string) (string, []byte) {
+		// override if set is set
+		if set {
+			return baseTopic + "/naos/set/" + param, []byte(value)
 		}
 
-		return nil
-	}
-
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+		return baseTopic + "/naos/get/" + param, nil
+	}, func(baseTopic string) string {
+		return baseTopic + "/naos/value/" + param
+	}, retries, timeout)
 	if err != nil {
 		return nil, err
 	}
 
-	// wait for ack
-	err = cf.Wait(timeout)
-	if err != nil {
-		return nil, err
+	// prepare result
+	result := &ParamsResult{
+		Values:  make(map[string]string, len(table)),
+		Missing: missing,
 	}
 
-	// make sure client gets closed
-	defer cl.Close()
-
-	// prepare subscriptions
-	var subs []packet.Subscription
-
-	// add subscriptions
-	for _, baseTopic := range baseTopics {
-		subs = append(subs, packet.Subscription{
-			Topic: baseTopic + "/naos/value/" + param,
-			QOS:   0,
-		})
+	// update table
+	for baseTopic, res := range table {
+		result.Values[baseTopic] = string(res.Payload)
 	}
 
-	// subscribe to next chunk topic
-	sf, err := cl.SubscribeMultiple(subs)
-	if err != nil {
-		return nil, err
-	}
-
-	// wait for ack
-	err = sf.Wait(timeout)
-	if err != nil {
-		return nil, err
-	}
-
-	// send get or set commands
-	for _, baseTopic := range baseTopics {
-		// init variables
-		topic := baseTopic + "/naos/get/" + param
-		payload := ""
-
-		// override if set is set
-		if set {
-			topic = baseTopic + "/naos/set/" + param
-			payload = value
-		}
-
-		// publish config update
-		pf, err := cl.Publish(topic, []byte(payload), 0, false)
-		if err != nil {
-			return nil, err
-		}
-
-		// wait for ack
-		err = pf.Wait(timeout)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	// prepare counter
-	counter := len(baseTopics)
-
-	// prepare timeout
-	deadline := time.After(timeout)
-
-	// wait for errors, counter or timeout
-	for {
-		select {
-		case err = <-errs:
-			return table, err
-		case <-response:
-			if counter--; counter == 0 {
-				return table, cl.Disconnect()
-			}
-		case <-deadline:
-			return table, cl.Disconnect()
-		}
-	}
+	return result, nil
 }
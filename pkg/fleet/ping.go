@@ -0,0 +1,45 @@
+package fleet
+
+import "time"
+
+// A PingResult is returned by Ping.
+type PingResult struct {
+	// The measured round trip times by base topic.
+	Latencies map[string]time.Duration
+
+	// The base topics that did not respond.
+	Missing []string
+}
+
+// Ping will connect to the specified MQTT broker and publish the 'ping' command
+// to all specified base topics. It will then wait for the next heartbeat and
+// measure the round trip time.
+//
+// Note: Heartbeats do not reference the ping that triggered them and devices
+// also send them periodically. A heartbeat that was already in flight when the
+// ping was sent is counted as the response, which makes the measured latency
+// and availability a best effort estimate.
+func Ping(config *Config, baseTopics []string, timeout time.Duration) (*PingResult, error) {
+	// send ping commands
+	table, missing, err := request(config, baseTopics, func(baseTopic string) (string, []byte) {
+		return baseTopic + "/naos/ping", nil
+	}, func(baseTopic string) string {
+		return baseTopic + "/naos/heartbeat"
+	}, 0, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare result
+	result := &PingResult{
+		Latencies: make(map[string]time.Duration, len(table)),
+		Missing:   missing,
+	}
+
+	// calculate latencies
+	for baseTopic, res := range table {
+		result.Latencies[baseTopic] = res.ReceivedAt.Sub(res.SentAt)
+	}
+
+	return result, nil
+}
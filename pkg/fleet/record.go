@@ -2,7 +2,6 @@ package fleet
 
 import (
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/256dpi/gomqtt/client"
@@ -17,7 +16,7 @@ type LogMessage struct {
 
 // Record will enable log recording mode and yield the received log messages
 // until the provided channel has been closed.
-func Record(url string, baseTopics []string, quit chan struct{}, timeout time.Duration, cb func(*LogMessage)) error {
+func Record(config *Config, baseTopics []string, quit chan struct{}, timeout time.Duration, cb func(*LogMessage)) error {
 	// check base topics
 	if len(baseTopics) == 0 {
 		return errors.New("zero base topics")
@@ -42,7 +41,7 @@ func Record(url string, baseTopics []string, quit chan struct{}, timeout time.Du
 
 		// set base topic
 		for _, baseTopic := range baseTopics {
-			if strings.HasPrefix(msg.Topic, baseTopic) {
+			if msg.Topic == baseTopic+"/naos/log" {
 				log.BaseTopic = baseTopic
 			}
 		}
@@ -53,8 +52,14 @@ func Record(url string, baseTopics []string, quit chan struct{}, timeout time.Du
 		return nil
 	}
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,220 @@
+package fleet
+
+import (
+	"errors"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// A response is collected by request for every answering base topic.
+type response struct {
+	BaseTopic  string
+	Topic      string
+	Payload    []byte
+	SentAt     time.Time
+	ReceivedAt time.Time
+}
+
+// request will publish the message returned by the outgoing function to all
+// specified base topics and wait for a response on the topic returned by the
+// incoming function. Base topics that did not respond within the timeout are
+// requested again up to the specified amount of retries and then returned as
+// missing.
+func request(config *Config, baseTopics []string, outgoing func(string) (string, []byte), incoming func(string) string, retries int, timeout time.Duration) (map[string]*response, []string, error) {
+	// check base topics
+	if len(baseTopics) == 0 {
+		return nil, nil, errors.New("zero base topics")
+	}
+
+	// prepare lookup table
+	lookup := make(map[string]string, len(baseTopics))
+	for _, baseTopic := range baseTopics {
+		lookup[incoming(baseTopic)] = baseTopic
+	}
+
+	// prepare channels
+	errs := make(chan error, 1)
+	responses := make(chan *response, len(baseTopics)*(retries+1))
+
+	// create client
+	cl := client.New()
+
+	// set callback
+	cl.Callback = func(msg *packet.Message, err error) error {
+		// send errors
+		if err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+
+			return nil
+		}
+
+		// get base topic
+		baseTopic, ok := lookup[msg.Topic]
+		if !ok {
+			return nil
+		}
+
+		// forward response
+		select {
+		case responses <- &response{
+			BaseTopic:  baseTopic,
+			Topic:      msg.Topic,
+			Payload:    msg.Payload,
+			ReceivedAt: time.Now(),
+		}:
+		default:
+		}
+
+		return nil
+	}
+
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// wait for ack
+	err = cf.Wait(timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// make sure client gets closed
+	defer cl.Close()
+
+	// prepare subscriptions
+	var subs []packet.Subscription
+
+	// add subscriptions
+	for _, baseTopic := range baseTopics {
+		subs = append(subs, packet.Subscription{
+			Topic: incoming(baseTopic),
+			QOS:   0,
+		})
+	}
+
+	// subscribe to response topics
+	sf, err := cl.SubscribeMultiple(subs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// wait for ack
+	err = sf.Wait(timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// prepare table
+	table := make(map[string]*response, len(baseTopics))
+
+	// prepare send times of all attempts
+	sentAt := make(map[string][]time.Time, len(baseTopics))
+
+	// prepare pending list
+	pending := baseTopics
+
+	// perform attempts
+	for attempt := 0; attempt <= retries && len(pending) > 0; attempt++ {
+		// send requests
+		for _, baseTopic := range pending {
+			// get message
+			topic, payload := outgoing(baseTopic)
+
+			// save time
+			sentAt[baseTopic] = append(sentAt[baseTopic], time.Now())
+
+			// publish request
+			pf, err := cl.Publish(topic, payload, 0, false)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			// wait for ack
+			err = pf.Wait(timeout)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		// prepare timeout
+		deadline := time.After(timeout)
+
+		// wait for errors, responses or timeout
+	wait:
+		for len(table) < len(baseTopics) {
+			select {
+			case err = <-errs:
+				return nil, nil, err
+			case res := <-responses:
+				// ignore duplicates
+				if _, ok := table[res.BaseTopic]; ok {
+					continue
+				}
+
+				// get send time, ignore messages received before the first request
+				sent, ok := firstSent(sentAt[res.BaseTopic], res.ReceivedAt)
+				if !ok {
+					continue
+				}
+
+				// add response
+				res.SentAt = sent
+				table[res.BaseTopic] = res
+			case <-deadline:
+				break wait
+			}
+		}
+
+		// compute remaining base topics
+		pending = missing(baseTopics, table)
+	}
+
+	// disconnect client
+	err = cl.Disconnect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return table, pending, nil
+}
+
+// firstSent returns the earliest send time before the message has been received.
+// As responses cannot be attributed to a specific attempt, a late response to an
+// earlier attempt is never paired with a later attempt.
+func firstSent(times []time.Time, received time.Time) (time.Time, bool) {
+	// find earliest time
+	for _, sent := range times {
+		if !received.Before(sent) {
+			return sent, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func missing(baseTopics []string, table map[string]*response) []string {
+	// prepare list
+	var list []string
+
+	// add base topics without response
+	for _, baseTopic := range baseTopics {
+		if _, ok := table[baseTopic]; !ok {
+			list = append(list, baseTopic)
+		}
+	}
+
+	return list
+}
@@ -7,12 +7,18 @@ import (
 )
 
 // Send will send a message to all provided topics.
-func Send(url string, topics []string, message string, timeout time.Duration) error {
+func Send(config *Config, topics []string, message []byte, timeout time.Duration) error {
 	// create client
 	cl := client.New()
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return err
 	}
@@ -28,7 +34,7 @@ func Send(url string, topics []string, message string, timeout time.Duration) er
 
 	// publish all messages
 	for _, topic := range topics {
-		_, err = cl.Publish(topic, []byte(message), 0, false)
+		_, err = cl.Publish(topic, message, 0, false)
 		if err != nil {
 			return err
 		}
@@ -39,3 +45,41 @@ func Send(url string, topics []string, message string, timeout time.Duration) er
 
 	return nil
 }
+
+// A RequestResult is returned by Request.
+type RequestResult struct {
+	// The received replies by base topic.
+	Replies map[string][]byte
+
+	// The base topics that did not respond.
+	Missing []string
+}
+
+// Request will send a message to the specified topic below all provided base
+// topics and wait for a reply on the specified response topic below the same
+// base topics. Devices that do not respond within the timeout are asked again
+// up to the specified amount of retries.
+func Request(config *Config, baseTopics []string, topic string, message []byte, response string, retries int, timeout time.Duration) (*RequestResult, error) {
+	// send messages
+	table, missing, err := request(config, baseTopics, func(baseTopic string) (string, []byte) {
+		return baseTopic + "/" + topic, message
+	}, func(baseTopic string) string {
+		return baseTopic + "/" + response
+	}, retries, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare result
+	result := &RequestResult{
+		Replies: make(map[string][]byte, len(table)),
+		Missing: missing,
+	}
+
+	// add replies
+	for baseTopic, res := range table {
+		result.Replies[baseTopic] = res.Payload
+	}
+
+	return result, nil
+}
@@ -0,0 +1,121 @@
+package fleet
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// A Message is emitted by Subscribe.
+type Message struct {
+	ReceivedAt time.Time
+	BaseTopic  string
+	Topic      string
+	Payload    []byte
+}
+
+// Subscribe will connect to the specified MQTT broker and subscribe to the
+// provided topic below all specified base topics. The topic may contain MQTT
+// wildcards. The supplied callback is called for every received message until
+// the specified quit channel is closed.
+func Subscribe(config *Config, baseTopics []string, topic string, quit chan struct{}, timeout time.Duration, cb func(*Message)) error {
+	// check base topics
+	if len(baseTopics) == 0 {
+		return errors.New("zero base topics")
+	}
+
+	// prepare channels
+	errs := make(chan error, 1)
+
+	// create client
+	cl := client.New()
+
+	// set callback
+	cl.Callback = func(msg *packet.Message, err error) error {
+		// send errors
+		if err != nil {
+			errs <- err
+			return nil
+		}
+
+		// prepare message
+		message := &Message{
+			ReceivedAt: time.Now(),
+			Topic:      msg.Topic,
+			Payload:    msg.Payload,
+		}
+
+		// set base topic using the longest match
+		for _, baseTopic := range baseTopics {
+			if strings.HasPrefix(msg.Topic, baseTopic+"/") && len(baseTopic) > len(message.BaseTopic) {
+				message.BaseTopic = baseTopic
+				message.Topic = strings.TrimPrefix(msg.Topic, baseTopic+"/")
+			}
+		}
+
+		// call callback
+		cb(message)
+
+		return nil
+	}
+
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
+	if err != nil {
+		return err
+	}
+
+	// wait for ack
+	err = cf.Wait(timeout)
+	if err != nil {
+		return err
+	}
+
+	// make sure client gets closed
+	defer cl.Close()
+
+	// prepare subscriptions
+	var subs []packet.Subscription
+
+	// add subscriptions
+	for _, baseTopic := range baseTopics {
+		subs = append(subs, packet.Subscription{
+			Topic: baseTopic + "/" + topic,
+			QOS:   0,
+		})
+	}
+
+	// subscribe to topics
+	sf, err := cl.SubscribeMultiple(subs)
+	if err != nil {
+		return err
+	}
+
+	// wait for ack
+	err = sf.Wait(timeout)
+	if err != nil {
+		return err
+	}
+
+	// wait for error or quit
+	select {
+	case err = <-errs:
+		return err
+	case <-quit:
+		// move on
+	}
+
+	// disconnect client
+	cl.Disconnect()
+
+	return nil
+}
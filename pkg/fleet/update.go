@@ -11,16 +11,21 @@ import (
 	"github.com/256dpi/gomqtt/packet"
 )
 
-// UpdateStatus is emitted by updateOne and Update.
+// UpdateStatus is emitted by updateOne and Update. The device name is set by
+// callers that know the device. The error message is set along with the error
+// to allow encoding the status.
 type UpdateStatus struct {
-	Progress float64
-	Error    error
+	BaseTopic    string  `json:"base_topic" yaml:"base_topic"`
+	DeviceName   string  `json:"device_name" yaml:"device_name"`
+	Progress     float64 `json:"progress" yaml:"progress"`
+	Error        error   `json:"-" yaml:"-"`
+	ErrorMessage string  `json:"error" yaml:"error"`
 }
 
 // Update will concurrently perform a firmware update and block until all devices
 // have updated or returned errors. If a callback is provided it will be called
 // with the current status of the update.
-func Update(url string, baseTopics []string, firmware []byte, jobs int, timeout time.Duration, callback func(string, *UpdateStatus)) error {
+func Update(config *Config, baseTopics []string, firmware []byte, jobs int, timeout time.Duration, callback func(string, *UpdateStatus)) error {
 	// check base topics
 	if len(baseTopics) == 0 {
 		return errors.New("zero base topics")
@@ -38,7 +43,7 @@ func Update(url string, baseTopics []string, firmware []byte, jobs int, timeout
 	// fill table and queue
 	for _, baseTopic := range baseTopics {
 		// create status
-		table[baseTopic] = &UpdateStatus{}
+		table[baseTopic] = &UpdateStatus{BaseTopic: baseTopic}
 
 		// add job
 		queue <- baseTopic
@@ -55,7 +60,7 @@ func Update(url string, baseTopics []string, firmware []byte, jobs int, timeout
 		go func() {
 			for baseTopic := range queue {
 				// begin update
-				err := updateOne(url, baseTopic, firmware, timeout, func(progress float64) {
+				err := updateOne(config, baseTopic, firmware, timeout, func(progress float64) {
 					// lock mutex
 					mutex.Lock()
 					defer mutex.Unlock()
@@ -74,6 +79,7 @@ func Update(url string, baseTopics []string, firmware []byte, jobs int, timeout
 
 					// update error
 					table[baseTopic].Error = err
+					table[baseTopic].ErrorMessage = err.Error()
 
 					// call callback if provided
 					if callback != nil {
@@ -103,7 +109,7 @@ func Update(url string, baseTopics []string, firmware []byte, jobs int, timeout
 	return nil
 }
 
-func updateOne(url, baseTopic string, firmware []byte, timeout time.Duration, progress func(float64)) error {
+func updateOne(config *Config, baseTopic string, firmware []byte, timeout time.Duration, progress func(float64)) error {
 	// prepare channels
 	requests := make(chan int)
 	errs := make(chan error)
@@ -138,8 +144,14 @@ func updateOne(url, baseTopic string, firmware []byte, timeout time.Duration, pr
 		return nil
 	}
 
-	// connect to the broker using the provided url
-	cf, err := cl.Connect(client.NewConfig(url))
+	// prepare client config
+	cc, err := config.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	// connect to the broker using the provided config
+	cf, err := cl.Connect(cc)
 	if err != nil {
 		return err
 	}
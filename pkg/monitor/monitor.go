@@ -0,0 +1,291 @@
+// Package monitor implements a serial monitor that decodes backtraces, adds
+// timestamps to lines and reconnects to boards that are reset or re-plugged.
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// DefaultBaudRate is the baud rate used by the monitor if not specified.
+const DefaultBaudRate = 115200
+
+// The hotkeys.
+const (
+	keyInterrupt = 0x03 // Ctrl+C
+	keyBootMode  = 0x10 // Ctrl+P
+	keyReset     = 0x12 // Ctrl+R
+	keyMenu      = 0x14 // Ctrl+T
+	keyExit      = 0x1D // Ctrl+]
+)
+
+// The interval in which a disconnected port is reopened.
+const reconnectInterval = 500 * time.Millisecond
+
+// Help describes the available hotkeys.
+const Help = "Ctrl+] to exit, Ctrl+T Ctrl+R to reset, Ctrl+T Ctrl+P to reset into the bootloader"
+
+// The pattern that matches instruction addresses.
+var addressPattern = regexp.MustCompile(`0x4[0-2][0-9a-fA-F]{6}`)
+
+// A Port is a serial port that is connected to a board. It is implemented by
+// the ports returned by serial.Open.
+type Port interface {
+	io.ReadWriteCloser
+	SetDTR(dtr bool) error
+	SetRTS(rts bool) error
+}
+
+// Config configures the monitor.
+type Config struct {
+	// The serial port and baud rate.
+	Port     string
+	BaudRate int
+
+	// Prefix every line with the time it was received.
+	Timestamps bool
+
+	// Log receives a copy of the session if set.
+	Log io.Writer
+
+	// Decode resolves the instruction addresses in backtraces and panic
+	// messages to functions and source locations if set.
+	Decode func(addresses []string) ([]string, error)
+
+	// Open opens the port, defaults to serial.Open.
+	Open func(name string, baudRate int) (Port, error)
+}
+
+// Run will monitor the configured port until the exit hotkey is pressed or in
+// is exhausted. The data read from in is forwarded to the board. If in is a terminal, it is
+// switched into raw mode while running.
+func Run(config Config, out io.Writer, in io.Reader) error {
+	// set defaults
+	if config.BaudRate == 0 {
+		config.BaudRate = DefaultBaudRate
+	}
+	if config.Open == nil {
+		config.Open = openPort
+	}
+
+	// prepare monitor
+	m := &monitor{
+		config: config,
+		quit:   make(chan struct{}),
+		proc: &processor{
+			out:        out,
+			log:        config.Log,
+			timestamps: config.Timestamps,
+			decode:     config.Decode,
+			start:      true,
+			now:        time.Now,
+		},
+	}
+
+	// open port
+	err := m.open()
+	if err != nil {
+		return err
+	}
+
+	// enable raw mode if possible
+	if file, ok := in.(*os.File); ok && isTerminal(file) {
+		restore, err := rawMode(file)
+		if err == nil {
+			defer restore()
+		}
+	}
+
+	// handle input
+	go m.input(in)
+
+	// read output
+	m.output()
+
+	return nil
+}
+
+type monitor struct {
+	config Config
+	proc   *processor
+	port   Port
+	mutex  sync.Mutex
+	quit   chan struct{}
+	once   sync.Once
+}
+
+func (m *monitor) open() error {
+	// open port
+	port, err := m.config.Open(m.config.Port, m.config.BaudRate)
+	if err != nil {
+		return err
+	}
+
+	// release reset and boot mode pins
+	_ = port.SetDTR(false)
+	_ = port.SetRTS(false)
+
+	// set port
+	m.mutex.Lock()
+	m.port = port
+	m.mutex.Unlock()
+
+	// close port if quit in the meantime
+	select {
+	case <-m.quit:
+		_ = port.Close()
+		return errors.New("monitor closed")
+	default:
+	}
+
+	return nil
+}
+
+func (m *monitor) output() {
+	// prepare buffer
+	buf := make([]byte, 1024)
+
+	for {
+		// read data
+		m.mutex.Lock()
+		port := m.port
+		m.mutex.Unlock()
+		n, err := port.Read(buf)
+		if n > 0 {
+			m.proc.write(buf[:n])
+			continue
+		}
+
+		// close port
+		_ = port.Close()
+
+		// check quit
+		select {
+		case <-m.quit:
+			return
+		default:
+		}
+
+		// report disconnect
+		if err == nil {
+			err = io.EOF
+		}
+		m.proc.message(fmt.Sprintf("Disconnected (%s), waiting for port...", err))
+
+		// reconnect
+		for {
+			select {
+			case <-m.quit:
+				return
+			case <-time.After(reconnectInterval):
+			}
+			if m.open() == nil {
+				break
+			}
+		}
+
+		// report reconnect
+		m.proc.message("Reconnected.")
+	}
+}
+
+func (m *monitor) input(in io.Reader) {
+	// prepare buffer
+	buf := make([]byte, 64)
+	menu := false
+
+	for {
+		// read data, quit when the input is closed
+		n, err := in.Read(buf)
+		if err != nil {
+			m.close()
+			return
+		}
+
+		// handle bytes
+		for _, b := range buf[:n] {
+			// handle menu keys
+			if menu {
+				menu = false
+				switch b {
+				case keyReset, 'r', 'R':
+					m.reset(false)
+					continue
+				case keyBootMode, 'p', 'P':
+					m.reset(true)
+					continue
+				case keyExit, 'x', 'X':
+					m.close()
+					return
+				case keyMenu:
+					// send key below
+				default:
+					m.proc.message(Help)
+					continue
+				}
+			} else {
+				switch b {
+				case keyExit, keyInterrupt:
+					m.close()
+					return
+				case keyMenu:
+					menu = true
+					continue
+				}
+			}
+
+			// forward byte
+			m.mutex.Lock()
+			_, _ = m.port.Write([]byte{b})
+			m.mutex.Unlock()
+		}
+	}
+}
+
+func (m *monitor) reset(bootMode bool) {
+	// acquire port
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// report reset
+	if bootMode {
+		m.proc.message("Resetting into bootloader...")
+	} else {
+		m.proc.message("Resetting...")
+	}
+
+	// pull enable low and set boot mode
+	_ = m.port.SetDTR(bootMode)
+	_ = m.port.SetRTS(true)
+	time.Sleep(100 * time.Millisecond)
+
+	// release enable
+	_ = m.port.SetRTS(false)
+	time.Sleep(50 * time.Millisecond)
+
+	// release boot mode
+	_ = m.port.SetDTR(false)
+}
+
+func (m *monitor) close() {
+	m.once.Do(func() {
+		// signal quit
+		close(m.quit)
+
+		// close port to unblock reader
+		m.mutex.Lock()
+		_ = m.port.Close()
+		m.mutex.Unlock()
+	})
+}
+
+func openPort(name string, baudRate int) (Port, error) {
+	return serial.Open(name, &serial.Mode{BaudRate: baudRate})
+}
@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakePort struct {
+	io.Reader
+	written bytes.Buffer
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakePort(data string) *fakePort {
+	return &fakePort{
+		Reader: bytes.NewBufferString(data),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *fakePort) Read(buf []byte) (int, error) {
+	n, _ := p.Reader.Read(buf)
+	if n > 0 {
+		return n, nil
+	}
+	<-p.closed
+	return 0, io.EOF
+}
+
+func (p *fakePort) Write(buf []byte) (int, error) {
+	return p.written.Write(buf)
+}
+
+func (p *fakePort) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *fakePort) SetDTR(bool) error { return nil }
+
+func (p *fakePort) SetRTS(bool) error { return nil }
+
+func TestProcessor(t *testing.T) {
+	var out, log bytes.Buffer
+	p := &processor{
+		out:        &out,
+		log:        &log,
+		timestamps: true,
+		start:      true,
+		now: func() time.Time {
+			return time.Date(2020, 1, 1, 12, 30, 15, 0, time.UTC)
+		},
+		decode: func(addresses []string) ([]string, error) {
+			var lines []string
+			for _, addr := range addresses {
+				lines = append(lines, addr+": foo at bar.c:1")
+			}
+			return lines, nil
+		},
+	}
+
+	p.write([]byte("Hello\r\nBacktrace: 0x400d1234:0x3ffb0000 0x40081"))
+	p.write([]byte("234:0x3ffb0020\nfoo"))
+	p.message("Reconnected.")
+
+	expected := "[12:30:15.000] Hello\r\n" +
+		"[12:30:15.000] Backtrace: 0x400d1234:0x3ffb0000 0x40081234:0x3ffb0020\n" +
+		"[12:30:15.000] --- 0x400d1234: foo at bar.c:1\n" +
+		"[12:30:15.000] --- 0x40081234: foo at bar.c:1\n" +
+		"[12:30:15.000] foo\n" +
+		"[12:30:15.000] --- Reconnected.\n"
+	assert.Equal(t, expected, out.String())
+	assert.Equal(t, expected, log.String())
+}
+
+func TestRun(t *testing.T) {
+	ports := []*fakePort{
+		newFakePort("one\n"),
+		newFakePort("two\n"),
+	}
+
+	inReader, inWriter := io.Pipe()
+
+	var opened int
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- Run(Config{
+			Port: "fake",
+			Open: func(name string, baudRate int) (Port, error) {
+				assert.Equal(t, "fake", name)
+				assert.Equal(t, DefaultBaudRate, baudRate)
+				port := ports[opened]
+				opened++
+				return port, nil
+			},
+		}, &out, inReader)
+	}()
+
+	// disconnect first port
+	time.Sleep(50 * time.Millisecond)
+	_ = ports[0].Close()
+
+	// wait for reconnect and send input
+	time.Sleep(2 * reconnectInterval)
+	_, _ = inWriter.Write([]byte("x\x1d"))
+
+	assert.NoError(t, <-done)
+	assert.Equal(t, 2, opened)
+	assert.Equal(t, "one\n--- Disconnected (EOF), waiting for port...\n--- Reconnected.\ntwo\n", out.String())
+	assert.Equal(t, "x", ports[1].written.String())
+}
+
+func TestRunInputEOF(t *testing.T) {
+	port := newFakePort("one\n")
+
+	var out bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- Run(Config{
+			Port: "fake",
+			Open: func(string, int) (Port, error) {
+				return port, nil
+			},
+		}, &out, bytes.NewReader(nil))
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("monitor did not quit")
+	}
+}
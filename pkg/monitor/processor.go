@@ -0,0 +1,131 @@
+package monitor
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// The layout of line timestamps.
+const timestampLayout = "15:04:05.000"
+
+// A processor writes the received data to the output and log, adds timestamps
+// and appends decoded addresses after completed lines.
+type processor struct {
+	out        io.Writer
+	log        io.Writer
+	timestamps bool
+	decode     func([]string) ([]string, error)
+	now        func() time.Time
+
+	line  []byte
+	start bool
+	mutex sync.Mutex
+}
+
+// write will process the received data.
+func (p *processor) write(data []byte) {
+	// acquire mutex
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// prepare buffer
+	var buf bytes.Buffer
+
+	for _, b := range data {
+		// add timestamp at line start
+		if p.start {
+			p.start = false
+			p.stamp(&buf)
+		}
+
+		// add byte
+		buf.WriteByte(b)
+
+		// handle line end
+		if b == '\n' {
+			p.start = true
+			p.decodeLine(&buf)
+			p.line = p.line[:0]
+		} else if b != '\r' {
+			p.line = append(p.line, b)
+		}
+	}
+
+	// emit data
+	p.emit(buf.Bytes())
+}
+
+// message will write a status message on a separate line.
+func (p *processor) message(msg string) {
+	// acquire mutex
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// prepare buffer
+	var buf bytes.Buffer
+
+	// terminate pending line
+	if !p.start {
+		buf.WriteByte('\n')
+		p.start = true
+		p.line = p.line[:0]
+	}
+
+	// add message
+	p.annotate(&buf, msg)
+
+	// emit data
+	p.emit(buf.Bytes())
+}
+
+func (p *processor) decodeLine(buf *bytes.Buffer) {
+	// check decoder
+	if p.decode == nil {
+		return
+	}
+
+	// find addresses
+	addresses := addressPattern.FindAllString(string(p.line), -1)
+	if len(addresses) == 0 {
+		return
+	}
+
+	// decode addresses
+	lines, err := p.decode(addresses)
+	if err != nil {
+		p.annotate(buf, "Failed to decode addresses: "+err.Error())
+		return
+	}
+
+	// add lines
+	for _, line := range lines {
+		p.annotate(buf, line)
+	}
+}
+
+func (p *processor) annotate(buf *bytes.Buffer, line string) {
+	p.stamp(buf)
+	buf.WriteString("--- ")
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+}
+
+func (p *processor) stamp(buf *bytes.Buffer) {
+	if p.timestamps {
+		buf.WriteString("[" + p.now().Format(timestampLayout) + "] ")
+	}
+}
+
+func (p *processor) emit(data []byte) {
+	// write output
+	if p.out != nil {
+		_, _ = p.out.Write(data)
+	}
+
+	// write log
+	if p.log != nil {
+		_, _ = p.log.Write(data)
+	}
+}
@@ -0,0 +1,52 @@
+package monitor
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rawMode will disable line buffering, echo and signals of the terminal so
+// that hotkeys are received immediately. The returned function restores the
+// previous state.
+func rawMode(file *os.File) (func(), error) {
+	// save state
+	state, err := stty(file, "-g")
+	if err != nil {
+		return nil, err
+	}
+
+	// set raw mode
+	_, err = stty(file, "-icanon", "-echo", "-isig", "-ixon", "min", "1")
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_, _ = stty(file, state)
+	}, nil
+}
+
+func stty(file *os.File, args ...string) (string, error) {
+	// prepare command
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = file
+
+	// run command
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func isTerminal(file *os.File) bool {
+	// get info
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
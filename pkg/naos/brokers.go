@@ -0,0 +1,257 @@
+package naos
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/256dpi/naos/pkg/fleet"
+)
+
+// A group is a set of devices that share the same broker.
+type group struct {
+	broker  string
+	config  *fleet.Config
+	devices map[string]*Device
+}
+
+// baseTopics returns the base topics of the devices in the group.
+func (g *group) baseTopics() []string {
+	// prepare list
+	list := make([]string, 0, len(g.devices))
+
+	// add base topics
+	for baseTopic := range g.devices {
+		list = append(list, baseTopic)
+	}
+
+	// sort list
+	sort.Strings(list)
+
+	return list
+}
+
+// lookup returns the devices for the provided base topics.
+func (g *group) lookup(baseTopics []string) []*Device {
+	// prepare list
+	var list []*Device
+
+	// add known devices
+	for _, baseTopic := range baseTopics {
+		if d, ok := g.devices[baseTopic]; ok {
+			list = append(list, d)
+		}
+	}
+
+	return list
+}
+
+func (i *Inventory) brokerURL(name string) (string, error) {
+	// use default broker if empty
+	if name == "" {
+		return i.Broker, nil
+	}
+
+	// get named broker
+	url, ok := i.Brokers[name]
+	if !ok {
+		return "", fmt.Errorf("unknown broker '%s'", name)
+	}
+
+	return url, nil
+}
+
+func (i *Inventory) brokerConfig(name string) (*fleet.Config, error) {
+	// get broker url
+	raw, err := i.brokerURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// resolve broker url
+	broker, _, err := resolveVariables(raw, i.credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare config
+	config := fleet.NewConfig(broker)
+
+	// return config if there are no additional options
+	if i.Connection == nil {
+		return config, nil
+	}
+
+	// prepare resolver
+	resolve := func(path string) string {
+		if path != "" && !filepath.IsAbs(path) {
+			return filepath.Join(i.dir, path)
+		}
+
+		return path
+	}
+
+	// set options
+	config.CAFile = resolve(i.Connection.CAFile)
+	config.CertFile = resolve(i.Connection.CertFile)
+	config.KeyFile = resolve(i.Connection.KeyFile)
+	config.ServerName = i.Connection.ServerName
+	config.InsecureSkipVerify = i.Connection.InsecureSkipVerify
+	config.ClientID = i.Connection.ClientID
+	config.KeepAlive = i.Connection.KeepAlive
+
+	return config, nil
+}
+
+// partition will group the provided devices by their broker.
+func (i *Inventory) partition(devices []*Device) ([]*group, error) {
+	// check devices
+	if len(devices) == 0 {
+		return nil, errors.New("no matching devices")
+	}
+
+	// prepare table
+	table := make(map[string]*group)
+
+	// prepare list
+	var groups []*group
+
+	// add devices
+	for _, d := range devices {
+		// get group
+		g, ok := table[d.Broker]
+		if !ok {
+			// get config
+			config, err := i.brokerConfig(d.Broker)
+			if err != nil {
+				return nil, err
+			}
+
+			// create group
+			g = &group{
+				broker:  d.Broker,
+				config:  config,
+				devices: make(map[string]*Device),
+			}
+
+			// add group
+			table[d.Broker] = g
+			groups = append(groups, g)
+		}
+
+		// add device
+		g.devices[d.BaseTopic] = d
+	}
+
+	// sort groups
+	sort.Slice(groups, func(a, b int) bool {
+		return groups[a].broker < groups[b].broker
+	})
+
+	return groups, nil
+}
+
+// groups will return a group for the default and every additional broker with
+// all devices that use the broker.
+func (i *Inventory) groups() ([]*group, error) {
+	// prepare names
+	names := []string{""}
+	for name := range i.Brokers {
+		names = append(names, name)
+	}
+
+	// sort names
+	sort.Strings(names)
+
+	// prepare list
+	var groups []*group
+
+	// create groups
+	for _, name := range names {
+		// get config
+		config, err := i.brokerConfig(name)
+		if err != nil {
+			return nil, err
+		}
+
+		// create group
+		g := &group{
+			broker:  name,
+			config:  config,
+			devices: make(map[string]*Device),
+		}
+
+		// add devices
+		for _, d := range i.Devices {
+			if d.Broker == name {
+				g.devices[d.BaseTopic] = d
+			}
+		}
+
+		// add group
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+// parallel will call the provided function concurrently for all groups and
+// return the first error once all functions returned.
+func parallel(groups []*group, fn func(*group) error) error {
+	return parallelUntil(groups, nil, func(g *group, _ chan struct{}) error {
+		return fn(g)
+	})
+}
+
+// parallelUntil will call the provided long-running function concurrently for
+// all groups. The quit channel passed to the function is closed when the
+// provided channel is closed or a function returns an error. It returns the
+// first error once all functions returned, so that no function modifies the
+// results of the caller afterwards.
+func parallelUntil(groups []*group, quit chan struct{}, fn func(*group, chan struct{}) error) error {
+	// prepare cancel channel
+	cancel := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(cancel)
+		})
+	}
+
+	// cancel on quit
+	done := make(chan struct{})
+	defer close(done)
+	if quit != nil {
+		go func() {
+			select {
+			case <-quit:
+				stop()
+			case <-done:
+			}
+		}()
+	}
+
+	// prepare errors
+	errs := make(chan error, len(groups))
+
+	// run function for all groups
+	for _, g := range groups {
+		go func(g *group) {
+			errs <- fn(g, cancel)
+		}(g)
+	}
+
+	// wait for completion and cancel others on the first error
+	var first error
+	for range groups {
+		err := <-errs
+		if err != nil && first == nil {
+			first = err
+			stop()
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,25 @@
+package naos
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelUntil(t *testing.T) {
+	cancelled := false
+
+	err := parallelUntil([]*group{{broker: "a"}, {broker: "b"}}, nil, func(g *group, quit chan struct{}) error {
+		if g.broker == "a" {
+			return errors.New("failed")
+		}
+
+		<-quit
+		cancelled = true
+
+		return nil
+	})
+	assert.EqualError(t, err, "failed")
+	assert.True(t, cancelled)
+}
@@ -0,0 +1,92 @@
+package naos
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+func readCredentials(path string) (map[string]string, error) {
+	// prepare table
+	table := make(map[string]string)
+
+	// read file
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return table, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// parse lines
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// get line
+		line := strings.TrimSpace(scanner.Text())
+
+		// skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// split line
+		key, value := line, ""
+		if i := strings.Index(line, "="); i >= 0 {
+			key, value = line[:i], line[i+1:]
+		}
+
+		// trim quotes
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		// set value
+		table[strings.TrimSpace(key)] = value
+	}
+
+	return table, scanner.Err()
+}
+
+func resolveVariables(str string, credentials map[string]string) (string, []string, error) {
+	// prepare lists
+	var secrets []string
+	var missing []string
+
+	// check variables
+	if !strings.Contains(str, "$") {
+		return str, nil, nil
+	}
+
+	// expand variables
+	str = os.Expand(str, func(name string) string {
+		// check environment
+		if value, ok := os.LookupEnv(name); ok {
+			secrets = append(secrets, value)
+			return value
+		}
+
+		// check credentials
+		if value, ok := credentials[name]; ok {
+			secrets = append(secrets, value)
+			return value
+		}
+
+		// add missing
+		missing = append(missing, name)
+
+		return ""
+	})
+
+	// check missing
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "", nil, fmt.Errorf("undefined variables in broker url: %s", strings.Join(missing, ", "))
+	}
+
+	return str, secrets, nil
+}
@@ -0,0 +1,220 @@
+package naos
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+
+	"github.com/256dpi/naos/pkg/fleet"
+)
+
+// Deliver will wait for devices matching the supplied glob pattern that have
+// queued operations to come online and then deliver the operations in order.
+// Devices are considered online when a heartbeat or announcement is received.
+// The specified callback is called for every delivered or failed operation.
+// Delivered operations are removed from the queue which is saved immediately.
+// The function returns when all operations have been delivered or the provided
+// channel has been closed.
+func (p *Project) Deliver(pattern string, quit chan struct{}, timeout time.Duration, callback func(*Device, *Operation, error)) error {
+	// check queue
+	if len(p.Queue.Filter(pattern)) == 0 {
+		return nil
+	}
+
+	// prepare channels
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	// prepare stopper
+	var stopOnce sync.Once
+	halt := func() {
+		stopOnce.Do(func() {
+			close(stop)
+		})
+	}
+
+	// stop on quit or when done
+	go func() {
+		select {
+		case <-quit:
+		case <-done:
+		case <-stop:
+		}
+
+		halt()
+	}()
+
+	// prepare state
+	var mutex sync.Mutex
+	var doneOnce sync.Once
+	var wg sync.WaitGroup
+	busy := make(map[*Device]bool)
+
+	// prepare device lock shared with the monitor and listener
+	var deviceMutex sync.Mutex
+
+	// prepare handler
+	online := func(device *Device) {
+		// acquire mutex
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		// check device
+		if busy[device] || !glob.Glob(pattern, device.Name) {
+			return
+		}
+
+		// get operations
+		ops := p.Queue.Pending(device.Name)
+		if len(ops) == 0 {
+			return
+		}
+
+		// mark device
+		busy[device] = true
+
+		// deliver operations
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for _, op := range ops {
+				// copy device to not race with the monitor and listener
+				deviceMutex.Lock()
+				snapshot := device.copy()
+				deviceMutex.Unlock()
+
+				// apply operation
+				err := p.apply(snapshot, op, timeout)
+
+				// update device if delivered
+				if !OperationFailed(err) {
+					deviceMutex.Lock()
+					device.Parameters = snapshot.Parameters
+					device.FirmwareVersion = snapshot.FirmwareVersion
+					deviceMutex.Unlock()
+				}
+
+				// acquire mutex
+				mutex.Lock()
+
+				// remove and save queue if delivered
+				if !OperationFailed(err) {
+					p.Queue.Remove(op)
+					if saveErr := p.SaveQueue(); saveErr != nil {
+						err = saveErr
+					}
+				}
+
+				// call callback
+				if callback != nil {
+					callback(device, op, err)
+				}
+
+				// release mutex
+				mutex.Unlock()
+
+				// stop on error to retain order
+				if OperationFailed(err) {
+					break
+				}
+			}
+
+			// acquire mutex
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			// unmark device
+			busy[device] = false
+
+			// check if done
+			if len(p.Queue.Filter(pattern)) == 0 {
+				doneOnce.Do(func() {
+					close(done)
+				})
+			}
+		}()
+	}
+
+	// prepare errors
+	errs := make(chan error, 2)
+
+	// monitor heartbeats
+	go func() {
+		err := p.Inventory.Monitor(pattern, &deviceMutex, stop, timeout, func(device *Device, _ *fleet.Heartbeat) {
+			online(device)
+		})
+		halt()
+		errs <- err
+	}()
+
+	// listen for announcements
+	go func() {
+		err := p.Inventory.Listen(&deviceMutex, stop, timeout, func(device *Device, _ *fleet.Announcement) {
+			online(device)
+		})
+		halt()
+		errs <- err
+	}()
+
+	// wait for both
+	err1, err2 := <-errs, <-errs
+
+	// wait for running deliveries
+	wg.Wait()
+
+	// return first error
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+func (p *Project) apply(device *Device, op *Operation, timeout time.Duration) error {
+	switch op.Action {
+	case SetAction:
+		// set parameter
+		result, err := p.Inventory.commonGetSet([]*Device{device}, op.Param, op.Value, true, 0, timeout)
+		if err != nil {
+			return err
+		} else if len(result.Missing) > 0 {
+			return errors.New("no response")
+		}
+
+		return nil
+	case UnsetAction:
+		// unset parameter
+		_, err := p.Inventory.unsetParams([]*Device{device}, op.Param, timeout)
+
+		return err
+	case UpdateAction:
+		// check version
+		if device.FirmwareVersion == op.Version {
+			return nil
+		}
+
+		// load and verify image
+		firmware, err := p.loadImage(op)
+		if err != nil {
+			return err
+		}
+
+		// update device
+		var updateErr error
+		err = p.Inventory.update(op.Version, []*Device{device}, firmware, 1, timeout, func(_ *Device, status *fleet.UpdateStatus) {
+			if status.Error != nil {
+				updateErr = status.Error
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		return updateErr
+	default:
+		return errors.New("unknown action")
+	}
+}
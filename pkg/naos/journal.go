@@ -0,0 +1,280 @@
+package naos
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+)
+
+// JournalFile is the name of the file next to the inventory file that records
+// all operations that modify devices or the inventory.
+const JournalFile = "naos.journal.jsonl"
+
+// The possible outcomes of an operation for a device.
+const (
+	// The device confirmed the operation.
+	Succeeded = "succeeded"
+
+	// The operation has been sent, but the protocol does not confirm it.
+	Sent = "sent"
+
+	// The device did not respond in time.
+	Missed = "missed"
+
+	// The operation failed for the device.
+	Failed = "failed"
+
+	// The device has been removed from the inventory.
+	Removed = "removed"
+)
+
+// A JournalEntry records a single operation.
+type JournalEntry struct {
+	Time    time.Time        `json:"time"`
+	User    string           `json:"user"`
+	Command string           `json:"command"`
+	Action  string           `json:"action"`
+	Param   string           `json:"param,omitempty"`
+	Topic   string           `json:"topic,omitempty"`
+	Devices []*JournalDevice `json:"devices"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// A JournalDevice records the effect of an operation on a single device.
+type JournalDevice struct {
+	Name    string `json:"name"`
+	Before  string `json:"before,omitempty"`
+	After   string `json:"after,omitempty"`
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// device returns the journal device for the named device.
+func (e *JournalEntry) device(name string) *JournalDevice {
+	// find device
+	for _, d := range e.Devices {
+		if d.Name == name {
+			return d
+		}
+	}
+
+	return nil
+}
+
+// newEntry creates a journal entry for the provided devices.
+func newEntry(action string, devices []*Device, before func(*Device) string) *JournalEntry {
+	// prepare entry
+	entry := &JournalEntry{
+		Action: action,
+	}
+
+	// add devices
+	for _, d := range devices {
+		jd := &JournalDevice{Name: d.Name}
+		if before != nil {
+			jd.Before = before(d)
+		}
+		entry.Devices = append(entry.Devices, jd)
+	}
+
+	// sort devices
+	sort.Slice(entry.Devices, func(a, b int) bool {
+		return entry.Devices[a].Name < entry.Devices[b].Name
+	})
+
+	return entry
+}
+
+// setOutcomes will set the outcome of the devices according to the result.
+func setOutcomes(entry *JournalEntry, result *Result) {
+	// prepare table
+	answering := make(map[string]bool)
+	for _, d := range result.Answering {
+		answering[d.Name] = true
+	}
+
+	// set outcomes
+	for _, d := range entry.Devices {
+		if answering[d.Name] {
+			d.Outcome = Succeeded
+		} else {
+			d.Outcome = Missed
+		}
+	}
+}
+
+// A JournalError is returned if the journal entry of an operation could not be
+// written. The error of the operation itself, if any, is available as Err and
+// takes precedence in the message.
+type JournalError struct {
+	Err     error
+	Journal error
+}
+
+// Error implements the error interface.
+func (e *JournalError) Error() string {
+	// check operation error
+	if e.Err != nil {
+		return fmt.Sprintf("%s (failed to write journal: %s)", e.Err, e.Journal)
+	}
+
+	return fmt.Sprintf("failed to write journal: %s", e.Journal)
+}
+
+// Unwrap returns the operation error.
+func (e *JournalError) Unwrap() error {
+	return e.Err
+}
+
+// OperationFailed returns whether the error indicates a failed operation rather
+// than only a failure to write the journal.
+func OperationFailed(err error) bool {
+	je, ok := err.(*JournalError)
+	return err != nil && (!ok || je.Err != nil)
+}
+
+// journal will complete the entry and append it to the journal file. If the
+// operation failed, devices without an outcome are marked as failed. It returns
+// the operation error or a JournalError if the entry could not be written.
+func (i *Inventory) journal(entry *JournalEntry, opErr error) error {
+	// set error
+	if opErr != nil {
+		entry.Error = opErr.Error()
+		for _, d := range entry.Devices {
+			if d.Outcome == "" {
+				d.Outcome = Failed
+			}
+		}
+	}
+
+	// skip if inventory has not been read from or saved to disk
+	if i.dir == "" {
+		return opErr
+	}
+
+	// write entry
+	err := i.writeEntry(entry)
+	if err != nil {
+		return &JournalError{Err: opErr, Journal: err}
+	}
+
+	return opErr
+}
+
+func (i *Inventory) writeEntry(entry *JournalEntry) error {
+	// set metadata
+	entry.Time = time.Now()
+	entry.User = currentUser()
+	entry.Command = strings.Join(append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...), " ")
+
+	// encode entry
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// open file
+	file, err := os.OpenFile(filepath.Join(i.dir, JournalFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	// write entry
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	// close file
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReadJournal will read the journal file at the specified path and return the
+// entries that involve a device matching the supplied glob pattern. Only the
+// matching devices are retained in the returned entries. A missing file yields
+// no entries.
+func ReadJournal(path, pattern string) ([]*JournalEntry, error) {
+	// open file
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// ensure file is closed
+	defer file.Close()
+
+	// prepare list
+	var list []*JournalEntry
+
+	// prepare scanner
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	// read entries
+	for scanner.Scan() {
+		// skip empty lines
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		// decode entry
+		var entry JournalEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// filter devices
+		var devices []*JournalDevice
+		for _, d := range entry.Devices {
+			if glob.Glob(pattern, d.Name) {
+				devices = append(devices, d)
+			}
+		}
+
+		// add entry if any device matches
+		if len(devices) > 0 {
+			entry.Devices = devices
+			list = append(list, &entry)
+		}
+	}
+
+	// check error
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func currentUser() string {
+	// get current user
+	u, err := user.Current()
+	if err == nil && u.Username != "" {
+		return u.Username
+	}
+
+	// fallback to environment
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+
+	return os.Getenv("USERNAME")
+}
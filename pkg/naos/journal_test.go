@@ -0,0 +1,69 @@
+package naos
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	inv := NewInventory()
+	assert.NoError(t, inv.Save(filepath.Join(dir, "naos.json")))
+
+	devices := []*Device{
+		{Name: "foo", Parameters: map[string]string{"a": "1"}},
+		{Name: "bar", Parameters: map[string]string{"a": "2"}},
+	}
+
+	entry := newEntry("set", devices, func(d *Device) string {
+		return d.Parameters["a"]
+	})
+	entry.Param = "a"
+	setOutcomes(entry, &Result{Answering: devices[:1]})
+	assert.NoError(t, inv.journal(entry, nil))
+
+	entry = newEntry("update", devices[:1], nil)
+	entry.device("foo").Outcome = Succeeded
+	assert.Error(t, inv.journal(entry, errors.New("failed")))
+
+	entries, err := ReadJournal(filepath.Join(dir, JournalFile), "*")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "set", entries[0].Action)
+	assert.Equal(t, "bar", entries[0].Devices[0].Name)
+	assert.Equal(t, "2", entries[0].Devices[0].Before)
+	assert.Equal(t, Missed, entries[0].Devices[0].Outcome)
+	assert.Equal(t, Succeeded, entries[0].Devices[1].Outcome)
+	assert.Equal(t, "failed", entries[1].Error)
+	assert.Equal(t, Succeeded, entries[1].Devices[0].Outcome)
+
+	entries, err = ReadJournal(filepath.Join(dir, JournalFile), "b*")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Len(t, entries[0].Devices, 1)
+
+	entries, err = ReadJournal(filepath.Join(dir, "missing.jsonl"), "*")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestJournalError(t *testing.T) {
+	inv := NewInventory()
+	inv.dir = filepath.Join(t.TempDir(), "missing")
+
+	err := inv.journal(newEntry("request", nil, nil), nil)
+	assert.Error(t, err)
+	assert.False(t, OperationFailed(err))
+
+	err = inv.journal(newEntry("request", nil, nil), errors.New("failed"))
+	assert.Error(t, err)
+	assert.True(t, OperationFailed(err))
+	assert.Regexp(t, `^failed \(failed to write journal: `, err.Error())
+
+	assert.False(t, OperationFailed(nil))
+	assert.True(t, OperationFailed(errors.New("failed")))
+}
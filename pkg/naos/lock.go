@@ -0,0 +1,126 @@
+package naos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/256dpi/naos/pkg/utils"
+)
+
+// LockFile is the name of the file next to the inventory file that records the
+// resolved versions of an installation. It should be committed to reproduce
+// installations.
+const LockFile = "naos.lock"
+
+// A LockedRepository records the resolved commit of a repository and the
+// commits of its submodules by path.
+type LockedRepository struct {
+	Repository string            `json:"repository,omitempty"`
+	Version    string            `json:"version"`
+	Commit     string            `json:"commit"`
+	Submodules map[string]string `json:"submodules,omitempty"`
+}
+
+// A LockedToolchain records the installed toolchain and the checksum of its
+// archive.
+type LockedToolchain struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// A Lock represents the contents of the lock file.
+type Lock struct {
+	Tree       *LockedRepository            `json:"tree"`
+	Components map[string]*LockedRepository `json:"components,omitempty"`
+	Toolchain  *LockedToolchain             `json:"toolchain,omitempty"`
+}
+
+// ReadLock will attempt to read the lock file at the specified path. A missing
+// file yields an empty lock.
+func ReadLock(path string) (*Lock, error) {
+	// read file
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Lock{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// decode lock
+	var lock Lock
+	err = json.Unmarshal(data, &lock)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lock, nil
+}
+
+// Save will write the lock to the specified path.
+func (l *Lock) Save(path string) error {
+	// encode lock
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write file
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// resolve will return the locked commit if the repository and version still
+// match and the version otherwise.
+func (r *LockedRepository) resolve(repository, version string) string {
+	// check lock
+	if r == nil || r.Commit == "" || r.Repository != repository || r.Version != version {
+		return version
+	}
+
+	return r.Commit
+}
+
+// check will return an error if a submodule has been checked out at another
+// commit than recorded.
+func (r *LockedRepository) check(name string, actual *LockedRepository) error {
+	// sort paths
+	paths := make([]string, 0, len(r.Submodules))
+	for path := range r.Submodules {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// compare commits
+	for _, path := range paths {
+		commit, ok := actual.Submodules[path]
+		if ok && commit != r.Submodules[path] {
+			return fmt.Errorf("submodule '%s' of %s is at %s but locked at %s", path, name, commit, r.Submodules[path])
+		}
+	}
+
+	return nil
+}
+
+func lockRepository(path, repository, version string) (*LockedRepository, error) {
+	// get commit
+	commit, err := utils.Head(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// get submodules
+	submodules, err := utils.Submodules(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LockedRepository{
+		Repository: repository,
+		Version:    version,
+		Commit:     commit,
+		Submodules: submodules,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package naos
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LockFile)
+
+	lock, err := ReadLock(path)
+	assert.NoError(t, err)
+	assert.Equal(t, &Lock{}, lock)
+
+	lock = &Lock{
+		Tree: &LockedRepository{
+			Version: "master",
+			Commit:  "1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b",
+			Submodules: map[string]string{
+				"esp-idf": "2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c",
+			},
+		},
+		Components: map[string]*LockedRepository{
+			"foo": {
+				Repository: "https://github.com/foo/foo.git",
+				Version:    "v1.0.0",
+				Commit:     "3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d",
+			},
+		},
+		Toolchain: &LockedToolchain{
+			Name:     "xtensa-esp32-elf",
+			Version:  "esp-2021r2-8.4.0",
+			Checksum: "55725bdd1e2a9d7e8f50de3d75e0e8a5ff9cb5fd0cd1b1dc5e8ae4ac0ea6b2d9",
+		},
+	}
+
+	err = lock.Save(path)
+	assert.NoError(t, err)
+
+	read, err := ReadLock(path)
+	assert.NoError(t, err)
+	assert.Equal(t, lock, read)
+}
+
+func TestLockedRepositoryResolve(t *testing.T) {
+	var missing *LockedRepository
+	assert.Equal(t, "master", missing.resolve("", "master"))
+
+	repo := &LockedRepository{
+		Repository: "https://github.com/foo/foo.git",
+		Version:    "master",
+		Commit:     "1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b",
+	}
+	assert.Equal(t, repo.Commit, repo.resolve("https://github.com/foo/foo.git", "master"))
+	assert.Equal(t, "develop", repo.resolve("https://github.com/foo/foo.git", "develop"))
+	assert.Equal(t, "master", repo.resolve("https://github.com/bar/foo.git", "master"))
+}
+
+func TestLockedRepositoryCheck(t *testing.T) {
+	locked := &LockedRepository{
+		Submodules: map[string]string{
+			"esp-idf": "1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b",
+		},
+	}
+
+	err := locked.check("NAOS", &LockedRepository{
+		Submodules: map[string]string{
+			"esp-idf": "1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b",
+		},
+	})
+	assert.NoError(t, err)
+
+	err = locked.check("NAOS", &LockedRepository{
+		Submodules: map[string]string{
+			"esp-idf": "2b3c4d5e6f1a2b3c4d5e6f1a2b3c4d5e6f1a2b3c",
+		},
+	})
+	assert.Error(t, err)
+}
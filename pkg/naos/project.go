@@ -1,11 +1,14 @@
 package naos
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/256dpi/naos/pkg/fleet"
@@ -18,6 +21,7 @@ import (
 type Project struct {
 	Location  string
 	Inventory *Inventory
+	Queue     *Queue
 }
 
 // CreateProject will initialize a project in the specified directory. If out is
@@ -31,7 +35,7 @@ func CreateProject(path string, force, cmake bool, out io.Writer) (*Project, err
 	}
 
 	// create project
-	p := &Project{Location: path}
+	p := &Project{Location: path, Queue: &Queue{}}
 
 	// check if inventory already exists
 	ok, err := utils.Exists(filepath.Join(path, "naos.json"))
@@ -54,6 +58,13 @@ func CreateProject(path string, force, cmake bool, out io.Writer) (*Project, err
 		utils.Log(out, "Inventory already exists.")
 	}
 
+	// ensure credentials file is ignored
+	utils.Log(out, "Ensuring gitignore file.")
+	err = ensureGitIgnore(filepath.Join(path, ".gitignore"), "/naos/", "/"+CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
 	// ensure source directory
 	utils.Log(out, "Ensuring source directory.")
 	err = os.MkdirAll(filepath.Join(path, "src"), 0755)
@@ -103,10 +114,17 @@ func OpenProject(path string) (*Project, error) {
 		return nil, err
 	}
 
+	// attempt to read queue
+	queue, err := ReadQueue(filepath.Join(path, QueueFile))
+	if err != nil {
+		return nil, err
+	}
+
 	// prepare project
 	project := &Project{
 		Location:  path,
 		Inventory: inv,
+		Queue:     queue,
 	}
 
 	return project, nil
@@ -123,6 +141,149 @@ func (p *Project) SaveInventory() error {
 	return nil
 }
 
+// SaveQueue will save the associated queue to disk. Images that are no longer
+// referenced by queued updates are removed.
+func (p *Project) SaveQueue() error {
+	// save queue
+	err := p.Queue.Save(filepath.Join(p.Location, QueueFile))
+	if err != nil {
+		return err
+	}
+
+	// collect referenced images
+	images := map[string]bool{}
+	for _, op := range p.Queue.Operations {
+		if op.Image != "" {
+			images[op.Image] = true
+		}
+	}
+
+	// list images
+	dir := filepath.Join(p.Location, ImageDirectory)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// remove unreferenced images
+	for _, file := range files {
+		if !images[file.Name()] {
+			err = os.Remove(filepath.Join(dir, file.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// remove empty directory
+	if len(images) == 0 {
+		err = os.Remove(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SnapshotImage will store a copy of the current application binary in the
+// image directory and return its name and SHA-256 checksum to be used with
+// queued updates.
+func (p *Project) SnapshotImage() (string, string, error) {
+	// get binary
+	bytes, err := tree.AppBinary(p.Tree())
+	if err != nil {
+		return "", "", err
+	}
+
+	// get checksum
+	sum := sha256.Sum256(bytes)
+	checksum := hex.EncodeToString(sum[:])
+	name := checksum + ".bin"
+
+	// ensure directory
+	dir := filepath.Join(p.Location, ImageDirectory)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", "", err
+	}
+
+	// write image
+	err = ioutil.WriteFile(filepath.Join(dir, name), bytes, 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	return name, checksum, nil
+}
+
+func (p *Project) loadImage(op *Operation) ([]byte, error) {
+	// check image
+	if op.Image == "" || op.Checksum == "" {
+		return nil, fmt.Errorf("queued update to '%s' has no image snapshot", op.Version)
+	}
+
+	// read image
+	bytes, err := ioutil.ReadFile(filepath.Join(p.Location, ImageDirectory, filepath.Base(op.Image)))
+	if err != nil {
+		return nil, err
+	}
+
+	// verify checksum
+	sum := sha256.Sum256(bytes)
+	if hex.EncodeToString(sum[:]) != op.Checksum {
+		return nil, fmt.Errorf("image of queued update to '%s' does not match its checksum", op.Version)
+	}
+
+	return bytes, nil
+}
+
+// QueueUpdate will queue the update to the specified version and image snapshot
+// for all devices that have not been updated successfully according to the
+// provided statuses and save the queue. It returns the number of queued devices.
+func (p *Project) QueueUpdate(version, image, checksum string, devices []*Device, statuses map[*Device]*fleet.UpdateStatus) (int, error) {
+	// add operations
+	var queued int
+	for _, device := range devices {
+		// skip updated devices
+		status := statuses[device]
+		if status != nil && status.Error == nil && status.Progress >= 1 {
+			continue
+		}
+
+		// add operation
+		p.Queue.Add(&Operation{
+			Device:   device.Name,
+			Action:   UpdateAction,
+			Version:  version,
+			Image:    image,
+			Checksum: checksum,
+		})
+		queued++
+	}
+
+	// save queue
+	err := p.SaveQueue()
+	if err != nil {
+		return 0, err
+	}
+
+	return queued, nil
+}
+
+// History will return the journal entries that involve devices matching the
+// supplied glob pattern.
+func (p *Project) History(pattern string) ([]*JournalEntry, error) {
+	return ReadJournal(filepath.Join(p.Location, JournalFile), pattern)
+}
+
+// Ports returns the serial ports with attached boards.
+func (p *Project) Ports() ([]utils.Port, error) {
+	return utils.FindPorts()
+}
+
 // Tree returns the internal directory used to store the toolchain, development
 // framework and other necessary files.
 func (p *Project) Tree() string {
@@ -130,18 +291,61 @@ func (p *Project) Tree() string {
 }
 
 // Install will download necessary dependencies. Any existing dependencies will be
-// removed if force is set to true. If out is not nil, it will be used to log
-// information about the process.
-func (p *Project) Install(force bool, out io.Writer) error {
+// removed if force is set to true. The versions recorded in the lock file are
+// installed unless update is set to true or the inventory requests other
+// versions. The resolved versions are written back to the lock file. Toolchains
+// that cannot be verified are only installed if insecure is set to true. If out
+// is not nil, it will be used to log information about the process.
+func (p *Project) Install(force, update, insecure bool, out io.Writer) error {
+	// read lock file unless updating
+	lock := &Lock{}
+	if !update {
+		var err error
+		lock, err = ReadLock(filepath.Join(p.Location, LockFile))
+		if err != nil {
+			return err
+		}
+	}
+
 	// install tree
-	err := tree.Install(p.Tree(), filepath.Join(p.Location, "src"), p.Location, p.Inventory.Version, p.Inventory.Overrides, force, out)
+	version := lock.Tree.resolve("", p.Inventory.Version)
+	err := tree.Install(p.Tree(), filepath.Join(p.Location, "src"), p.Location, version, p.Inventory.Overrides, force, out)
+	if err != nil {
+		return err
+	}
+
+	// get required toolchain
+	toolchainVersion, err := tree.RequiredToolchain(p.Tree())
 	if err != nil {
 		return err
 	}
 
+	// get toolchain name
+	toolchainName := tree.Toolchain
+
+	// get locked checksum
+	var checksum string
+	if lock.Toolchain != nil && lock.Toolchain.Name == toolchainName && lock.Toolchain.Version == toolchainVersion {
+		checksum = lock.Toolchain.Checksum
+	}
+
+	// install toolchain
+	actual, err := tree.InstallToolchain(p.Tree(), toolchainVersion, checksum, force, insecure, out)
+	if err != nil {
+		return err
+	}
+
+	// check installed toolchain
+	if checksum != "" && actual != "" && !strings.EqualFold(checksum, actual) {
+		return fmt.Errorf("toolchain '%s' does not match the locked checksum (run with --force)", toolchainName)
+	} else if actual != "" {
+		checksum = actual
+	}
+
 	// install components
 	for name, com := range p.Inventory.Components {
-		err = tree.InstallComponent(p.Tree(), name, com.Repository, com.Version, force, out)
+		version := lock.Components[name].resolve(com.Repository, com.Version)
+		err = tree.InstallComponent(p.Tree(), name, com.Repository, version, force, out)
 		if err != nil {
 			return err
 		}
@@ -153,6 +357,59 @@ func (p *Project) Install(force bool, out io.Writer) error {
 		return err
 	}
 
+	// prepare new lock
+	newLock := &Lock{
+		Toolchain: &LockedToolchain{
+			Name:     toolchainName,
+			Version:  toolchainVersion,
+			Checksum: checksum,
+		},
+	}
+
+	// lock tree
+	newLock.Tree, err = lockRepository(p.Tree(), "", p.Inventory.Version)
+	if err != nil {
+		return err
+	}
+
+	// check tree submodules
+	if version != p.Inventory.Version {
+		err = lock.Tree.check("NAOS", newLock.Tree)
+		if err != nil {
+			return err
+		}
+	}
+
+	// lock components
+	for name, com := range p.Inventory.Components {
+		// lock component
+		locked, err := lockRepository(tree.ComponentDirectory(p.Tree(), name), com.Repository, com.Version)
+		if err != nil {
+			return err
+		}
+
+		// check component submodules
+		if lock.Components[name].resolve(com.Repository, com.Version) != com.Version {
+			err = lock.Components[name].check(fmt.Sprintf("component '%s'", name), locked)
+			if err != nil {
+				return err
+			}
+		}
+
+		// add component
+		if newLock.Components == nil {
+			newLock.Components = map[string]*LockedRepository{}
+		}
+		newLock.Components[name] = locked
+	}
+
+	// write lock file
+	utils.Log(out, "Writing lock file.")
+	err = newLock.Save(filepath.Join(p.Location, LockFile))
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -161,28 +418,42 @@ func (p *Project) Build(clean, appOnly bool, out io.Writer) error {
 	return tree.Build(p.Tree(), p.Inventory.Embeds, clean, appOnly, out)
 }
 
-// Flash will flash the project to the attached device.
-func (p *Project) Flash(device string, erase bool, appOnly bool, out io.Writer) error {
-	// set missing device
-	if device == "" {
-		device = utils.FindPort(out)
+// Flash will flash the project to the attached device. Non-zero values in the
+// overrides for all or the chosen port take precedence over the flash config of
+// the inventory.
+func (p *Project) Flash(device string, erase bool, appOnly bool, overrides FlashOverrides, out io.Writer) error {
+	// choose missing device
+	device, err := p.port(device, out)
+	if err != nil {
+		return err
 	}
 
-	return tree.Flash(p.Tree(), device, erase, appOnly, out)
+	return tree.Flash(p.Tree(), device, tree.FlashOptions{
+		Settings: p.flashSettings(device, overrides),
+		Erase:    erase,
+		AppOnly:  appOnly,
+	}, out)
 }
 
-// Attach will attach to the attached device.
-func (p *Project) Attach(device string, simple bool, out io.Writer, in io.Reader) error {
-	// set missing device
-	if device == "" {
-		device = utils.FindPort(out)
+// Attach will attach to the attached device. The session is appended to the log
+// file if specified.
+func (p *Project) Attach(device string, simple, timestamps bool, logFile string, out io.Writer, in io.Reader) error {
+	// choose missing device
+	device, err := p.port(device, out)
+	if err != nil {
+		return err
 	}
 
-	return tree.Attach(p.Tree(), device, simple, out, in)
+	return tree.Attach(p.Tree(), device, tree.AttachOptions{
+		Simple:     simple,
+		Timestamps: timestamps,
+		LogFile:    logFile,
+	}, out, in)
 }
 
-// Config will write settings and parameters to an attached device.
-func (p *Project) Config(file, device string, out io.Writer) error {
+// Config will write settings and parameters to an attached device. If an output
+// path is specified, only the partition image is written to it.
+func (p *Project) Config(file, device, output string, out io.Writer) error {
 	// load file
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -196,12 +467,34 @@ func (p *Project) Config(file, device string, out io.Writer) error {
 		return err
 	}
 
-	// set missing device
-	if device == "" {
-		device = utils.FindPort(out)
+	// write image only if requested
+	if output != "" {
+		image, err := tree.ConfigImage(values)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(output, image, 0644)
+	}
+
+	// choose missing device
+	device, err = p.port(device, out)
+	if err != nil {
+		return err
 	}
 
-	return tree.Config(p.Tree(), values, device, out)
+	return tree.Config(values, device, p.flashSettings(device, nil), out)
+}
+
+// ReadConfig will read the settings and parameters from an attached device.
+func (p *Project) ReadConfig(device string, out io.Writer) (map[string]string, error) {
+	// choose missing device
+	device, err := p.port(device, out)
+	if err != nil {
+		return nil, err
+	}
+
+	return tree.ReadConfig(device, p.flashSettings(device, nil), out)
 }
 
 // Format will format all source files in the project if 'clang-format' is
@@ -268,3 +561,66 @@ func (p *Project) Update(version, pattern string, jobs int, timeout time.Duratio
 
 	return nil
 }
+
+func (p *Project) port(device string, out io.Writer) (string, error) {
+	// check device
+	if device != "" {
+		return device, nil
+	}
+
+	return utils.ChoosePort(out, os.Stdin)
+}
+
+func (p *Project) flashSettings(port string, overrides FlashOverrides) tree.FlashSettings {
+	// get config
+	var config FlashConfig
+	if p.Inventory.Flash != nil {
+		config = *p.Inventory.Flash
+	}
+
+	// apply overrides for all ports and then the port
+	config = config.merge(overrides[""])
+	if port != "" {
+		config = config.merge(overrides[port])
+	}
+
+	return tree.FlashSettings{
+		BaudRate:  config.BaudRate,
+		Mode:      config.Mode,
+		Frequency: config.Frequency,
+		Before:    config.Before,
+		After:     config.After,
+	}
+}
+
+func ensureGitIgnore(path string, entries ...string) error {
+	// read file
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// get lines
+	lines := strings.Split(string(data), "\n")
+
+	// add missing entries
+	for _, entry := range entries {
+		found := false
+		for _, line := range lines {
+			if strings.TrimSpace(line) == entry {
+				found = true
+			}
+		}
+
+		if !found {
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				data = append(data, '\n')
+			}
+
+			data = append(data, []byte(entry+"\n")...)
+		}
+	}
+
+	// write file
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,255 @@
+package naos
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/256dpi/naos/pkg/tree"
+	"github.com/256dpi/naos/pkg/utils"
+)
+
+// A Board describes an attached board while it is provisioned. Its fields are
+// available in the templates of the configuration file.
+type Board struct {
+	// The one-based index of the board.
+	Index int
+
+	// The serial port of the board.
+	Port string
+
+	// The factory MAC address, available once connected.
+	MAC string
+}
+
+// A BoardStatus describes the state of a board that is provisioned.
+type BoardStatus struct {
+	Board
+
+	// The current step and its progress.
+	Step     string
+	Progress float64
+
+	// The device that is recorded in the inventory if configured.
+	Device *Device
+
+	// The error if provisioning failed.
+	Error error
+}
+
+// Provision will flash all attached boards in parallel. If a configuration file
+// is specified, its values are rendered as templates per board and written as
+// settings and parameters. Boards that are configured with a device name are
+// recorded in the inventory. Non-zero values in the overrides for all or the
+// board's port take precedence over the flash config of the inventory. The
+// callback is called with every change of a board status.
+func (p *Project) Provision(file string, erase, appOnly bool, overrides FlashOverrides, callback func(*BoardStatus)) error {
+	// find ports
+	ports, err := utils.FindPorts()
+	if err != nil {
+		return err
+	} else if len(ports) == 0 {
+		return utils.ErrNoPort
+	}
+
+	// load templates if requested
+	var templates map[string]*template.Template
+	if file != "" {
+		templates, err = loadTemplates(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// prepare statuses
+	statuses := make([]*BoardStatus, 0, len(ports))
+	for i, port := range ports {
+		statuses = append(statuses, &BoardStatus{
+			Board: Board{Index: i + 1, Port: port.Name},
+		})
+	}
+
+	// prepare mutex and wait group
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	// provision boards
+	for _, status := range statuses {
+		wg.Add(1)
+		go func(status *BoardStatus) {
+			defer wg.Done()
+
+			// prepare update function
+			update := func(fn func()) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				fn()
+				callback(status)
+			}
+
+			// prepare options
+			opts := tree.FlashOptions{
+				Settings: p.flashSettings(status.Port, overrides),
+				Erase:    erase,
+				AppOnly:  appOnly,
+				Progress: func(step string, progress float64) {
+					update(func() {
+						status.Step = step
+						status.Progress = progress
+					})
+				},
+			}
+
+			// render config per board if requested
+			if templates != nil {
+				opts.Config = func(mac string) (map[string]string, error) {
+					// set mac
+					update(func() {
+						status.MAC = mac
+					})
+
+					// render values
+					values, err := renderTemplates(templates, status.Board)
+					if err != nil {
+						return nil, err
+					}
+
+					// prepare device
+					update(func() {
+						status.Device = deviceFromValues(values)
+					})
+
+					return values, nil
+				}
+			}
+
+			// flash board
+			err := tree.Flash(p.Tree(), status.Port, opts, nil)
+			if err != nil {
+				update(func() {
+					status.Error = err
+				})
+			}
+		}(status)
+	}
+
+	// wait for completion
+	wg.Wait()
+
+	// collect devices
+	var devices []*Device
+	var failed int
+	for _, status := range statuses {
+		if status.Error != nil {
+			failed++
+		} else if status.Device != nil {
+			devices = append(devices, status.Device)
+		}
+	}
+
+	// record devices
+	if len(devices) > 0 {
+		// prepare entry
+		entry := newEntry("provision", devices, nil)
+		for _, d := range devices {
+			jd := entry.device(d.Name)
+			jd.After = d.BaseTopic
+			jd.Outcome = Succeeded
+		}
+
+		// add devices
+		for _, d := range devices {
+			if existing, ok := p.Inventory.Devices[d.Name]; ok {
+				existing.BaseTopic = d.BaseTopic
+				for key, value := range d.Parameters {
+					existing.Parameters[key] = value
+				}
+			} else {
+				p.Inventory.Devices[d.Name] = d
+			}
+		}
+
+		// journal operation
+		err := p.Inventory.journal(entry, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check failures
+	if failed > 0 {
+		return fmt.Errorf("%d board(s) failed", failed)
+	}
+
+	return nil
+}
+
+func loadTemplates(file string) (map[string]*template.Template, error) {
+	// load file
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// unmarshal values
+	var values map[string]string
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse templates
+	templates := make(map[string]*template.Template)
+	for key, value := range values {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		templates[key] = tmpl
+	}
+
+	return templates, nil
+}
+
+func renderTemplates(templates map[string]*template.Template, board Board) (map[string]string, error) {
+	// render templates
+	values := make(map[string]string)
+	for key, tmpl := range templates {
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, board)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = buf.String()
+	}
+
+	return values, nil
+}
+
+func deviceFromValues(values map[string]string) *Device {
+	// check name
+	name := values["device-name"]
+	if name == "" {
+		return nil
+	}
+
+	// prepare device
+	device := &Device{
+		Name:       name,
+		BaseTopic:  values["base-topic"],
+		Parameters: make(map[string]string),
+	}
+
+	// add parameters
+	for key, value := range values {
+		if !tree.IsSetting(key) {
+			device.Parameters[key] = value
+		}
+	}
+
+	return device
+}
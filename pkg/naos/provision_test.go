@@ -0,0 +1,42 @@
+package naos
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisionTemplates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`
+device-name: "box-{{ .MAC }}"
+base-topic: "/boxes/{{ .Index }}"
+wifi-ssid: factory
+owner: line-{{ .Port }}
+`), 0644))
+
+	templates, err := loadTemplates(file)
+	assert.NoError(t, err)
+
+	values, err := renderTemplates(templates, Board{Index: 2, Port: "usb1", MAC: "a4cf12345678"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"device-name": "box-a4cf12345678",
+		"base-topic":  "/boxes/2",
+		"wifi-ssid":   "factory",
+		"owner":       "line-usb1",
+	}, values)
+
+	device := deviceFromValues(values)
+	assert.Equal(t, &Device{
+		Name:      "box-a4cf12345678",
+		BaseTopic: "/boxes/2",
+		Parameters: map[string]string{
+			"owner": "line-usb1",
+		},
+	}, device)
+
+	assert.Nil(t, deviceFromValues(map[string]string{"owner": "me"}))
+}
@@ -0,0 +1,166 @@
+package naos
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+)
+
+// QueueFile is the name of the file in the project that stores the queue.
+const QueueFile = "naos.queue.json"
+
+// ImageDirectory is the name of the directory in the project that stores the
+// firmware images of queued updates.
+const ImageDirectory = "naos.images"
+
+// The available operation actions.
+const (
+	SetAction    = "set"
+	UnsetAction  = "unset"
+	UpdateAction = "update"
+)
+
+// An Operation is a pending change for a device that has not yet been
+// delivered. Updates reference a snapshot of the firmware image in the image
+// directory and its SHA-256 checksum.
+type Operation struct {
+	Device   string    `json:"device"`
+	Action   string    `json:"action"`
+	Param    string    `json:"param,omitempty"`
+	Value    string    `json:"value,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Image    string    `json:"image,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// A Queue represents the contents of the queue file.
+type Queue struct {
+	Operations []*Operation `json:"operations"`
+}
+
+// ReadQueue will attempt to read the queue file at the specified path. An empty
+// queue is returned if the file does not exist.
+func ReadQueue(path string) (*Queue, error) {
+	// prepare queue
+	var queue Queue
+
+	// read file
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &queue, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// decode data
+	err = json.Unmarshal(data, &queue)
+	if err != nil {
+		return nil, err
+	}
+
+	return &queue, nil
+}
+
+// Save will write the queue file to the specified path. The file is removed if
+// the queue is empty.
+func (q *Queue) Save(path string) error {
+	// remove file if empty
+	if len(q.Operations) == 0 {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	// encode data
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write file
+	err = ioutil.WriteFile(path, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Add will add the provided operation to the queue. A previously queued
+// operation for the same device and parameter or update is replaced.
+func (q *Queue) Add(op *Operation) {
+	// set time
+	if op.QueuedAt.IsZero() {
+		op.QueuedAt = time.Now()
+	}
+
+	// remove superseded operations
+	for _, existing := range q.Operations {
+		if existing.Device != op.Device {
+			continue
+		}
+
+		if existing.Action == UpdateAction && op.Action == UpdateAction {
+			q.Remove(existing)
+		} else if existing.Action != UpdateAction && op.Action != UpdateAction && existing.Param == op.Param {
+			q.Remove(existing)
+		}
+	}
+
+	// add operation
+	q.Operations = append(q.Operations, op)
+}
+
+// Remove will remove the provided operation from the queue.
+func (q *Queue) Remove(op *Operation) {
+	// prepare list
+	list := make([]*Operation, 0, len(q.Operations))
+
+	// keep other operations
+	for _, existing := range q.Operations {
+		if existing != op {
+			list = append(list, existing)
+		}
+	}
+
+	// set list
+	q.Operations = list
+}
+
+// Pending returns the queued operations for the named device in order.
+func (q *Queue) Pending(device string) []*Operation {
+	// prepare list
+	var list []*Operation
+
+	// add matching operations
+	for _, op := range q.Operations {
+		if op.Device == device {
+			list = append(list, op)
+		}
+	}
+
+	return list
+}
+
+// Filter returns the queued operations for all devices that have a name
+// matching the supplied glob pattern.
+func (q *Queue) Filter(pattern string) []*Operation {
+	// prepare list
+	var list []*Operation
+
+	// add matching operations
+	for _, op := range q.Operations {
+		if glob.Glob(pattern, op.Device) {
+			list = append(list, op)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,110 @@
+package naos
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/naos/pkg/fleet"
+	"github.com/256dpi/naos/pkg/tree"
+)
+
+func TestQueueAdd(t *testing.T) {
+	q := &Queue{}
+	q.Add(&Operation{Device: "foo", Action: SetAction, Param: "a", Value: "1"})
+	q.Add(&Operation{Device: "foo", Action: UpdateAction, Version: "1.0.0"})
+	q.Add(&Operation{Device: "bar", Action: SetAction, Param: "a", Value: "1"})
+	q.Add(&Operation{Device: "foo", Action: UnsetAction, Param: "a"})
+	q.Add(&Operation{Device: "foo", Action: UpdateAction, Version: "1.1.0"})
+
+	ops := q.Pending("foo")
+	assert.Len(t, ops, 2)
+	assert.Equal(t, UnsetAction, ops[0].Action)
+	assert.Equal(t, "1.1.0", ops[1].Version)
+	assert.Len(t, q.Filter("*"), 3)
+	assert.Len(t, q.Filter("b*"), 1)
+}
+
+func TestQueueSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), QueueFile)
+
+	q, err := ReadQueue(path)
+	assert.NoError(t, err)
+	assert.Empty(t, q.Operations)
+
+	q.Add(&Operation{Device: "foo", Action: SetAction, Param: "a", Value: "1"})
+	assert.NoError(t, q.Save(path))
+
+	q, err = ReadQueue(path)
+	assert.NoError(t, err)
+	assert.Len(t, q.Operations, 1)
+
+	q.Remove(q.Operations[0])
+	assert.NoError(t, q.Save(path))
+	assert.NoFileExists(t, path)
+}
+
+func TestQueueImage(t *testing.T) {
+	p := &Project{Location: t.TempDir(), Queue: &Queue{}}
+
+	bin := filepath.Join(tree.Directory(p.Tree()), "build", "naos-project.bin")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	assert.NoError(t, ioutil.WriteFile(bin, []byte("foo"), 0644))
+
+	image, checksum, err := p.SnapshotImage()
+	assert.NoError(t, err)
+
+	op := &Operation{Device: "foo", Action: UpdateAction, Version: "1.0.0", Image: image, Checksum: checksum}
+	p.Queue.Add(op)
+	assert.NoError(t, p.SaveQueue())
+
+	assert.NoError(t, ioutil.WriteFile(bin, []byte("bar"), 0644))
+
+	data, err := p.loadImage(op)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("foo"), data)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(p.Location, ImageDirectory, image), []byte("bar"), 0644))
+
+	_, err = p.loadImage(op)
+	assert.Error(t, err)
+
+	p.Queue.Remove(op)
+	assert.NoError(t, p.SaveQueue())
+	assert.NoDirExists(t, filepath.Join(p.Location, ImageDirectory))
+}
+
+func TestQueueUpdate(t *testing.T) {
+	p := &Project{Location: t.TempDir(), Queue: &Queue{}}
+
+	bin := filepath.Join(tree.Directory(p.Tree()), "build", "naos-project.bin")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(bin), 0755))
+	assert.NoError(t, ioutil.WriteFile(bin, []byte("foo"), 0644))
+
+	image, checksum, err := p.SnapshotImage()
+	assert.NoError(t, err)
+
+	foo := &Device{Name: "foo"}
+	bar := &Device{Name: "bar"}
+	baz := &Device{Name: "baz"}
+
+	queued, err := p.QueueUpdate("1.0.0", image, checksum, []*Device{foo, bar, baz}, map[*Device]*fleet.UpdateStatus{
+		foo: {Progress: 1},
+		bar: {Progress: 0.5, Error: errors.New("failed")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queued)
+	assert.Empty(t, p.Queue.Pending("foo"))
+	assert.Len(t, p.Queue.Pending("bar"), 1)
+	assert.Len(t, p.Queue.Pending("baz"), 1)
+
+	q, err := ReadQueue(filepath.Join(p.Location, QueueFile))
+	assert.NoError(t, err)
+	assert.Len(t, q.Operations, 2)
+	assert.Equal(t, checksum, q.Operations[0].Checksum)
+	assert.FileExists(t, filepath.Join(p.Location, ImageDirectory, image))
+}
@@ -0,0 +1,174 @@
+package nvs
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// The page states that may hold valid entries.
+var readableStates = map[uint32]bool{
+	pageActive:  true,
+	pageFull:    true,
+	pageFreeing: true,
+}
+
+type rawEntry struct {
+	ns    byte
+	key   string
+	value interface{}
+}
+
+type blobKey struct {
+	ns    byte
+	key   string
+	chunk byte
+}
+
+// Decode will decode a partition image. Unused pages and entries that are
+// erased, fail the checksum or belong to an unknown namespace are skipped. If a key has been written multiple
+// times, the most recent value is returned.
+func Decode(image []byte) (*Partition, error) {
+	// check size
+	if len(image) == 0 || len(image)%PageSize != 0 {
+		return nil, errors.New("size must be a multiple of the page size")
+	}
+
+	// collect readable pages
+	var pages [][]byte
+	for off := 0; off < len(image); off += PageSize {
+		page := image[off : off+PageSize]
+		state := binary.LittleEndian.Uint32(page[0:])
+		if readableStates[state] && checksum(page[4:28]) == binary.LittleEndian.Uint32(page[28:]) {
+			pages = append(pages, page)
+		}
+	}
+
+	// order pages by sequence number
+	sort.SliceStable(pages, func(i, j int) bool {
+		return binary.LittleEndian.Uint32(pages[i][4:]) < binary.LittleEndian.Uint32(pages[j][4:])
+	})
+
+	// prepare tables
+	namespaces := make(map[byte]string)
+	chunks := make(map[blobKey][]byte)
+	var entries []rawEntry
+
+	// read pages
+	for _, page := range pages {
+		for i := 0; i < entriesPerPage; {
+			// skip entries that have not been written
+			if (page[bitmapOffset+i/4]>>(uint(i%4)*2))&3 != 2 {
+				i++
+				continue
+			}
+
+			// get entry
+			entry := page[entriesOffset+i*entrySize:][:entrySize]
+			ns, typ, span, chunk := entry[0], entry[1], int(entry[2]), entry[3]
+
+			// skip corrupted entries
+			if span == 0 || i+span > entriesPerPage || checksum(entry[0:4], entry[8:32]) != binary.LittleEndian.Uint32(entry[4:]) {
+				i++
+				continue
+			}
+
+			// get key and data
+			key := string(entry[8:24])
+			if n := strings.IndexByte(key, 0); n >= 0 {
+				key = key[:n]
+			}
+			data := page[entriesOffset+(i+1)*entrySize:][:(span-1)*entrySize]
+
+			// advance
+			i += span
+
+			// handle entry
+			switch typ {
+			case typeU8:
+				if ns == 0 {
+					namespaces[entry[24]] = key
+				} else {
+					entries = append(entries, rawEntry{ns, key, entry[24]})
+				}
+			case typeI8:
+				entries = append(entries, rawEntry{ns, key, int8(entry[24])})
+			case typeU16:
+				entries = append(entries, rawEntry{ns, key, binary.LittleEndian.Uint16(entry[24:])})
+			case typeI16:
+				entries = append(entries, rawEntry{ns, key, int16(binary.LittleEndian.Uint16(entry[24:]))})
+			case typeU32:
+				entries = append(entries, rawEntry{ns, key, binary.LittleEndian.Uint32(entry[24:])})
+			case typeI32:
+				entries = append(entries, rawEntry{ns, key, int32(binary.LittleEndian.Uint32(entry[24:]))})
+			case typeU64:
+				entries = append(entries, rawEntry{ns, key, binary.LittleEndian.Uint64(entry[24:])})
+			case typeI64:
+				entries = append(entries, rawEntry{ns, key, int64(binary.LittleEndian.Uint64(entry[24:]))})
+			case typeString, typeBlob, typeBlobData:
+				// get data
+				size := int(binary.LittleEndian.Uint16(entry[24:]))
+				if size > len(data) || checksum(data[:size]) != binary.LittleEndian.Uint32(entry[28:]) {
+					continue
+				}
+				value := append([]byte(nil), data[:size]...)
+
+				// handle value
+				switch typ {
+				case typeString:
+					entries = append(entries, rawEntry{ns, key, strings.TrimRight(string(value), "\x00")})
+				case typeBlob:
+					entries = append(entries, rawEntry{ns, key, value})
+				case typeBlobData:
+					chunks[blobKey{ns, key, chunk}] = value
+				}
+			case typeBlobIndex:
+				// assemble chunks
+				size := int(binary.LittleEndian.Uint32(entry[24:]))
+				count, start := int(entry[28]), int(entry[29])
+				var value []byte
+				for c := start; c < start+count; c++ {
+					value = append(value, chunks[blobKey{ns, key, byte(c)}]...)
+				}
+
+				// check size
+				if len(value) != size {
+					continue
+				}
+
+				entries = append(entries, rawEntry{ns, key, value})
+			}
+		}
+	}
+
+	// prepare partition
+	partition := &Partition{}
+	index := make(map[string]int)
+
+	// add entries
+	for _, e := range entries {
+		// get namespace, skip entries of unknown namespaces
+		namespace, ok := namespaces[e.ns]
+		if !ok {
+			continue
+		}
+
+		// replace previous value
+		id := namespace + "/" + e.key
+		if n, ok := index[id]; ok {
+			partition.Entries[n].Value = e.value
+			continue
+		}
+
+		// add entry
+		index[id] = len(partition.Entries)
+		partition.Entries = append(partition.Entries, Entry{
+			Namespace: namespace,
+			Key:       e.key,
+			Value:     e.value,
+		})
+	}
+
+	return partition, nil
+}
@@ -0,0 +1,397 @@
+// Package nvs implements the ESP-IDF non-volatile storage (NVS) partition
+// format.
+package nvs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// PageSize is the size of a single NVS page.
+const PageSize = 4096
+
+// DefaultSize is the size of the default NVS partition.
+const DefaultSize = 0x4000
+
+// The layout of a page.
+const (
+	entrySize      = 32
+	entriesPerPage = 126
+	bitmapOffset   = 32
+	entriesOffset  = 64
+	maxKeyLength   = 15
+	maxNamespaces  = 254
+	maxChunkData   = (entriesPerPage - 1) * entrySize
+)
+
+// The page states and versions.
+const (
+	pageActive  uint32 = 0xFFFFFFFE
+	pageFull    uint32 = 0xFFFFFFFC
+	pageFreeing uint32 = 0xFFFFFFF8
+	version2    byte   = 0xFE
+)
+
+// The entry types.
+const (
+	typeU8        byte = 0x01
+	typeI8        byte = 0x11
+	typeU16       byte = 0x02
+	typeI16       byte = 0x12
+	typeU32       byte = 0x04
+	typeI32       byte = 0x14
+	typeU64       byte = 0x08
+	typeI64       byte = 0x18
+	typeString    byte = 0x21
+	typeBlob      byte = 0x41
+	typeBlobData  byte = 0x42
+	typeBlobIndex byte = 0x48
+)
+
+// chunkAny is the chunk index of entries that are not blob data.
+const chunkAny byte = 0xFF
+
+// An Entry is a single value stored in a namespace. The value is one of uint8,
+// int8, uint16, int16, uint32, int32, uint64, int64, string or []byte.
+type Entry struct {
+	Namespace string
+	Key       string
+	Value     interface{}
+}
+
+// A Partition is an ordered list of entries that can be encoded as an NVS
+// partition image.
+type Partition struct {
+	Entries []Entry
+}
+
+// Add will validate and append a value.
+func (p *Partition) Add(namespace, key string, value interface{}) error {
+	// check namespace and key
+	err := checkKey(namespace)
+	if err != nil {
+		return fmt.Errorf("invalid namespace: %w", err)
+	}
+	err = checkKey(key)
+	if err != nil {
+		return fmt.Errorf("invalid key '%s': %w", key, err)
+	}
+
+	// check value
+	switch value := value.(type) {
+	case uint8, int8, uint16, int16, uint32, int32, uint64, int64:
+	case string:
+		if len(value)+1 > maxChunkData {
+			return fmt.Errorf("string '%s' too long", key)
+		}
+	case []byte:
+		if len(value) > 255*maxChunkData {
+			return fmt.Errorf("blob '%s' too long", key)
+		}
+	default:
+		return fmt.Errorf("unsupported value type %T", value)
+	}
+
+	// add entry
+	p.Entries = append(p.Entries, Entry{
+		Namespace: namespace,
+		Key:       key,
+		Value:     value,
+	})
+
+	return nil
+}
+
+// Encode will generate a partition image of the specified size. The last page
+// is kept empty as required by the NVS library.
+func (p *Partition) Encode(size int) ([]byte, error) {
+	// check size
+	if size%PageSize != 0 || size < 3*PageSize {
+		return nil, errors.New("size must be a multiple of the page size and span at least three pages")
+	}
+
+	// prepare writer
+	w := &writer{
+		buf:   make([]byte, size),
+		pages: size / PageSize,
+	}
+	for i := range w.buf {
+		w.buf[i] = 0xFF
+	}
+
+	// begin first page
+	w.begin()
+
+	// prepare namespaces
+	namespaces := make(map[string]byte)
+
+	// write entries
+	for _, e := range p.Entries {
+		// write namespace if new
+		ns, ok := namespaces[e.Namespace]
+		if !ok {
+			// check count
+			if len(namespaces) >= maxNamespaces {
+				return nil, errors.New("too many namespaces")
+			}
+
+			// assign index
+			ns = byte(len(namespaces) + 1)
+			namespaces[e.Namespace] = ns
+
+			// write entry
+			err := w.primitive(0, typeU8, e.Namespace, []byte{ns})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// write value
+		var err error
+		switch value := e.Value.(type) {
+		case uint8:
+			err = w.primitive(ns, typeU8, e.Key, []byte{value})
+		case int8:
+			err = w.primitive(ns, typeI8, e.Key, []byte{byte(value)})
+		case uint16:
+			err = w.primitive(ns, typeU16, e.Key, little(2, uint64(value)))
+		case int16:
+			err = w.primitive(ns, typeI16, e.Key, little(2, uint64(value)))
+		case uint32:
+			err = w.primitive(ns, typeU32, e.Key, little(4, uint64(value)))
+		case int32:
+			err = w.primitive(ns, typeI32, e.Key, little(4, uint64(value)))
+		case uint64:
+			err = w.primitive(ns, typeU64, e.Key, little(8, uint64(value)))
+		case int64:
+			err = w.primitive(ns, typeI64, e.Key, little(8, uint64(value)))
+		case string:
+			err = w.string(ns, e.Key, value)
+		case []byte:
+			err = w.blob(ns, e.Key, value)
+		default:
+			err = fmt.Errorf("unsupported value type %T", value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return w.buf, nil
+}
+
+type writer struct {
+	buf   []byte
+	pages int
+	page  int
+	entry int
+}
+
+func (w *writer) begin() {
+	// get header
+	header := w.buf[w.page*PageSize:][:entrySize]
+
+	// set state, sequence number and version
+	binary.LittleEndian.PutUint32(header[0:], pageActive)
+	binary.LittleEndian.PutUint32(header[4:], uint32(w.page))
+	header[8] = version2
+
+	// set checksum
+	binary.LittleEndian.PutUint32(header[28:], checksum(header[4:28]))
+}
+
+func (w *writer) reserve(entries int) error {
+	// check current page
+	if w.entry+entries <= entriesPerPage {
+		return nil
+	}
+
+	// check pages, the last page must remain empty
+	if w.page+2 >= w.pages {
+		return errors.New("partition is full")
+	}
+
+	// mark current page full
+	binary.LittleEndian.PutUint32(w.buf[w.page*PageSize:], pageFull)
+
+	// begin next page
+	w.page++
+	w.entry = 0
+	w.begin()
+
+	return nil
+}
+
+func (w *writer) write(data []byte) {
+	// get page
+	page := w.buf[w.page*PageSize:][:PageSize]
+
+	// write entries
+	for i := 0; i < spanOf(len(data)); i++ {
+		// copy data
+		chunk := data[i*entrySize:]
+		if len(chunk) > entrySize {
+			chunk = chunk[:entrySize]
+		}
+		copy(page[entriesOffset+w.entry*entrySize:], chunk)
+
+		// mark entry written
+		page[bitmapOffset+w.entry/4] &^= 1 << (uint(w.entry%4) * 2)
+
+		// advance
+		w.entry++
+	}
+}
+
+func (w *writer) primitive(ns, typ byte, key string, value []byte) error {
+	// reserve entry
+	err := w.reserve(1)
+	if err != nil {
+		return err
+	}
+
+	// write entry
+	entry := header(ns, typ, 1, chunkAny, key)
+	copy(entry[24:], value)
+	seal(entry)
+	w.write(entry)
+
+	return nil
+}
+
+func (w *writer) string(ns byte, key, value string) error {
+	// append terminator
+	data := append([]byte(value), 0)
+
+	// reserve entries
+	span := 1 + spanOf(len(data))
+	err := w.reserve(span)
+	if err != nil {
+		return err
+	}
+
+	// write entries
+	w.write(dataHeader(ns, typeString, byte(span), chunkAny, key, data))
+	w.write(data)
+
+	return nil
+}
+
+func (w *writer) blob(ns byte, key string, value []byte) error {
+	// write chunks
+	chunks := 0
+	rest := value
+	for {
+		// ensure a header and at least one data entry fit on the page
+		err := w.reserve(2)
+		if err != nil {
+			return err
+		}
+
+		// get chunk data that fits on the page
+		data := rest
+		if limit := (entriesPerPage - w.entry - 1) * entrySize; len(data) > limit {
+			data = data[:limit]
+		}
+		rest = rest[len(data):]
+
+		// write entries
+		span := 1 + spanOf(len(data))
+		w.write(dataHeader(ns, typeBlobData, byte(span), byte(chunks), key, data))
+		w.write(data)
+		chunks++
+
+		// check rest
+		if len(rest) == 0 {
+			break
+		}
+	}
+
+	// reserve index
+	err := w.reserve(1)
+	if err != nil {
+		return err
+	}
+
+	// write index
+	entry := header(ns, typeBlobIndex, 1, chunkAny, key)
+	binary.LittleEndian.PutUint32(entry[24:], uint32(len(value)))
+	entry[28] = byte(chunks)
+	entry[29] = 0
+	seal(entry)
+	w.write(entry)
+
+	return nil
+}
+
+func header(ns, typ, span, chunk byte, key string) []byte {
+	// prepare entry
+	entry := make([]byte, entrySize)
+	for i := range entry {
+		entry[i] = 0xFF
+	}
+
+	// set fields
+	entry[0] = ns
+	entry[1] = typ
+	entry[2] = span
+	entry[3] = chunk
+
+	// set zero padded key
+	copy(entry[8:24], make([]byte, 16))
+	copy(entry[8:24], key)
+
+	return entry
+}
+
+func dataHeader(ns, typ, span, chunk byte, key string, data []byte) []byte {
+	// prepare entry
+	entry := header(ns, typ, span, chunk, key)
+
+	// set size and data checksum
+	binary.LittleEndian.PutUint16(entry[24:], uint16(len(data)))
+	binary.LittleEndian.PutUint32(entry[28:], checksum(data))
+	seal(entry)
+
+	return entry
+}
+
+func seal(entry []byte) {
+	// set checksum of entry without the checksum itself
+	binary.LittleEndian.PutUint32(entry[4:], checksum(entry[0:4], entry[8:32]))
+}
+
+func checksum(data ...[]byte) uint32 {
+	// compute checksum like the ESP-IDF
+	crc := uint32(0xFFFFFFFF)
+	for _, d := range data {
+		crc = crc32.Update(crc, crc32.IEEETable, d)
+	}
+
+	return crc
+}
+
+func little(size int, value uint64) []byte {
+	// encode value
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+
+	return buf[:size]
+}
+
+func spanOf(size int) int {
+	return (size + entrySize - 1) / entrySize
+}
+
+func checkKey(key string) error {
+	// check length
+	if len(key) == 0 {
+		return errors.New("empty")
+	} else if len(key) > maxKeyLength {
+		return fmt.Errorf("longer than %d characters", maxKeyLength)
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package nvs
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncode(t *testing.T) {
+	var p Partition
+	assert.NoError(t, p.Add("naos", "ssid", "foo"))
+	assert.NoError(t, p.Add("naos", "port", uint16(1883)))
+	assert.NoError(t, p.Add("other", "num", int32(-1)))
+
+	img, err := p.Encode(DefaultSize)
+	assert.NoError(t, err)
+	assert.Len(t, img, DefaultSize)
+
+	// page header
+	assert.Equal(t, pageActive, binary.LittleEndian.Uint32(img[0:]))
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(img[4:]))
+	assert.Equal(t, version2, img[8])
+	assert.Equal(t, checksum(img[4:28]), binary.LittleEndian.Uint32(img[28:]))
+
+	// namespace, string header, string data, integer, namespace, integer
+	assert.Equal(t, []byte{0xaa, 0xfa, 0xff}, img[32:35])
+
+	// namespace entry
+	entry := img[64:96]
+	assert.Equal(t, []byte{0, typeU8, 1, chunkAny}, entry[0:4])
+	assert.Equal(t, "naos", strings.TrimRight(string(entry[8:24]), "\x00"))
+	assert.Equal(t, byte(1), entry[24])
+	assert.Equal(t, checksum(entry[0:4], entry[8:32]), binary.LittleEndian.Uint32(entry[4:]))
+
+	// string entry
+	entry = img[96:128]
+	assert.Equal(t, []byte{1, typeString, 2, chunkAny}, entry[0:4])
+	assert.Equal(t, uint16(4), binary.LittleEndian.Uint16(entry[24:]))
+	assert.Equal(t, checksum([]byte("foo\x00")), binary.LittleEndian.Uint32(entry[28:]))
+	assert.Equal(t, "foo\x00", string(img[128:132]))
+
+	// integer entry
+	entry = img[160:192]
+	assert.Equal(t, []byte{1, typeU16, 1, chunkAny}, entry[0:4])
+	assert.Equal(t, uint16(1883), binary.LittleEndian.Uint16(entry[24:]))
+
+	// second namespace
+	entry = img[192:224]
+	assert.Equal(t, byte(2), entry[24])
+	entry = img[224:256]
+	assert.Equal(t, []byte{2, typeI32, 1, chunkAny}, entry[0:4])
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, entry[24:28])
+
+	// unused pages
+	for _, b := range img[PageSize:] {
+		assert.Equal(t, byte(0xff), b)
+	}
+}
+
+func TestEncodeBlob(t *testing.T) {
+	var p Partition
+	assert.NoError(t, p.Add("naos", "blob", make([]byte, 5000)))
+
+	img, err := p.Encode(DefaultSize)
+	assert.NoError(t, err)
+
+	// first page is full with one chunk of 124 data entries
+	assert.Equal(t, pageFull, binary.LittleEndian.Uint32(img[0:]))
+	entry := img[96:128]
+	assert.Equal(t, []byte{1, typeBlobData, 125, 0}, entry[0:4])
+	assert.Equal(t, uint16(124*32), binary.LittleEndian.Uint16(entry[24:]))
+
+	// second page holds the second chunk and the index
+	page := img[PageSize:]
+	assert.Equal(t, pageActive, binary.LittleEndian.Uint32(page[0:]))
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(page[4:]))
+	entry = page[64:96]
+	assert.Equal(t, []byte{1, typeBlobData, 1 + 33, 1}, entry[0:4])
+	assert.Equal(t, uint16(5000-124*32), binary.LittleEndian.Uint16(entry[24:]))
+	entry = page[64+34*32:][:32]
+	assert.Equal(t, []byte{1, typeBlobIndex, 1, chunkAny}, entry[0:4])
+	assert.Equal(t, uint32(5000), binary.LittleEndian.Uint32(entry[24:]))
+	assert.Equal(t, []byte{2, 0}, entry[28:30])
+}
+
+func TestEncodeFull(t *testing.T) {
+	var p Partition
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, p.Add("naos", "str", strings.Repeat("x", 3000)))
+	}
+
+	_, err := p.Encode(3 * PageSize)
+	assert.Error(t, err)
+
+	_, err = p.Encode(1000)
+	assert.Error(t, err)
+
+	assert.Error(t, p.Add("naos", "this-key-is-too-long", "x"))
+	assert.Error(t, p.Add("naos", "float", 1.5))
+}
+
+func TestDecode(t *testing.T) {
+	var p Partition
+	assert.NoError(t, p.Add("naos", "ssid", "foo"))
+	assert.NoError(t, p.Add("naos", "port", uint16(1883)))
+	assert.NoError(t, p.Add("other", "num", int32(-1)))
+	assert.NoError(t, p.Add("other", "blob", []byte(strings.Repeat("x", 5000))))
+	assert.NoError(t, p.Add("other", "big", int64(-42)))
+
+	img, err := p.Encode(DefaultSize)
+	assert.NoError(t, err)
+
+	q, err := Decode(img)
+	assert.NoError(t, err)
+	assert.Equal(t, p.Entries, q.Entries)
+
+	// corrupt string data
+	img[128] = 'x'
+
+	q, err = Decode(img)
+	assert.NoError(t, err)
+	assert.Len(t, q.Entries, 4)
+	assert.Equal(t, "port", q.Entries[0].Key)
+}
@@ -0,0 +1,360 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/256dpi/naos/pkg/fleet"
+	"github.com/256dpi/naos/pkg/naos"
+	"github.com/256dpi/naos/pkg/tree"
+)
+
+// A Request is the body of all operation requests. Fields that do not apply to
+// an operation are ignored.
+type Request struct {
+	Pattern  string `json:"pattern"`
+	Param    string `json:"param"`
+	Value    string `json:"value"`
+	Topic    string `json:"topic"`
+	Message  string `json:"message"`
+	Expect   string `json:"expect"`
+	Version  string `json:"version"`
+	Firmware []byte `json:"firmware"`
+	Delete   bool   `json:"delete"`
+	Retries  int    `json:"retries"`
+	Jobs     int    `json:"jobs"`
+	Timeout  string `json:"timeout"`
+	Duration string `json:"duration"`
+}
+
+// A Result is returned by most operations. The answering devices are listed
+// with their current state and the missing devices by name.
+type Result struct {
+	Devices []*naos.Device `json:"devices"`
+	Missing []string       `json:"missing"`
+}
+
+func (s *Server) listDevices(w http.ResponseWriter, r *http.Request) {
+	// acquire mutex
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// get pattern
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+
+	// filter devices
+	devices := s.project.Inventory.FilterDevices(pattern)
+	if devices == nil {
+		devices = []*naos.Device{}
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (s *Server) getDevice(w http.ResponseWriter, r *http.Request) {
+	// acquire mutex
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// get device
+	device, ok := s.project.Inventory.Devices[strings.TrimPrefix(r.URL.Path, "/api/devices/")]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("device not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, device)
+}
+
+func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
+	// read request
+	var req Request
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	// acquire mutex
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// ping devices
+	result, err := s.project.Inventory.Ping(req.pattern(), req.timeout())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// prepare latencies
+	latencies := make(map[string]float64)
+	for device, latency := range result.Latencies {
+		latencies[device.Name] = float64(latency) / float64(time.Millisecond)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"latencies": latencies,
+		"missing":   names(result.Missing),
+	})
+}
+
+func (s *Server) send(w http.ResponseWriter, r *http.Request) {
+	// read request
+	var req Request
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	// check topic
+	if req.Topic == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing topic"))
+		return
+	}
+
+	// acquire mutex
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// send message only if no reply is expected
+	if req.Expect == "" {
+		err := s.project.Inventory.Send(req.pattern(), req.Topic, []byte(req.Message), req.timeout())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+		return
+	}
+
+	// send message and await replies
+	result, err := s.project.Inventory.Request(req.pattern(), req.Topic, []byte(req.Message), req.Expect, req.Retries, req.timeout())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// prepare replies
+	replies := make(map[string]string)
+	for device, reply := range result.Replies {
+		replies[device.Name] = string(reply)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"replies": replies,
+		"missing": names(result.Missing),
+	})
+}
+
+func (s *Server) discover(w http.ResponseWriter, r *http.Request) {
+	s.modify(w, r, false, func(req *Request) (*naos.Result, error) {
+		return s.project.Inventory.Discover(req.pattern(), req.Retries, req.timeout())
+	})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	s.modify(w, r, true, func(req *Request) (*naos.Result, error) {
+		return s.project.Inventory.GetParams(req.pattern(), req.Param, req.Retries, req.timeout())
+	})
+}
+
+func (s *Server) set(w http.ResponseWriter, r *http.Request) {
+	s.modify(w, r, true, func(req *Request) (*naos.Result, error) {
+		return s.project.Inventory.SetParams(req.pattern(), req.Param, req.Value, req.Retries, req.timeout())
+	})
+}
+
+func (s *Server) unset(w http.ResponseWriter, r *http.Request) {
+	s.modify(w, r, true, func(req *Request) (*naos.Result, error) {
+		// unset parameter
+		devices, err := s.project.Inventory.UnsetParams(req.pattern(), req.Param, req.timeout())
+		if err != nil {
+			return nil, err
+		}
+
+		return &naos.Result{Answering: devices}, nil
+	})
+}
+
+func (s *Server) modify(w http.ResponseWriter, r *http.Request, param bool, fn func(*Request) (*naos.Result, error)) {
+	// read request
+	var req Request
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	// check param
+	if param && req.Param == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing param"))
+		return
+	}
+
+	// acquire mutex
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// get devices
+	before := deviceSet(s.project.Inventory)
+
+	// run operation
+	result, err := fn(&req)
+
+	// restart feeds if the devices changed
+	if deviceSet(s.project.Inventory) != before {
+		s.hub.refresh()
+	}
+
+	// check error
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// save inventory
+	err = s.project.SaveInventory()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// prepare devices
+	devices := result.Answering
+	if devices == nil {
+		devices = []*naos.Device{}
+	}
+
+	writeJSON(w, http.StatusOK, &Result{
+		Devices: devices,
+		Missing: names(result.Missing),
+	})
+}
+
+func (s *Server) debug(w http.ResponseWriter, r *http.Request) {
+	// read request
+	var req Request
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	// parse duration
+	duration, _ := time.ParseDuration(req.Duration)
+	if duration <= 0 {
+		duration = 2 * time.Second
+	}
+
+	// acquire mutex
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// gather coredumps
+	coredumps, err := s.project.Inventory.Debug(req.pattern(), req.Delete, duration)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// prepare table
+	table := make(map[string][]byte)
+	for device, coredump := range coredumps {
+		table[device.Name] = coredump
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"coredumps": table,
+	})
+}
+
+func (s *Server) update(w http.ResponseWriter, r *http.Request) {
+	// read request
+	var req Request
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	// check version
+	if req.Version == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing version"))
+		return
+	}
+
+	// use built firmware if none has been uploaded
+	firmware := req.Firmware
+	if len(firmware) == 0 {
+		bytes, err := tree.AppBinary(s.project.Tree())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		firmware = bytes
+	}
+
+	// get jobs
+	jobs := req.Jobs
+	if jobs <= 0 {
+		jobs = 10
+	}
+
+	// copy inventory as no lock is held for the duration of the update
+	s.mutex.RLock()
+	inv := s.project.Inventory.Copy()
+	s.mutex.RUnlock()
+
+	// start job
+	job := s.jobs.start("update", func(report func(*fleet.UpdateStatus)) error {
+		return inv.Update(req.Version, req.pattern(), firmware, jobs, req.timeout(), func(_ *naos.Device, status *fleet.UpdateStatus) {
+			report(status)
+		})
+	})
+
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.jobs.all())
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request) {
+	// get job
+	job := s.jobs.get(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	if job == nil {
+		writeError(w, http.StatusNotFound, errors.New("job not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+func (r *Request) pattern() string {
+	// use all devices by default
+	if r.Pattern == "" {
+		return "*"
+	}
+
+	return r.Pattern
+}
+
+func (r *Request) timeout() time.Duration {
+	// parse timeout
+	timeout, _ := time.ParseDuration(r.Timeout)
+	if timeout <= 0 {
+		return DefaultTimeout
+	}
+
+	return timeout
+}
+
+func names(devices []*naos.Device) []string {
+	// prepare list
+	list := make([]string, 0, len(devices))
+
+	// add names
+	for _, device := range devices {
+		list = append(list, device.Name)
+	}
+
+	return list
+}
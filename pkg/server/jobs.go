@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/256dpi/naos/pkg/fleet"
+)
+
+// JobRetention is the duration finished jobs are kept. At most the latest
+// MaxFinishedJobs finished jobs are kept regardless of their age.
+const JobRetention = time.Hour
+
+// MaxFinishedJobs is the number of finished jobs that are kept at most.
+const MaxFinishedJobs = 100
+
+// The available job states.
+const (
+	Running   = "running"
+	Completed = "completed"
+	Failed    = "failed"
+)
+
+// A Job describes a long-running operation. The devices map holds the latest
+// update status by device name.
+type Job struct {
+	ID         string                         `json:"id"`
+	Type       string                         `json:"type"`
+	Status     string                         `json:"status"`
+	Error      string                         `json:"error,omitempty"`
+	Devices    map[string]*fleet.UpdateStatus `json:"devices"`
+	CreatedAt  time.Time                      `json:"created_at"`
+	FinishedAt *time.Time                     `json:"finished_at,omitempty"`
+}
+
+type jobs struct {
+	list   map[string]*Job
+	notify func(job string, status fleet.UpdateStatus)
+	mutex  sync.Mutex
+}
+
+func newJobs() *jobs {
+	return &jobs{
+		list: make(map[string]*Job),
+	}
+}
+
+// start will create a new job and run the provided function in the background.
+// The function may call the provided report function with the status of a
+// device.
+func (j *jobs) start(typ string, fn func(report func(status *fleet.UpdateStatus)) error) *Job {
+	// generate id
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+
+	// create job
+	job := &Job{
+		ID:        hex.EncodeToString(buf),
+		Type:      typ,
+		Status:    Running,
+		Devices:   make(map[string]*fleet.UpdateStatus),
+		CreatedAt: time.Now(),
+	}
+
+	// add job
+	j.mutex.Lock()
+	j.prune(job.CreatedAt)
+	j.list[job.ID] = job
+	cp := j.copy(job)
+	j.mutex.Unlock()
+
+	// prepare report function
+	report := func(status *fleet.UpdateStatus) {
+		// acquire mutex
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+
+		// set status
+		state := *status
+		job.Devices[state.DeviceName] = &state
+
+		// notify status
+		if j.notify != nil {
+			j.notify(job.ID, state)
+		}
+	}
+
+	// run job
+	go func() {
+		// run function
+		err := fn(report)
+
+		// acquire mutex
+		j.mutex.Lock()
+		defer j.mutex.Unlock()
+
+		// set status
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Status = Completed
+		if err != nil {
+			job.Status = Failed
+			job.Error = err.Error()
+		}
+	}()
+
+	return cp
+}
+
+// get will return a copy of the job with the specified id.
+func (j *jobs) get(id string) *Job {
+	// acquire mutex
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	// prune jobs
+	j.prune(time.Now())
+
+	// get job
+	job, ok := j.list[id]
+	if !ok {
+		return nil
+	}
+
+	return j.copy(job)
+}
+
+// all will return a copy of all jobs ordered by their creation time.
+func (j *jobs) all() []*Job {
+	// acquire mutex
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	// prune jobs
+	j.prune(time.Now())
+
+	// copy jobs
+	list := make([]*Job, 0, len(j.list))
+	for _, job := range j.list {
+		list = append(list, j.copy(job))
+	}
+
+	// sort jobs
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.Before(list[b].CreatedAt)
+	})
+
+	return list
+}
+
+// prune will remove finished jobs that are older than the retention or exceed
+// the maximum number of finished jobs. It must be called with the mutex held.
+func (j *jobs) prune(now time.Time) {
+	// collect finished jobs
+	var finished []*Job
+	for id, job := range j.list {
+		if job.FinishedAt == nil {
+			continue
+		}
+
+		// remove expired job
+		if now.Sub(*job.FinishedAt) > JobRetention {
+			delete(j.list, id)
+			continue
+		}
+
+		finished = append(finished, job)
+	}
+
+	// check count
+	if len(finished) <= MaxFinishedJobs {
+		return
+	}
+
+	// sort jobs, latest first
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].FinishedAt.After(*finished[b].FinishedAt)
+	})
+
+	// remove oldest jobs
+	for _, job := range finished[MaxFinishedJobs:] {
+		delete(j.list, job.ID)
+	}
+}
+
+func (j *jobs) copy(job *Job) *Job {
+	// copy job
+	cp := *job
+
+	// copy devices
+	cp.Devices = make(map[string]*fleet.UpdateStatus, len(job.Devices))
+	for name, state := range job.Devices {
+		s := *state
+		cp.Devices[name] = &s
+	}
+
+	return &cp
+}
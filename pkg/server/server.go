@@ -0,0 +1,154 @@
+// Package server provides an HTTP/JSON API over a NAOS project.
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/naos/pkg/fleet"
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+// DefaultTimeout is used for operations that do not specify a timeout.
+const DefaultTimeout = 5 * time.Second
+
+// A Server serves the HTTP/JSON API for a project. All requests must carry the
+// configured token either as a bearer token in the "Authorization" header or
+// in the "token" query parameter.
+//
+// Operations that modify the inventory are serialized and the inventory is
+// saved after each of them. Updates are run in the background as jobs that can
+// be polled using their ID.
+//
+// Heartbeats, log messages, update progress and online state changes are
+// streamed as server-sent events. All clients share a single broker connection
+// per event source that is only kept open while clients are connected.
+type Server struct {
+	project *naos.Project
+	token   string
+	mux     *http.ServeMux
+	mutex   sync.RWMutex
+	jobs    *jobs
+	hub     *hub
+}
+
+// New creates a new Server for the provided project that requires the specified
+// token.
+func New(project *naos.Project, token string) *Server {
+	// create server
+	s := &Server{
+		project: project,
+		token:   token,
+		mux:     http.NewServeMux(),
+		jobs:    newJobs(),
+		hub:     newHub(),
+	}
+
+	// register feeds
+	s.hub.feeds = []*feed{
+		{types: []string{HeartbeatEvent, OnlineEvent, OfflineEvent}, run: s.heartbeats, reset: s.hub.forget},
+		{types: []string{LogEvent}, run: s.logs},
+	}
+
+	// publish job progress
+	s.jobs.notify = func(job string, status fleet.UpdateStatus) {
+		s.hub.publish(&Event{Type: UpdateEvent, Time: time.Now(), Device: status.DeviceName, Job: job, Update: &status})
+	}
+
+	// register handlers
+	s.mux.HandleFunc("/api/devices", s.only("GET", s.listDevices))
+	s.mux.HandleFunc("/api/devices/", s.only("GET", s.getDevice))
+	s.mux.HandleFunc("/api/ping", s.only("POST", s.ping))
+	s.mux.HandleFunc("/api/send", s.only("POST", s.send))
+	s.mux.HandleFunc("/api/discover", s.only("POST", s.discover))
+	s.mux.HandleFunc("/api/get", s.only("POST", s.get))
+	s.mux.HandleFunc("/api/set", s.only("POST", s.set))
+	s.mux.HandleFunc("/api/unset", s.only("POST", s.unset))
+	s.mux.HandleFunc("/api/debug", s.only("POST", s.debug))
+	s.mux.HandleFunc("/api/update", s.only("POST", s.update))
+	s.mux.HandleFunc("/api/jobs", s.only("GET", s.listJobs))
+	s.mux.HandleFunc("/api/jobs/", s.only("GET", s.getJob))
+	s.mux.HandleFunc("/api/events", s.only("GET", s.events))
+
+	return s
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// check token
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+		return
+	}
+
+	// serve request
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	// get token from header or query
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	return s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) only(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check method
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+
+		// call handler
+		handler(w, r)
+	}
+}
+
+// deviceSet returns a string that identifies the devices of the inventory and
+// how they are reached.
+func deviceSet(inv *naos.Inventory) string {
+	// collect devices
+	list := make([]string, 0, len(inv.Devices))
+	for name, d := range inv.Devices {
+		list = append(list, name+"|"+d.BaseTopic+"|"+d.Broker)
+	}
+
+	// sort devices
+	sort.Strings(list)
+
+	return strings.Join(list, "\n")
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	// decode body
+	err := json.NewDecoder(r.Body).Decode(value)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	// write response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+func testServer(t *testing.T) *Server {
+	// prepare inventory
+	inv := naos.NewInventory()
+	inv.Devices["foo"] = &naos.Device{
+		Name:       "foo",
+		BaseTopic:  "/foo",
+		Parameters: map[string]string{},
+	}
+
+	return New(&naos.Project{
+		Location:  t.TempDir(),
+		Inventory: inv,
+		Queue:     &naos.Queue{},
+	}, "secret")
+}
+
+func call(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	// prepare request
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	// serve request
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestServerAuthorization(t *testing.T) {
+	s := testServer(t)
+
+	rec := call(s, "GET", "/api/devices", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = call(s, "GET", "/api/devices", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = call(s, "GET", "/api/devices?token=secret", "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestServerDevices(t *testing.T) {
+	s := testServer(t)
+
+	rec := call(s, "GET", "/api/devices?pattern=f*", "secret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var devices []*naos.Device
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &devices))
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "/foo", devices[0].BaseTopic)
+
+	rec = call(s, "GET", "/api/devices/bar", "secret", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = call(s, "POST", "/api/devices", "secret", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestServerJobs(t *testing.T) {
+	s := testServer(t)
+
+	rec := call(s, "POST", "/api/update", "secret", `{"version":"1.0.0","pattern":"bar","firmware":"AQID"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	var job Job
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	assert.NotEmpty(t, job.ID)
+	assert.Equal(t, "update", job.Type)
+
+	assert.Eventually(t, func() bool {
+		rec = call(s, "GET", "/api/jobs/"+job.ID, "secret", "")
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return job.Status != Running
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, Failed, job.Status)
+	assert.Equal(t, "no matching devices", job.Error)
+
+	rec = call(s, "GET", "/api/jobs/unknown", "secret", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestJobsPrune(t *testing.T) {
+	j := newJobs()
+
+	now := time.Now()
+	old := now.Add(-2 * JobRetention)
+	j.list["old"] = &Job{ID: "old", FinishedAt: &old}
+	j.list["running"] = &Job{ID: "running", Status: Running}
+	for i := 0; i < MaxFinishedJobs+5; i++ {
+		finished := now.Add(-time.Duration(i) * time.Second)
+		id := fmt.Sprintf("job%d", i)
+		j.list[id] = &Job{ID: id, FinishedAt: &finished}
+	}
+
+	j.prune(now)
+	assert.Len(t, j.list, MaxFinishedJobs+1)
+	assert.NotNil(t, j.list["running"])
+	assert.NotNil(t, j.list["job0"])
+	assert.Nil(t, j.list["old"])
+	assert.Nil(t, j.list[fmt.Sprintf("job%d", MaxFinishedJobs)])
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanuber/go-glob"
+
+	"github.com/256dpi/naos/pkg/fleet"
+	"github.com/256dpi/naos/pkg/naos"
+)
+
+// OfflineTimeout is the duration after the last heartbeat of a device after
+// which it is reported offline.
+const OfflineTimeout = 30 * time.Second
+
+// The delays used to restart failed feeds.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// The available event types.
+const (
+	HeartbeatEvent = "heartbeat"
+	LogEvent       = "log"
+	UpdateEvent    = "update"
+	OnlineEvent    = "online"
+	OfflineEvent   = "offline"
+	ErrorEvent     = "error"
+)
+
+// An Event is streamed to clients of the events endpoint.
+type Event struct {
+	Type      string              `json:"type"`
+	Time      time.Time           `json:"time"`
+	Device    string              `json:"device,omitempty"`
+	Heartbeat *fleet.Heartbeat    `json:"heartbeat,omitempty"`
+	Log       string              `json:"log,omitempty"`
+	Job       string              `json:"job,omitempty"`
+	Update    *fleet.UpdateStatus `json:"update,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+type subscriber struct {
+	pattern string
+	types   map[string]bool
+	events  chan *Event
+}
+
+func (s *subscriber) wants(typ string) bool {
+	return len(s.types) == 0 || s.types[typ]
+}
+
+// A feed is a source of events that is only running while subscribers want
+// at least one of its event types. A failed feed is restarted with backoff. The
+// optional reset function is called with the hub mutex held when a feed
+// instance exits and has not been replaced in the meantime.
+type feed struct {
+	types []string
+	run   func(stop chan struct{}) error
+	reset func()
+	stop  chan struct{}
+}
+
+type hub struct {
+	subscribers map[*subscriber]bool
+	feeds       []*feed
+	seen        map[string]time.Time
+	online      map[string]bool
+	timeout     time.Duration
+	backoff     time.Duration
+	mutex       sync.Mutex
+}
+
+func newHub() *hub {
+	return &hub{
+		subscribers: make(map[*subscriber]bool),
+		seen:        make(map[string]time.Time),
+		online:      make(map[string]bool),
+		timeout:     OfflineTimeout,
+		backoff:     minBackoff,
+	}
+}
+
+// subscribe will add the subscriber and start the feeds it requires.
+func (h *hub) subscribe(sub *subscriber) {
+	// acquire mutex
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// add subscriber
+	h.subscribers[sub] = true
+
+	// reconcile feeds
+	h.reconcile()
+}
+
+// unsubscribe will remove the subscriber and stop the feeds that are no longer
+// required.
+func (h *hub) unsubscribe(sub *subscriber) {
+	// acquire mutex
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// remove subscriber
+	delete(h.subscribers, sub)
+
+	// reconcile feeds
+	h.reconcile()
+}
+
+// publish will send the event to all interested subscribers. Events are
+// dropped for subscribers that do not keep up.
+func (h *hub) publish(evt *Event) {
+	// acquire mutex
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// broadcast event
+	h.broadcast(evt)
+}
+
+// heartbeat will publish the heartbeat and report the device online if it has
+// not been seen before.
+func (h *hub) heartbeat(device string, hb *fleet.Heartbeat) {
+	// acquire mutex
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// update state
+	h.seen[device] = hb.ReceivedAt
+	if !h.online[device] {
+		h.online[device] = true
+		h.broadcast(&Event{Type: OnlineEvent, Time: hb.ReceivedAt, Device: device})
+	}
+
+	// broadcast heartbeat
+	h.broadcast(&Event{Type: HeartbeatEvent, Time: hb.ReceivedAt, Device: device, Heartbeat: hb})
+}
+
+// check will report devices offline that have not sent a heartbeat within the
+// offline timeout.
+func (h *hub) check(now time.Time) {
+	// acquire mutex
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// check devices
+	for device, last := range h.seen {
+		if h.online[device] && now.Sub(last) > h.timeout {
+			h.online[device] = false
+			h.broadcast(&Event{Type: OfflineEvent, Time: now, Device: device})
+		}
+	}
+}
+
+// forget will clear the online state of all devices. It must be called with
+// the mutex held.
+func (h *hub) forget() {
+	// reset state
+	h.seen = make(map[string]time.Time)
+	h.online = make(map[string]bool)
+}
+
+// refresh will restart all running feeds to pick up changed devices. The online
+// state of the devices is retained.
+func (h *hub) refresh() {
+	// acquire mutex
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// restart running feeds
+	for _, f := range h.feeds {
+		if f.stop != nil {
+			close(f.stop)
+			f.stop = make(chan struct{})
+			go h.run(f, f.stop)
+		}
+	}
+}
+
+func (h *hub) broadcast(evt *Event) {
+	for sub := range h.subscribers {
+		// check subscriber
+		if !sub.wants(evt.Type) || (evt.Device != "" && !glob.Glob(sub.pattern, evt.Device)) {
+			continue
+		}
+
+		// queue event
+		select {
+		case sub.events <- evt:
+		default:
+		}
+	}
+}
+
+func (h *hub) reconcile() {
+	for _, f := range h.feeds {
+		// check if any subscriber wants the feed
+		needed := false
+		for sub := range h.subscribers {
+			for _, typ := range f.types {
+				if sub.wants(typ) {
+					needed = true
+				}
+			}
+		}
+
+		// start feed if needed
+		if needed && f.stop == nil {
+			f.stop = make(chan struct{})
+			go h.run(f, f.stop)
+		}
+
+		// stop feed if no longer needed
+		if !needed && f.stop != nil {
+			close(f.stop)
+			f.stop = nil
+		}
+	}
+}
+
+func (h *hub) run(f *feed, stop chan struct{}) {
+	// prepare backoff
+	backoff := h.backoff
+
+	for {
+		// run feed
+		start := time.Now()
+		err := f.run(stop)
+
+		// acquire mutex
+		h.mutex.Lock()
+
+		// reset state unless the feed has been restarted in the meantime
+		if f.reset != nil && (f.stop == nil || f.stop == stop) {
+			f.reset()
+		}
+
+		// check if stopped
+		select {
+		case <-stop:
+			h.mutex.Unlock()
+			return
+		default:
+		}
+
+		// report error
+		if err != nil {
+			h.broadcast(&Event{Type: ErrorEvent, Time: time.Now(), Error: err.Error()})
+		}
+
+		// release mutex
+		h.mutex.Unlock()
+
+		// reset backoff if the feed has been running for a while
+		if time.Since(start) > maxBackoff {
+			backoff = h.backoff
+		}
+
+		// wait before restarting
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+
+		// increase backoff
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *Server) heartbeats(stop chan struct{}) error {
+	// check devices periodically
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				s.hub.check(now)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// prepare pending heartbeats
+	pending := make(map[string]*fleet.Heartbeat)
+	var mutex sync.Mutex
+	signal := make(chan struct{}, 1)
+
+	// apply pending heartbeats to the inventory without blocking the monitor
+	// while operations hold the server mutex
+	go func() {
+		for {
+			select {
+			case <-signal:
+			case <-stop:
+				return
+			}
+
+			// get pending heartbeats
+			mutex.Lock()
+			list := pending
+			pending = make(map[string]*fleet.Heartbeat)
+			mutex.Unlock()
+
+			// update devices
+			s.mutex.Lock()
+			for name, hb := range list {
+				if d, ok := s.project.Inventory.Devices[name]; ok {
+					d.Type = hb.DeviceType
+					d.FirmwareVersion = hb.FirmwareVersion
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}()
+
+	// copy inventory to only hold the server mutex while copying
+	s.mutex.RLock()
+	inv := s.project.Inventory.Copy()
+	s.mutex.RUnlock()
+
+	// monitor devices
+	return inv.Monitor("*", nil, stop, DefaultTimeout, func(d *naos.Device, hb *fleet.Heartbeat) {
+		// publish heartbeat
+		s.hub.heartbeat(d.Name, hb)
+
+		// queue heartbeat
+		mutex.Lock()
+		pending[d.Name] = hb
+		mutex.Unlock()
+
+		// signal applier
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	})
+}
+
+func (s *Server) logs(stop chan struct{}) error {
+	// copy inventory to only hold the server mutex while copying
+	s.mutex.RLock()
+	inv := s.project.Inventory.Copy()
+	s.mutex.RUnlock()
+
+	// record devices
+	return inv.Record("*", stop, DefaultTimeout, func(d *naos.Device, msg string) {
+		s.hub.publish(&Event{Type: LogEvent, Time: time.Now(), Device: d.Name, Log: msg})
+	})
+}
+
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	// check flusher
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	// prepare subscriber
+	sub := &subscriber{
+		pattern: r.URL.Query().Get("pattern"),
+		types:   make(map[string]bool),
+		events:  make(chan *Event, 64),
+	}
+	if sub.pattern == "" {
+		sub.pattern = "*"
+	}
+
+	// parse types
+	for _, typ := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			sub.types[typ] = true
+		}
+	}
+
+	// subscribe
+	s.hub.subscribe(sub)
+	defer s.hub.unsubscribe(sub)
+
+	// write headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// prepare keep alive
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case evt := <-sub.events:
+			// encode event
+			data, err := json.Marshal(evt)
+			if err != nil {
+				return
+			}
+
+			// write event
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Type, data)
+			if err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			// write comment
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+
+		// flush data
+		flusher.Flush()
+	}
+}
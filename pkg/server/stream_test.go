@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/256dpi/naos/pkg/fleet"
+)
+
+func TestHubFilter(t *testing.T) {
+	h := newHub()
+
+	all := &subscriber{pattern: "*", events: make(chan *Event, 10)}
+	foo := &subscriber{pattern: "foo*", types: map[string]bool{LogEvent: true}, events: make(chan *Event, 10)}
+	h.subscribe(all)
+	h.subscribe(foo)
+
+	h.publish(&Event{Type: LogEvent, Device: "foo1"})
+	h.publish(&Event{Type: LogEvent, Device: "bar1"})
+	h.publish(&Event{Type: UpdateEvent, Device: "foo1"})
+
+	assert.Len(t, all.events, 3)
+	assert.Len(t, foo.events, 1)
+	assert.Equal(t, "foo1", (<-foo.events).Device)
+}
+
+func TestHubOnlineState(t *testing.T) {
+	h := newHub()
+
+	sub := &subscriber{pattern: "*", events: make(chan *Event, 10)}
+	h.subscribe(sub)
+
+	now := time.Now()
+	h.heartbeat("foo", &fleet.Heartbeat{ReceivedAt: now})
+	h.heartbeat("foo", &fleet.Heartbeat{ReceivedAt: now})
+	h.check(now.Add(h.timeout / 2))
+	h.check(now.Add(h.timeout * 2))
+	h.check(now.Add(h.timeout * 3))
+
+	var types []string
+	for len(sub.events) > 0 {
+		types = append(types, (<-sub.events).Type)
+	}
+	assert.Equal(t, []string{OnlineEvent, HeartbeatEvent, HeartbeatEvent, OfflineEvent}, types)
+}
+
+func TestHubSharedFeed(t *testing.T) {
+	h := newHub()
+
+	var starts int32
+	h.feeds = []*feed{{
+		types: []string{LogEvent},
+		run: func(stop chan struct{}) error {
+			atomic.AddInt32(&starts, 1)
+			<-stop
+			return nil
+		},
+	}}
+
+	sub1 := &subscriber{pattern: "*", types: map[string]bool{LogEvent: true}, events: make(chan *Event, 10)}
+	sub2 := &subscriber{pattern: "*", events: make(chan *Event, 10)}
+	sub3 := &subscriber{pattern: "*", types: map[string]bool{UpdateEvent: true}, events: make(chan *Event, 10)}
+	h.subscribe(sub1)
+	h.subscribe(sub2)
+	h.subscribe(sub3)
+	assert.NotNil(t, h.feeds[0].stop)
+
+	h.unsubscribe(sub1)
+	assert.NotNil(t, h.feeds[0].stop)
+
+	h.unsubscribe(sub2)
+	assert.Nil(t, h.feeds[0].stop)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&starts))
+}
+
+func TestHubRestartFeed(t *testing.T) {
+	h := newHub()
+	h.backoff = time.Millisecond
+
+	var starts, resets int32
+	h.feeds = []*feed{{
+		types: []string{LogEvent},
+		run: func(stop chan struct{}) error {
+			if atomic.AddInt32(&starts, 1) == 1 {
+				return errors.New("failed")
+			}
+			<-stop
+			return nil
+		},
+		reset: func() {
+			atomic.AddInt32(&resets, 1)
+		},
+	}}
+
+	sub := &subscriber{pattern: "*", events: make(chan *Event, 10)}
+	h.subscribe(sub)
+
+	evt := <-sub.events
+	assert.Equal(t, ErrorEvent, evt.Type)
+	assert.Equal(t, "failed", evt.Error)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&starts) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&resets))
+
+	h.unsubscribe(sub)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&resets) == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestHubRefreshFeed(t *testing.T) {
+	h := newHub()
+
+	var starts, resets int32
+	h.feeds = []*feed{{
+		types: []string{LogEvent},
+		run: func(stop chan struct{}) error {
+			atomic.AddInt32(&starts, 1)
+			<-stop
+			return nil
+		},
+		reset: func() {
+			atomic.AddInt32(&resets, 1)
+		},
+	}}
+
+	h.refresh()
+	assert.Equal(t, int32(0), atomic.LoadInt32(&starts))
+
+	sub := &subscriber{pattern: "*", events: make(chan *Event, 10)}
+	h.subscribe(sub)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&starts) == 1
+	}, time.Second, time.Millisecond)
+
+	h.refresh()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&starts) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&resets))
+
+	h.unsubscribe(sub)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&resets) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestServerEvents(t *testing.T) {
+	s := testServer(t)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	res, err := srv.Client().Get(srv.URL + "/api/events?token=secret&types=update")
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	s.jobs.start("update", func(report func(*fleet.UpdateStatus)) error {
+		report(&fleet.UpdateStatus{DeviceName: "foo", Progress: 0.5, ErrorMessage: "failed"})
+		return nil
+	})
+
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "event: update\n", line)
+
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "data: "))
+	assert.Contains(t, line, `"device":"foo"`)
+	assert.Contains(t, line, `"progress":0.5`)
+	assert.Contains(t, line, `"error":"failed"`)
+}
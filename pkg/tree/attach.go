@@ -1,88 +1,110 @@
 package tree
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 
-	"github.com/kr/pty"
-
+	"github.com/256dpi/naos/pkg/monitor"
 	"github.com/256dpi/naos/pkg/utils"
 )
 
-// Attach will attach to the specified serial port using either miniterm in simple
-// mode or idf_monitor.
-func Attach(naosPath, port string, simple bool, out io.Writer, in io.Reader) error {
-	// prepare command
-	var cmd *exec.Cmd
-
-	// set simple or advanced command
-	if simple {
-		// construct command
-		cmd = exec.Command("miniterm.py", "--rts", "0", "--dtr", "0", "--raw", port, "115200")
-	} else {
-		// get path of monitor tool
-		tool := filepath.Join(IDFDirectory(naosPath), "tools", "idf_monitor.py")
-
-		// get elf path
-		elf := filepath.Join(Directory(naosPath), "build", "naos-project.elf")
-
-		// construct command
-		cmd = exec.Command("python", tool, "--baud", "115200", "--port", port, elf)
+// AttachOptions configures the serial monitor.
+type AttachOptions struct {
+	// Do not decode backtraces and panic addresses.
+	Simple bool
+
+	// Prefix every line with the time it was received.
+	Timestamps bool
+
+	// Append the session to the specified file.
+	LogFile string
+}
+
+// Attach will attach to the specified serial port. Backtraces and panic
+// addresses are decoded using the project ELF unless simple mode is requested.
+func Attach(naosPath, port string, opts AttachOptions, out io.Writer, in io.Reader) error {
+	// prepare config
+	config := monitor.Config{
+		Port:       port,
+		Timestamps: opts.Timestamps,
 	}
 
-	// set working directory
-	cmd.Dir = Directory(naosPath)
+	// open log file if requested
+	if opts.LogFile != "" {
+		file, err := os.OpenFile(opts.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
 
-	// inherit current environment
-	cmd.Env = os.Environ()
+		// ensure file gets closed
+		defer file.Close()
 
-	// get bin directory
-	bin, err := BinDirectory(naosPath)
-	if err != nil {
-		return err
+		// set log
+		config.Log = file
 	}
 
-	// go through all env variables
-	for i, str := range cmd.Env {
-		if strings.HasPrefix(str, "PATH=") {
-			// prepend toolchain bin directory
-			cmd.Env[i] = "PATH=" + bin + ":" + os.Getenv("PATH")
-		} else if strings.HasPrefix(str, "PWD=") {
-			// override shell working directory
-			cmd.Env[i] = "PWD=" + Directory(naosPath)
+	// set decoder if not simple and available
+	if !opts.Simple {
+		decoder, err := addressDecoder(naosPath)
+		if err != nil {
+			return err
 		}
+		config.Decode = decoder
 	}
 
-	// start process and get tty
-	utils.Log(out, "Attaching to serial port (press Ctrl+C to exit)...")
-	tty, err := pty.Start(cmd)
+	// run monitor
+	utils.Log(out, "Attaching to serial port ("+monitor.Help+")...")
+	err := monitor.Run(config, out, in)
 	if err != nil {
 		return err
 	}
 
-	// make sure tty gets closed
-	defer tty.Close()
+	return nil
+}
 
-	// prepare channel
-	quit := make(chan struct{})
+func addressDecoder(naosPath string) (func([]string) ([]string, error), error) {
+	// get elf path
+	elf := filepath.Join(Directory(naosPath), "build", "naos-project.elf")
 
-	// read data until EOF
-	go func() {
-		io.Copy(out, tty)
-		close(quit)
-	}()
+	// check elf
+	_, err := os.Stat(elf)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-	// write data until EOF
-	go func() {
-		io.Copy(tty, in)
-		close(quit)
-	}()
+	// get bin directory
+	bin, err := BinDirectory(naosPath)
+	if err != nil {
+		return nil, err
+	}
 
-	// wait for quit
-	<-quit
+	// get tool path
+	tool := filepath.Join(bin, Toolchain+"-addr2line")
 
-	return nil
+	return func(addresses []string) ([]string, error) {
+		// prepare command
+		cmd := exec.Command(tool, append([]string{"-pfiaC", "-e", elf}, addresses...)...)
+
+		// run command
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, err
+		}
+
+		// collect known locations
+		var lines []string
+		for _, line := range strings.Split(string(bytes.TrimSpace(output)), "\n") {
+			if line != "" && !strings.Contains(line, "?? ??:0") {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+		}
+
+		return lines, nil
+	}, nil
 }
@@ -1,13 +1,12 @@
 package tree
 
 import (
-	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"sort"
 
+	"github.com/256dpi/naos/pkg/nvs"
 	"github.com/256dpi/naos/pkg/utils"
 )
 
@@ -23,75 +22,148 @@ var settings = map[string]bool{
 	"base-topic":     true,
 }
 
-// Config will write settings and parameters to an attached device.
-func Config(naosPath string, values map[string]string, port string, out io.Writer) error {
-	// assemble csv
-	var buf bytes.Buffer
-	buf.WriteString("key,type,encoding,value\n")
-	buf.WriteString("naos-ble,namespace,,\n")
-	for key, value := range values {
+// IsSetting returns whether the key is a setting rather than a parameter.
+func IsSetting(key string) bool {
+	return settings[key]
+}
+
+// ConfigImage will generate an NVS partition image with the provided settings
+// and parameters.
+func ConfigImage(values map[string]string) ([]byte, error) {
+	// sort keys
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// prepare partition
+	var partition nvs.Partition
+
+	// add settings
+	for _, key := range keys {
 		if settings[key] {
-			buf.WriteString(fmt.Sprintf("%s,data,string,%s\n", key, value))
+			err := partition.Add("naos-ble", key, values[key])
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
-	buf.WriteString("naos-manager,namespace,,\n")
-	for key, value := range values {
+
+	// add parameters
+	for _, key := range keys {
 		if !settings[key] {
-			buf.WriteString(fmt.Sprintf("%s,data,string,%s\n", key, value))
+			err := partition.Add("naos-manager", key, values[key])
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	// calculate paths
-	tempDir := filepath.Join(os.TempDir(), "naos")
-	valuesCSV := filepath.Join(tempDir, "values.csv")
-	nvsImage := filepath.Join(tempDir, "nvs.img")
-	nvsPartGen := filepath.Join(IDFDirectory(naosPath), "components", "nvs_flash", "nvs_partition_generator", "nvs_partition_gen.py")
-	espTool := filepath.Join(IDFDirectory(naosPath), "components", "esptool_py", "esptool", "esptool.py")
+	return partition.Encode(nvs.DefaultSize)
+}
 
-	// ensure directory
-	err := os.MkdirAll(tempDir, 0755)
+// Config will write settings and parameters to an attached device.
+func Config(values map[string]string, port string, settings FlashSettings, out io.Writer) error {
+	// get settings
+	settings, err := settings.withDefaults()
 	if err != nil {
 		return err
 	}
 
-	// writing CSV
-	utils.Log(out, "Writing values...")
-	err = ioutil.WriteFile(valuesCSV, buf.Bytes(), 0644)
+	// generating image
+	utils.Log(out, "Generating image...")
+	image, err := ConfigImage(values)
 	if err != nil {
 		return err
 	}
 
-	// generating image
-	utils.Log(out, "Generating image...")
-	err = Exec(naosPath, out, nil, "python", []string{
-		nvsPartGen,
-		"--input", valuesCSV,
-		"--output", nvsImage,
-		"--size", "0x4000",
-	}...)
+	// connect to device
+	flasher, _, err := connect(port, settings, out)
 	if err != nil {
 		return err
 	}
 
+	// ensure flasher is closed
+	defer flasher.Close()
+
 	// flashing image
 	utils.Log(out, "Flashing...")
-	err = Exec(naosPath, out, nil, "python", []string{
-		espTool,
-		"--chip", "esp32",
-		"--port", port,
-		"--baud", "921600",
-		"--before", "default_reset",
-		"--after", "hard_reset",
-		"write_flash",
-		"-z",
-		"--flash_mode", "dio",
-		"--flash_freq", "40m",
-		"--flash_size", "detect",
-		"0x9000", nvsImage,
-	}...)
+	err = write(flasher, "config", nvsOffset, image, FlashOptions{}, out)
 	if err != nil {
 		return err
 	}
 
+	// reset device if requested
+	if settings.After == ResetDefault {
+		return flasher.Reset()
+	}
+
 	return nil
 }
+
+// ParseConfigImage will decode the settings and parameters from an NVS partition
+// image.
+func ParseConfigImage(image []byte) (map[string]string, error) {
+	// decode partition
+	partition, err := nvs.Decode(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect values
+	values := make(map[string]string)
+	for _, e := range partition.Entries {
+		// check namespace
+		if e.Namespace != "naos-ble" && e.Namespace != "naos-manager" {
+			continue
+		}
+
+		// set value
+		switch value := e.Value.(type) {
+		case string:
+			values[e.Key] = value
+		case []byte:
+			values[e.Key] = hex.EncodeToString(value)
+		default:
+			values[e.Key] = fmt.Sprint(value)
+		}
+	}
+
+	return values, nil
+}
+
+// ReadConfig will read the settings and parameters from an attached device.
+func ReadConfig(port string, settings FlashSettings, out io.Writer) (map[string]string, error) {
+	// get settings
+	settings, err := settings.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to device
+	flasher, _, err := connect(port, settings, out)
+	if err != nil {
+		return nil, err
+	}
+
+	// ensure flasher is closed
+	defer flasher.Close()
+
+	// reading image
+	utils.Log(out, "Reading...")
+	image, err := flasher.Read(nvsOffset, nvs.DefaultSize, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// reset device if requested
+	if settings.After == ResetDefault {
+		err = flasher.Reset()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ParseConfigImage(image)
+}
@@ -1,111 +1,348 @@
 package tree
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 
+	"github.com/256dpi/naos/pkg/esp"
 	"github.com/256dpi/naos/pkg/utils"
 )
 
-// Flash will flash the project using the specified serial port.
-func Flash(naosPath, port string, erase, appOnly bool, out io.Writer) error {
+// The default flash settings.
+const (
+	FlashBaudRate  = 921600
+	FlashMode      = "dio"
+	FlashFrequency = "40m"
+)
+
+// The reset behaviours before and after flashing.
+const (
+	ResetDefault = "reset"
+	ResetNone    = "none"
+)
+
+// The baud rates tried if the configured baud rate fails.
+var fallbackRates = []int{460800, 230400, esp.DefaultBaudRate}
+
+// The flash layout.
+const (
+	bootloaderOffset = 0x1000
+	partitionsOffset = 0x8000
+	nvsOffset        = 0x9000
+	otaOffset        = 0xd000
+	otaSize          = 0x2000
+	appOffset        = 0x10000
+)
+
+// FlashSettings configures the connection to the bootloader and the flash chip.
+// Zero values select the defaults.
+type FlashSettings struct {
+	// The baud rate, lower baud rates are tried if it fails.
+	BaudRate int
+
+	// The flash mode and frequency set in the bootloader image.
+	Mode      string
+	Frequency string
+
+	// Whether the device is reset into the bootloader before and into the
+	// application after flashing, either "reset" or "none".
+	Before string
+	After  string
+}
+
+func (s FlashSettings) withDefaults() (FlashSettings, error) {
+	// set defaults
+	if s.BaudRate == 0 {
+		s.BaudRate = FlashBaudRate
+	}
+	if s.Mode == "" {
+		s.Mode = FlashMode
+	}
+	if s.Frequency == "" {
+		s.Frequency = FlashFrequency
+	}
+	if s.Before == "" {
+		s.Before = ResetDefault
+	}
+	if s.After == "" {
+		s.After = ResetDefault
+	}
+
+	// check reset behaviours
+	for _, value := range []string{s.Before, s.After} {
+		if value != ResetDefault && value != ResetNone {
+			return s, fmt.Errorf("invalid reset behaviour '%s'", value)
+		}
+	}
+
+	return s, nil
+}
+
+// FlashOptions configures how a device is flashed.
+type FlashOptions struct {
+	// The connection and flash chip settings.
+	Settings FlashSettings
+
+	// Erase the whole flash before flashing.
+	Erase bool
+
+	// Only flash the application.
+	AppOnly bool
+
+	// Config may return settings and parameters that are written to the
+	// device with the provided MAC address.
+	Config func(mac string) (map[string]string, error)
+
+	// Progress is called with the current step and its progress instead of
+	// logging the progress.
+	Progress func(step string, progress float64)
+}
+
+type image struct {
+	name   string
+	offset int
+	data   []byte
+}
+
+// Flash will flash the project using the specified serial port. If writing the
+// first image fails, the device is flashed again using a lower baud rate.
+func Flash(naosPath, port string, opts FlashOptions, out io.Writer) error {
+	// get settings
+	settings, err := opts.Settings.withDefaults()
+	if err != nil {
+		return err
+	}
+
 	// calculate paths
-	espTool := filepath.Join(IDFDirectory(naosPath), "components", "esptool_py", "esptool", "esptool.py")
 	bootLoaderBinary := filepath.Join(Directory(naosPath), "build", "bootloader", "bootloader.bin")
 	projectBinary := filepath.Join(Directory(naosPath), "build", "naos-project.bin")
 	partitionsBinary := filepath.Join(Directory(naosPath), "build", "partitions.bin")
 
-	// prepare erase flash command
-	eraseFlash := []string{
-		espTool,
-		"--chip", "esp32",
-		"--port", port,
-		"--baud", "921600",
-		"--before", "default_reset",
-		"--after", "hard_reset",
-		"erase_flash",
-	}
-
-	// prepare erase ota command
-	eraseOTA := []string{
-		espTool,
-		"--chip", "esp32",
-		"--port", port,
-		"--baud", "921600",
-		"--before", "default_reset",
-		"--after", "hard_reset",
-		"erase_region", "0xd000", "0x2000",
-	}
-
-	// prepare flash all command
-	flashAll := []string{
-		espTool,
-		"--chip", "esp32",
-		"--port", port,
-		"--baud", "921600",
-		"--before", "default_reset",
-		"--after", "hard_reset",
-		"write_flash",
-		"-z",
-		"--flash_mode", "dio",
-		"--flash_freq", "40m",
-		"--flash_size", "detect",
-		"0x1000", bootLoaderBinary,
-		"0x8000", partitionsBinary,
-		"0x10000", projectBinary,
-	}
-
-	// prepare flash app command
-	flashApp := []string{
-		espTool,
-		"--chip", "esp32",
-		"--port", port,
-		"--baud", "921600",
-		"--before", "default_reset",
-		"--after", "hard_reset",
-		"write_flash",
-		"-z",
-		"--flash_mode", "dio",
-		"--flash_freq", "40m",
-		"--flash_size", "detect",
-		"0x10000", projectBinary,
+	// prepare images
+	images := []image{
+		{name: "bootloader", offset: bootloaderOffset},
+		{name: "partitions", offset: partitionsOffset},
+		{name: "app", offset: appOffset},
+	}
+	paths := []string{bootLoaderBinary, partitionsBinary, projectBinary}
+	if opts.AppOnly {
+		images = images[2:]
+		paths = paths[2:]
 	}
 
-	// erase if requested
-	if erase {
-		utils.Log(out, "Erasing flash...")
-		err := Exec(naosPath, out, nil, "python", eraseFlash...)
+	// read images
+	for i := range images {
+		images[i].data, err = ioutil.ReadFile(paths[i])
 		if err != nil {
 			return err
 		}
 	}
 
-	// flash app only
-	if appOnly {
-		utils.Log(out, "Flashing (app only)...")
-		err := Exec(naosPath, out, nil, "python", flashApp...)
+	// patch bootloader, the flash size is patched once connected
+	if !opts.AppOnly {
+		images[0].data, err = esp.PatchImage(images[0].data, settings.Mode, settings.Frequency, 0)
 		if err != nil {
 			return err
 		}
+	}
+
+	for {
+		// connect to device
+		report(opts, "connecting", 0)
+		flasher, rate, err := connect(port, settings, out)
+		if err != nil {
+			return err
+		}
+
+		// check chip
+		if chip := flasher.Chip().Name; chip != DefaultTarget {
+			_ = flasher.Close()
+			return fmt.Errorf("attached chip is '%s' but the project targets '%s'", chip, DefaultTarget)
+		}
+
+		// flash device
+		written, err := flash(flasher, images, settings, opts, out)
+		_ = flasher.Close()
+		if err == nil {
+			report(opts, "done", 1)
+			return nil
+		}
+
+		// check fallback
+		lower := lowerRate(rate)
+		if written || lower == 0 || settings.Before == ResetNone {
+			return err
+		}
 
-		return nil
+		// retry with lower baud rate
+		utils.Log(out, fmt.Sprintf("Writing failed at %d baud (%s), retrying at %d baud...", rate, err, lower))
+		settings.BaudRate = lower
 	}
+}
 
-	// flash all
-	utils.Log(out, "Flashing...")
-	err := Exec(naosPath, out, nil, "python", flashAll...)
-	if err != nil {
-		return err
+func flash(flasher *esp.Flasher, images []image, settings FlashSettings, opts FlashOptions, out io.Writer) (bool, error) {
+	// patch detected flash size into bootloader
+	if len(images) > 0 && images[0].name == "bootloader" {
+		data, err := esp.PatchImage(images[0].data, "", "", flasher.FlashSize())
+		if err != nil {
+			return false, err
+		}
+		images = append([]image{{name: "bootloader", offset: images[0].offset, data: data}}, images[1:]...)
+	}
+
+	// generate config if requested
+	var config []byte
+	if opts.Config != nil {
+		// read mac
+		mac, err := flasher.ReadMAC()
+		if err != nil {
+			return false, err
+		}
+
+		// get values
+		values, err := opts.Config(mac)
+		if err != nil {
+			return false, err
+		}
+
+		// generate image
+		config, err = ConfigImage(values)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// erase if requested
+	if opts.Erase {
+		utils.Log(out, "Erasing flash...")
+		report(opts, "erasing", 0)
+		err := flasher.Erase(0, flasher.FlashSize())
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// flash images
+	if opts.AppOnly {
+		utils.Log(out, "Flashing (app only)...")
+	} else {
+		utils.Log(out, "Flashing...")
+	}
+	for i, image := range images {
+		err := write(flasher, image.name, image.offset, image.data, opts, out)
+		if err != nil {
+			return i > 0, err
+		}
+	}
+
+	// flash config if available
+	if config != nil {
+		utils.Log(out, "Flashing config...")
+		err := write(flasher, "config", nvsOffset, config, opts, out)
+		if err != nil {
+			return true, err
+		}
 	}
 
 	// erase ota if not already erased
-	if !erase {
+	if !opts.Erase && !opts.AppOnly {
 		utils.Log(out, "Erasing OTA config...")
-		err := Exec(naosPath, out, nil, "python", eraseOTA...)
+		report(opts, "erasing ota", 0)
+		err := flasher.Erase(otaOffset, otaSize)
 		if err != nil {
-			return err
+			return true, err
 		}
 	}
 
+	// reset device if requested
+	if settings.After == ResetDefault {
+		err := flasher.Reset()
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+func connect(port string, settings FlashSettings, out io.Writer) (*esp.Flasher, int, error) {
+	for {
+		// open port
+		utils.Log(out, "Connecting...")
+		flasher, err := esp.Open(port)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// connect to bootloader
+		err = flasher.Connect(settings.Before == ResetDefault)
+		if err != nil {
+			_ = flasher.Close()
+			return nil, 0, err
+		}
+
+		// change baud rate
+		err = flasher.ChangeBaud(settings.BaudRate)
+		if err != nil {
+			_ = flasher.Close()
+
+			// check fallback
+			lower := lowerRate(settings.BaudRate)
+			if lower == 0 || settings.Before == ResetNone {
+				return nil, 0, err
+			}
+
+			// retry with lower baud rate
+			utils.Log(out, fmt.Sprintf("Connection failed at %d baud, retrying at %d baud...", settings.BaudRate, lower))
+			settings.BaudRate = lower
+			continue
+		}
+
+		// attach flash
+		err = flasher.Attach(0)
+		if err != nil {
+			_ = flasher.Close()
+			return nil, 0, err
+		}
+
+		return flasher, settings.BaudRate, nil
+	}
+}
+
+func lowerRate(rate int) int {
+	// find next lower rate
+	for _, r := range fallbackRates {
+		if r < rate {
+			return r
+		}
+	}
+
+	return 0
+}
+
+func write(flasher *esp.Flasher, name string, offset int, data []byte, opts FlashOptions, out io.Writer) error {
+	// write data
+	err := flasher.Write(offset, data, func(progress float64) {
+		if opts.Progress != nil {
+			opts.Progress("flashing "+name, progress)
+		} else if out != nil {
+			_, _ = fmt.Fprintf(out, "\rWriting %d bytes at 0x%05x... (%d %%)", len(data), offset, int(progress*100))
+		}
+	})
+	if opts.Progress == nil && out != nil {
+		_, _ = fmt.Fprintln(out)
+	}
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
+
+func report(opts FlashOptions, step string, progress float64) {
+	if opts.Progress != nil {
+		opts.Progress(step, progress)
+	}
+}
@@ -13,7 +13,8 @@ import (
 )
 
 // Install will install the NAOS repo to the specified path and link the source
-// path into the build tree.
+// path into the build tree. The version may be a branch, a tag or a commit hash.
+// The toolchain is installed separately.
 func Install(naosPath, sourcePath, dataPath, version string, overrides map[string]string, force bool, out io.Writer) error {
 	// remove existing directory if existing or force has been set
 	if force {
@@ -48,18 +49,6 @@ func Install(naosPath, sourcePath, dataPath, version string, overrides map[strin
 		}
 	}
 
-	// get required toolchain
-	toolchainVersion, err := RequiredToolchain(naosPath)
-	if err != nil {
-		return err
-	}
-
-	// install xtensa toolchain
-	err = InstallToolchain(naosPath, toolchainVersion, force, out)
-	if err != nil {
-		return err
-	}
-
 	// link source directory if missing
 	ok, err = utils.Exists(filepath.Join(Directory(naosPath), "main", "src"))
 	if err != nil {
@@ -123,6 +112,14 @@ func Install(naosPath, sourcePath, dataPath, version string, overrides map[strin
 	return nil
 }
 
+// ComponentDirectory returns the location of the named component in the build
+// tree.
+//
+// Note: It will not check if the directory exists.
+func ComponentDirectory(naosPath, name string) string {
+	return filepath.Join(Directory(naosPath), "components", name)
+}
+
 // InstallComponent will install the specified component in the build tree.
 func InstallComponent(naosPath, name, repository, version string, force bool, out io.Writer) error {
 	// check component name
@@ -131,7 +128,7 @@ func InstallComponent(naosPath, name, repository, version string, force bool, ou
 	}
 
 	// get component dir
-	comPath := filepath.Join(Directory(naosPath), "components", name)
+	comPath := ComponentDirectory(naosPath, name)
 
 	// remove existing directory if existing or force has been set
 	if force {
@@ -0,0 +1,22 @@
+package tree
+
+import "fmt"
+
+// DefaultTarget is the chip targeted by the build tree. Newer chips like the
+// esp32s2, esp32s3 and esp32c3 require an ESP-IDF 4.x build using idf.py which
+// is not supported by the legacy make build of the tree.
+const DefaultTarget = "esp32"
+
+// Targets returns the names of all supported targets.
+func Targets() []string {
+	return []string{DefaultTarget}
+}
+
+// CheckTarget will return an error if the target is not supported.
+func CheckTarget(name string) error {
+	if name != DefaultTarget {
+		return fmt.Errorf("unsupported target '%s', expected one of %v", name, Targets())
+	}
+
+	return nil
+}
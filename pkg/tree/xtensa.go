@@ -1,90 +1,180 @@
 package tree
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 
+	"code.cloudfoundry.org/bytefmt"
 	"github.com/mholt/archiver/v3"
 
 	"github.com/256dpi/naos/pkg/utils"
 )
 
-// InstallToolchain will install the xtensa toolchain. An existing toolchain will
-// be removed if force is set to true. If out is not nil, it will be used to log
-// information about the installation process.
-func InstallToolchain(naosPath, version string, force bool, out io.Writer) error {
+// Toolchain is the name of the xtensa toolchain.
+const Toolchain = "xtensa-esp32-elf"
+
+// toolchainChecksums lists the SHA-256 checksums of the legacy toolchain
+// archives by file name as they are not listed by older esp-idf versions.
+var toolchainChecksums = map[string]string{}
+
+// InstallToolchain will install the xtensa toolchain and return the SHA-256
+// checksum of its archive. The archive is verified against the provided
+// checksum, the known checksums of legacy toolchains or the checksum listed by
+// esp-idf. Archives that cannot be verified are refused unless insecure is set
+// to true. If force is set to true, the existing link is removed and the cached
+// archive is verified again and unpacked if it had to be replaced. If out is not
+// nil, it will be used to log information about the installation process.
+func InstallToolchain(naosPath, version, checksum string, force, insecure bool, out io.Writer) (string, error) {
 	// get toolchain url
-	var url string
-	switch runtime.GOOS {
-	case "darwin":
-		url = "https://dl.espressif.com/dl/xtensa-esp32-elf-macos-" + version + ".tar.gz"
-	case "linux":
-		url = "https://dl.espressif.com/dl/xtensa-esp32-elf-linux64-" + version + ".tar.gz"
-	default:
-		return errors.New("unsupported os")
+	url, err := toolchainURL(version)
+	if err != nil {
+		return "", err
+	}
+
+	// get cache directory
+	cache, err := utils.CacheDirectory()
+	if err != nil {
+		return "", err
 	}
 
-	// prepare toolchain directory
-	dir := filepath.Join(Directory(naosPath), "toolchain", version)
+	// prepare toolchain directories
+	cached := filepath.Join(cache, "toolchain", version, Toolchain)
+	dir := filepath.Join(Directory(naosPath), "toolchain", version, Toolchain)
 
 	// check if already exists
 	ok, err := utils.Exists(dir)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// remove link if cached toolchain is missing
+	if _, err := os.Stat(dir); ok && os.IsNotExist(err) {
+		err = os.Remove(dir)
+		if err != nil {
+			return "", err
+		}
+		ok = false
 	}
 
 	// return immediately if already exists and not forced
 	if ok && !force {
-		utils.Log(out, "Skipping xtensa toolchain as it already exists.")
-		return nil
+		utils.Log(out, fmt.Sprintf("Skipping toolchain '%s' as it already exists.", Toolchain))
+		return utils.CachedChecksum(url)
 	}
 
-	// remove existing directory if existing
+	// remove existing link or directory, the cached toolchain is shared and kept
 	if ok {
-		utils.Log(out, "Removing existing xtensa toolchain (forced).")
+		utils.Log(out, fmt.Sprintf("Removing existing toolchain '%s' (forced).", Toolchain))
 		err = os.RemoveAll(dir)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	// get a temporary file
-	tmp, err := ioutil.TempFile("", "naos")
+	// check cached toolchain
+	ok, err = utils.Exists(cached)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// make sure temporary file gets closed
-	defer tmp.Close()
+	// verify and install toolchain into cache if missing or forced
+	if !ok || force {
+		// get expected checksum
+		checksum, err = expectedChecksum(naosPath, url, checksum, insecure)
+		if err != nil {
+			return "", err
+		}
 
-	// download toolchain
-	utils.Log(out, "Downloading xtensa toolchain...")
-	err = utils.Download(tmp.Name(), url)
+		// warn if the archive cannot be verified
+		if checksum == "" {
+			warn := out
+			if warn == nil {
+				warn = os.Stderr
+			}
+			utils.Log(warn, fmt.Sprintf("WARNING: No checksum is known for toolchain '%s', the archive is NOT verified (insecure)!", path.Base(url)))
+			utils.Log(warn, "WARNING: Its checksum is recorded in the lock file and trusted from now on, verify it manually.")
+		}
+
+		// get previous checksum
+		previous, err := utils.CachedChecksum(url)
+		if err != nil {
+			return "", err
+		}
+
+		// download or verify toolchain, a mismatching archive is replaced
+		utils.Log(out, fmt.Sprintf("Downloading toolchain '%s'...", Toolchain))
+		archive, err := utils.CachedDownload(url, checksum, progress(out))
+		if err != nil {
+			return "", err
+		}
+
+		// get actual checksum
+		actual, err := utils.CachedChecksum(url)
+		if err != nil {
+			return "", err
+		}
+
+		// keep cached toolchain if the archive has not been replaced
+		if ok && actual == previous {
+			utils.Log(out, fmt.Sprintf("Verified cached toolchain '%s'.", Toolchain))
+		} else {
+			err = unpackToolchain(archive, cached, out)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	// link toolchain
+	utils.Log(out, fmt.Sprintf("Linking toolchain '%s'.", Toolchain))
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = os.Symlink(cached, dir)
+	if err != nil {
+		return "", err
+	}
+
+	return utils.CachedChecksum(url)
+}
+
+func unpackToolchain(archive, cached string, out io.Writer) error {
+	// get a temporary directory next to the cached toolchain
+	err := os.MkdirAll(filepath.Dir(cached), 0755)
 	if err != nil {
 		return err
 	}
+	tmp, err := ioutil.TempDir(filepath.Dir(cached), "unpack")
+	if err != nil {
+		return err
+	}
+
+	// make sure temporary directory gets removed
+	defer os.RemoveAll(tmp)
 
 	// unpack toolchain
-	utils.Log(out, "Unpacking xtensa toolchain...")
-	err = archiver.DefaultTarGz.Unarchive(tmp.Name(), dir)
+	utils.Log(out, fmt.Sprintf("Unpacking toolchain '%s'...", Toolchain))
+	err = archiver.DefaultTarGz.Unarchive(archive, tmp)
 	if err != nil {
 		return err
 	}
 
-	// close temporary file
-	tmp.Close()
-
-	// remove temporary file
-	err = os.Remove(tmp.Name())
+	// remove replaced toolchain
+	err = os.RemoveAll(cached)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// move toolchain into place
+	return os.Rename(filepath.Join(tmp, Toolchain), cached)
 }
 
 // BinDirectory returns the assumed location of the xtensa toolchain 'bin'
@@ -98,5 +188,106 @@ func BinDirectory(naosPath string) (string, error) {
 		return "", err
 	}
 
-	return filepath.Join(Directory(naosPath), "toolchain", version, "xtensa-esp32-elf", "bin"), nil
+	return filepath.Join(Directory(naosPath), "toolchain", version, Toolchain, "bin"), nil
+}
+
+func toolchainURL(version string) (string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return "https://dl.espressif.com/dl/" + Toolchain + "-macos-" + version + ".tar.gz", nil
+	case "linux":
+		return "https://dl.espressif.com/dl/" + Toolchain + "-linux64-" + version + ".tar.gz", nil
+	default:
+		return "", errors.New("unsupported os")
+	}
+}
+
+func expectedChecksum(naosPath, url, checksum string, insecure bool) (string, error) {
+	// use provided checksum
+	if checksum != "" {
+		return checksum, nil
+	}
+
+	// use known checksum
+	if checksum, ok := toolchainChecksums[path.Base(url)]; ok {
+		return checksum, nil
+	}
+
+	// get listed checksum
+	checksum, err := toolchainChecksum(naosPath, url)
+	if err != nil {
+		return "", err
+	}
+
+	// refuse unverified archives unless insecure
+	if checksum == "" && !insecure {
+		return "", fmt.Errorf("no checksum is known for toolchain '%s' (run with --insecure to trust it)", path.Base(url))
+	}
+
+	return checksum, nil
+}
+
+func toolchainChecksum(naosPath, url string) (string, error) {
+	// read tools file
+	data, err := ioutil.ReadFile(filepath.Join(IDFDirectory(naosPath), "tools", "tools.json"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// decode tools
+	var tools struct {
+		Tools []struct {
+			Versions []map[string]json.RawMessage `json:"versions"`
+		} `json:"tools"`
+	}
+	err = json.Unmarshal(data, &tools)
+	if err != nil {
+		return "", err
+	}
+
+	// find download with the same file name
+	for _, tool := range tools.Tools {
+		for _, version := range tool.Versions {
+			for _, raw := range version {
+				var download struct {
+					URL    string `json:"url"`
+					SHA256 string `json:"sha256"`
+				}
+				if json.Unmarshal(raw, &download) == nil && download.URL != "" && path.Base(download.URL) == path.Base(url) {
+					return download.SHA256, nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+func progress(out io.Writer) func(int64, int64) {
+	// check output
+	if out == nil {
+		return nil
+	}
+
+	// prepare last percentage
+	last := -1
+
+	return func(done, total int64) {
+		// check total
+		if total <= 0 {
+			return
+		}
+
+		// print on change
+		percent := int(done * 100 / total)
+		if percent != last {
+			last = percent
+			_, _ = fmt.Fprintf(out, "\rDownloaded %s of %s (%d %%)", bytefmt.ByteSize(uint64(done)), bytefmt.ByteSize(uint64(total)), percent)
+			if done == total {
+				_, _ = fmt.Fprintln(out)
+			}
+		}
+	}
 }
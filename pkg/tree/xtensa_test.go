@@ -0,0 +1,41 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedChecksum(t *testing.T) {
+	naosPath := t.TempDir()
+	url := "https://dl.espressif.com/dl/xtensa-esp32-elf-linux64-1.22.0-97-gc752ad5-5.2.0.tar.gz"
+
+	checksum, err := expectedChecksum(naosPath, url, "abc", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", checksum)
+
+	_, err = expectedChecksum(naosPath, url, "", false)
+	assert.EqualError(t, err, "no checksum is known for toolchain 'xtensa-esp32-elf-linux64-1.22.0-97-gc752ad5-5.2.0.tar.gz' (run with --insecure to trust it)")
+
+	checksum, err = expectedChecksum(naosPath, url, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "", checksum)
+
+	toolchainChecksums["xtensa-esp32-elf-linux64-1.22.0-97-gc752ad5-5.2.0.tar.gz"] = "def"
+	defer delete(toolchainChecksums, "xtensa-esp32-elf-linux64-1.22.0-97-gc752ad5-5.2.0.tar.gz")
+
+	checksum, err = expectedChecksum(naosPath, url, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "def", checksum)
+
+	tools := filepath.Join(IDFDirectory(naosPath), "tools")
+	assert.NoError(t, os.MkdirAll(tools, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tools, "tools.json"), []byte(`{"tools":[{"versions":[{"linux-amd64":{"url":"https://dl.espressif.com/dl/xtensa-esp32-elf-gcc8_2_0.tar.gz","sha256":"ghi"}}]}]}`), 0644))
+
+	checksum, err = expectedChecksum(naosPath, "https://dl.espressif.com/dl/xtensa-esp32-elf-gcc8_2_0.tar.gz", "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "ghi", checksum)
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// CacheDirectory returns the user-level directory that caches downloads,
+// toolchains and repositories for all projects. It defaults to 'naos' in the
+// user cache directory e.g. '~/.cache/naos' and may be changed by setting the
+// NAOS_CACHE environment variable.
+func CacheDirectory() (string, error) {
+	// check variable
+	if dir := os.Getenv("NAOS_CACHE"); dir != "" {
+		return filepath.Abs(dir)
+	}
+
+	// get user cache directory
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "naos"), nil
+}
+
+// MirrorDirectory returns the local mirror directory set using the NAOS_MIRROR
+// environment variable. Downloads are looked up in the mirror by their file
+// name and repositories by their host and path e.g.
+// 'git/github.com/256dpi/naos.git'.
+func MirrorDirectory() string {
+	return os.Getenv("NAOS_MIRROR")
+}
+
+// Offline returns whether the NAOS_OFFLINE environment variable is set, in
+// which case only the cache and mirror directory are used.
+func Offline() bool {
+	return os.Getenv("NAOS_OFFLINE") != ""
+}
@@ -1,9 +1,17 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 // Exists will check if the provided file or directory exists.
@@ -22,10 +30,17 @@ func Exists(path string) (bool, error) {
 	return true, err
 }
 
-// Download will download the specified source to the specified destination.
-func Download(destination, source string) error {
-	// create file
-	file, err := os.Create(destination)
+// Download will download the specified source to the specified destination. A
+// partial download left at the destination with the suffix '.part' is resumed.
+// If a checksum is provided, the SHA-256 hash of the data is verified. The
+// optional progress function is called with the downloaded and total number of
+// bytes, the total is negative if unknown.
+func Download(destination, source, checksum string, progress func(done, total int64)) error {
+	// get partial file
+	partial := destination + ".part"
+
+	// open file
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
@@ -33,8 +48,26 @@ func Download(destination, source string) error {
 	// make sure file gets closed
 	defer file.Close()
 
-	// read data
-	resp, err := http.Get(source)
+	// get offset
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+
+	// prepare request
+	req, err := http.NewRequest("GET", source, nil)
+	if err != nil {
+		return err
+	}
+
+	// resume partial download
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	// perform request
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -42,10 +75,37 @@ func Download(destination, source string) error {
 	// make sure the body gets closed
 	defer resp.Body.Close()
 
+	// check status
+	var complete bool
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// restart download
+		offset = 0
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// already downloaded
+		complete = true
+	default:
+		return fmt.Errorf("failed to download %s: %s", source, resp.Status)
+	}
+
 	// write body to file
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		return err
+	if !complete {
+		// get total
+		total := int64(-1)
+		if resp.ContentLength >= 0 {
+			total = offset + resp.ContentLength
+		}
+
+		// copy body
+		_, err = io.Copy(&progressWriter{w: file, done: offset, total: total, fn: progress}, resp.Body)
+		if err != nil {
+			return err
+		}
 	}
 
 	// properly close file
@@ -54,5 +114,209 @@ func Download(destination, source string) error {
 		return err
 	}
 
-	return nil
+	return commit(partial, destination, checksum)
+}
+
+// Checksum will return the hex encoded SHA-256 hash of the specified file.
+func Checksum(path string) (string, error) {
+	// open file
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	// make sure file gets closed
+	defer file.Close()
+
+	// hash file
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CachedDownload will return the path of the specified source in the cache
+// directory. Missing files are copied from the mirror directory or downloaded
+// unless offline. Cached files are verified against the provided checksum or the
+// checksum recorded when they were added.
+func CachedDownload(source, checksum string, progress func(done, total int64)) (string, error) {
+	// get cache directory
+	cache, err := CacheDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	// ensure downloads directory
+	dir := filepath.Join(cache, "downloads")
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// get file name
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+	file := filepath.Join(dir, name)
+
+	// check cached file
+	ok, err := Exists(file)
+	if err != nil {
+		return "", err
+	} else if ok {
+		// get expected checksum
+		expected := checksum
+		if expected == "" {
+			data, _ := ioutil.ReadFile(file + ".sha256")
+			expected = strings.TrimSpace(string(data))
+		}
+
+		// verify file
+		actual, err := Checksum(file)
+		if err != nil {
+			return "", err
+		} else if expected == "" || strings.EqualFold(expected, actual) {
+			return file, ioutil.WriteFile(file+".sha256", []byte(actual+"\n"), 0644)
+		}
+
+		// remove corrupt file
+		err = os.Remove(file)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// check mirror
+	var mirrored string
+	if dir := MirrorDirectory(); dir != "" {
+		ok, err = Exists(filepath.Join(dir, name))
+		if err != nil {
+			return "", err
+		} else if ok {
+			mirrored = filepath.Join(dir, name)
+		}
+	}
+
+	// get file
+	if mirrored != "" {
+		err = copyFile(mirrored, file+".part")
+		if err == nil {
+			err = commit(file+".part", file, checksum)
+		}
+	} else if Offline() {
+		err = fmt.Errorf("'%s' is not cached and downloads are disabled", name)
+	} else {
+		err = Download(file, source, checksum, progress)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// record checksum
+	actual, err := Checksum(file)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(file+".sha256", []byte(actual+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return file, nil
+}
+
+// CachedChecksum returns the checksum recorded for the specified source in the
+// cache directory or an empty string if it has not been cached.
+func CachedChecksum(source string) (string, error) {
+	// get cache directory
+	cache, err := CacheDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	// get file name
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	name := path.Base(u.Path)
+
+	// read checksum
+	data, err := ioutil.ReadFile(filepath.Join(cache, "downloads", name+".sha256"))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func commit(partial, destination, checksum string) error {
+	// verify checksum if available
+	if checksum != "" {
+		actual, err := Checksum(partial)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(checksum, actual) {
+			_ = os.Remove(partial)
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filepath.Base(destination), checksum, actual)
+		}
+	}
+
+	return os.Rename(partial, destination)
+}
+
+func copyFile(source, destination string) error {
+	// open source
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+
+	// make sure source gets closed
+	defer src.Close()
+
+	// create destination
+	dst, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+
+	// make sure destination gets closed
+	defer dst.Close()
+
+	// copy data
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+type progressWriter struct {
+	w     io.Writer
+	done  int64
+	total int64
+	fn    func(int64, int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	// write data
+	n, err := w.w.Write(p)
+	w.done += int64(n)
+
+	// report progress
+	if w.fn != nil {
+		w.fn(w.done, w.total)
+	}
+
+	return n, err
 }
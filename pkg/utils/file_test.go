@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	data := strings.Repeat("naos", 1000)
+	sum := sha256.Sum256([]byte(data))
+	checksum := hex.EncodeToString(sum[:])
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "file.tar.gz", time.Time{}, strings.NewReader(data))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.tar.gz")
+
+	assert.NoError(t, ioutil.WriteFile(file+".part", []byte(data[:1000]), 0644))
+
+	var done, total int64
+	err := Download(file, server.URL+"/file.tar.gz", checksum, func(d, t int64) {
+		done, total = d, t
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bytes=1000-"}, ranges)
+	assert.Equal(t, int64(len(data)), done)
+	assert.Equal(t, int64(len(data)), total)
+
+	actual, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(actual))
+
+	err = Download(file, server.URL+"/file.tar.gz", strings.Repeat("0", 64), nil)
+	assert.Error(t, err)
+
+	ok, err := Exists(file + ".part")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestCachedDownload(t *testing.T) {
+	cache := t.TempDir()
+	mirror := t.TempDir()
+	t.Setenv("NAOS_CACHE", cache)
+	t.Setenv("NAOS_MIRROR", mirror)
+	t.Setenv("NAOS_OFFLINE", "1")
+
+	_, err := CachedDownload("https://example.org/dl/file.tar.gz", "", nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(mirror, "file.tar.gz"), []byte("naos"), 0644))
+
+	file, err := CachedDownload("https://example.org/dl/file.tar.gz", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(cache, "downloads", "file.tar.gz"), file)
+
+	sum, err := ioutil.ReadFile(file + ".sha256")
+	assert.NoError(t, err)
+	assert.Equal(t, "55725bddbc586275c5b25340df4ee23197c1bd0014afbcf5326d20ff186ab1cc\n", string(sum))
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte("corrupt"), 0644))
+
+	file, err = CachedDownload("https://example.org/dl/file.tar.gz", "", nil)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "naos", string(data))
+
+	_, err = CachedDownload("https://example.org/dl/file.tar.gz", strings.Repeat("0", 64), nil)
+	assert.Error(t, err)
+}
@@ -1,45 +1,43 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"io"
+	"net/url"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 )
 
 // Clone will checkout the provided repository set it to the specified version
-// and properly checkout all submodules.
+// and properly checkout all submodules. The version may be a branch, a tag
+// starting with 'v' or a commit hash. The repository and its submodules are
+// cloned from mirrors in the cache directory.
 func Clone(repo, path, commit string, out io.Writer) error {
-	// construct clone command
-	cmd := exec.Command("git", "clone", "--recursive", repo, path)
-	cmd.Stdout = out
-	cmd.Stderr = out
-
-	// clone repo
-	err := cmd.Run()
+	// mirror repository
+	mirror, err := Mirror(repo, out)
 	if err != nil {
 		return err
 	}
 
-	// construct reset command
-	cmd = exec.Command("git", "reset", "--hard", "origin/"+commit)
-	cmd.Stderr = out
-	cmd.Stdout = out
-	cmd.Dir = path
+	// clone repo from mirror
+	err = git("", out, "clone", mirror, path)
+	if err != nil {
+		return err
+	}
 
 	// reset repo to specific version
-	err = cmd.Run()
+	err = git(path, out, "reset", "--hard", revision(commit))
 	if err != nil {
 		return err
 	}
 
-	// construct update command
-	cmd = exec.Command("git", "submodule", "update", "--recursive", "--init")
-	cmd.Stderr = out
-	cmd.Stdout = out
-	cmd.Dir = path
-
 	// set submodules to proper version
-	err = cmd.Run()
+	err = updateSubmodules(path, repo, out)
 	if err != nil {
 		return err
 	}
@@ -48,48 +46,314 @@ func Clone(repo, path, commit string, out io.Writer) error {
 }
 
 // Fetch will updates to the remote repository and update all submodules
-// accordingly.
+// accordingly. Repositories that have not been cloned from a mirror are
+// switched to a mirror in the cache directory.
 func Fetch(path, commit string, out io.Writer) error {
-	// construct fetch command
-	cmd := exec.Command("git", "fetch", "origin")
-	cmd.Stdout = out
-	cmd.Stderr = out
-	cmd.Dir = path
+	// get origin
+	origin, err := gitOutput(path, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return err
+	}
 
-	// clone repo
-	err := cmd.Run()
+	// get upstream
+	upstream, err := gitOutput(origin, "config", "--get", "naos.upstream")
+	if err != nil {
+		upstream = origin
+	}
+
+	// update mirror
+	mirror, err := Mirror(upstream, out)
 	if err != nil {
 		return err
 	}
 
-	// prepend origin if not tag
-	if !strings.HasPrefix(commit, "v") {
-		commit = "origin/" + commit
+	// switch origin to mirror
+	if origin != mirror {
+		err = git(path, out, "remote", "set-url", "origin", mirror)
+		if err != nil {
+			return err
+		}
 	}
 
-	// construct reset command
-	cmd = exec.Command("git", "reset", "--hard", commit)
-	cmd.Stderr = out
-	cmd.Stdout = out
-	cmd.Dir = path
+	// fetch repo
+	err = git(path, out, "fetch", "origin")
+	if err != nil {
+		return err
+	}
 
 	// reset repo to specific version
-	err = cmd.Run()
+	err = git(path, out, "reset", "--hard", revision(commit))
 	if err != nil {
 		return err
 	}
 
-	// construct update command
-	cmd = exec.Command("git", "submodule", "update", "--recursive", "--init")
-	cmd.Stderr = out
-	cmd.Stdout = out
-	cmd.Dir = path
-
 	// set submodules to proper version
-	err = cmd.Run()
+	err = updateSubmodules(path, upstream, out)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Head returns the commit hash of the checked out version of the repository.
+func Head(path string) (string, error) {
+	return gitOutput(path, "rev-parse", "HEAD")
+}
+
+// Submodules returns the commit hashes of all checked out submodules including
+// nested submodules by their path relative to the repository.
+func Submodules(path string) (map[string]string, error) {
+	// get status
+	status, err := gitOutput(path, "submodule", "status", "--recursive")
+	if err != nil {
+		return nil, err
+	}
+
+	// parse status lines e.g. " 1a2b3c... components/foo (v1.0.0)"
+	modules := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			modules[fields[1]] = strings.TrimLeft(fields[0], "+-U")
+		}
+	}
+
+	return modules, nil
+}
+
+// Mirror will create or update a bare mirror of the repository in the cache
+// directory and return its path. The repository is fetched from the mirror
+// directory if available. Existing mirrors are used as they are if offline or
+// if the update fails. Repositories that are not referenced by an URL are not
+// mirrored.
+func Mirror(repo string, out io.Writer) (string, error) {
+	// get mirror path
+	dir, err := mirrorPath(repo)
+	if err != nil {
+		return "", err
+	} else if dir == "" {
+		return repo, nil
+	}
+
+	// get source
+	source := repo
+	if local := MirrorDirectory(); local != "" {
+		rel, _ := mirrorRelative(repo)
+		candidate := filepath.Join(local, "git", rel)
+		ok, err := Exists(candidate)
+		if err != nil {
+			return "", err
+		} else if ok {
+			source = candidate
+		}
+	}
+
+	// check existence
+	ok, err := Exists(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// use existing mirror if offline
+	if ok && Offline() && source == repo {
+		return dir, nil
+	}
+
+	// check offline
+	if !ok && Offline() && source == repo {
+		return "", fmt.Errorf("repository '%s' is not cached and downloads are disabled", repo)
+	}
+
+	// create mirror
+	if !ok {
+		Log(out, fmt.Sprintf("Mirroring '%s'...", repo))
+		err = git("", out, "-c", "init.defaultBranch=master", "init", "--quiet", "--bare", dir)
+		if err == nil {
+			err = git(dir, out, "config", "naos.upstream", repo)
+		}
+		if err == nil {
+			err = git(dir, out, "fetch", "--prune", source, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+		}
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return "", err
+		}
+
+		return dir, nil
+	}
+
+	// update mirror
+	err = git(dir, out, "fetch", "--prune", source, "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+	if err != nil {
+		Log(out, fmt.Sprintf("Using cached '%s' (%s).", repo, err))
+	}
+
+	return dir, nil
+}
+
+func mirrorPath(repo string) (string, error) {
+	// get relative path
+	rel, ok := mirrorRelative(repo)
+	if !ok {
+		return "", nil
+	}
+
+	// get cache directory
+	cache, err := CacheDirectory()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cache, "git", rel), nil
+}
+
+func mirrorRelative(repo string) (string, bool) {
+	// parse url
+	u, err := url.Parse(repo)
+	if err != nil || u.Scheme == "" || u.Scheme == "file" || u.Host == "" {
+		return "", false
+	}
+
+	return filepath.Join(u.Hostname(), filepath.FromSlash(path.Clean(u.Path))), true
+}
+
+func updateSubmodules(dir, upstream string, out io.Writer) error {
+	// check modules file
+	ok, err := Exists(filepath.Join(dir, ".gitmodules"))
+	if err != nil || !ok {
+		return err
+	}
+
+	// list submodules
+	list, err := gitOutput(dir, "config", "--file", ".gitmodules", "--get-regexp", `^submodule\..*\.(path|url)$`)
 	if err != nil {
 		return err
 	}
 
+	// parse submodules
+	paths := map[string]string{}
+	urls := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		// split line
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		// get name and key
+		key := fields[0][strings.LastIndex(fields[0], ".")+1:]
+		name := strings.TrimSuffix(strings.TrimPrefix(fields[0], "submodule."), "."+key)
+
+		// set value
+		if key == "path" {
+			paths[name] = fields[1]
+		} else {
+			urls[name] = resolveURL(upstream, fields[1])
+		}
+	}
+
+	// mirror submodules
+	for _, repo := range urls {
+		_, err = Mirror(repo, out)
+		if err != nil {
+			return err
+		}
+	}
+
+	// get cache directory
+	cache, err := CacheDirectory()
+	if err != nil {
+		return err
+	}
+
+	// update submodules using mirrors
+	prefix := filepath.Join(cache, "git") + string(filepath.Separator)
+	err = git(dir, out, "-c", "protocol.file.allow=always",
+		"-c", "url."+prefix+".insteadOf=https://",
+		"-c", "url."+prefix+".insteadOf=http://",
+		"submodule", "update", "--init")
+	if err != nil {
+		return err
+	}
+
+	// update nested submodules
+	for name, p := range paths {
+		err = updateSubmodules(filepath.Join(dir, p), urls[name], out)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+func resolveURL(base, ref string) string {
+	// check relative reference
+	if !strings.HasPrefix(ref, "./") && !strings.HasPrefix(ref, "../") {
+		return ref
+	}
+
+	// parse base
+	u, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+
+	// resolve path relative to the repository
+	u.Path = path.Join(u.Path, ref)
+
+	return u.String()
+}
+
+func revision(commit string) string {
+	// use tags and commit hashes as they are
+	if strings.HasPrefix(commit, "v") || isHash(commit) {
+		return commit
+	}
+
+	return "origin/" + commit
+}
+
+func isHash(commit string) bool {
+	// check length
+	if len(commit) != 40 {
+		return false
+	}
+
+	// check characters
+	for _, c := range commit {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func git(dir string, out io.Writer, args ...string) error {
+	// construct command
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Dir = dir
+
+	// run command
+	return cmd.Run()
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	// construct command
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	// run command
+	data, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(data)), nil
+}
@@ -1,32 +1,200 @@
 package utils
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 
 	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
 )
 
-var usbPrefixes = []string{"cu.usbserial"}
+// ErrNoPort is returned if no serial port with an attached board is found.
+var ErrNoPort = errors.New("no attached board found, check the USB connection or specify the port")
 
-// FindPort will return the fist known USB serial port or an empty string.
-func FindPort(out io.Writer) string {
+// The known USB-UART bridges and native USB interfaces by VID:PID.
+var knownAdapters = map[string]string{
+	"10C4:EA60": "CP210x",
+	"10C4:EA70": "CP2105",
+	"10C4:EA71": "CP2108",
+	"1A86:7522": "CH340",
+	"1A86:7523": "CH340",
+	"1A86:5523": "CH341",
+	"1A86:55D4": "CH9102",
+	"0403:6001": "FT232R",
+	"0403:6010": "FT2232",
+	"0403:6011": "FT4232",
+	"0403:6014": "FT232H",
+	"0403:6015": "FT231X",
+	"067B:2303": "PL2303",
+	"303A:1001": "ESP32 USB",
+	"303A:0002": "ESP32 USB CDC",
+}
+
+// The name prefixes used if the USB details cannot be enumerated or the adapter
+// is not known.
+var fallbackPrefixes = []string{
+	"cu.usbserial",
+	"cu.SLAB_USBtoUART",
+	"cu.wchusbserial",
+	"cu.usbmodem",
+	"ttyUSB",
+	"ttyACM",
+}
+
+// A Port is a serial port that likely has a board attached.
+type Port struct {
+	Name    string `json:"name"`
+	Adapter string `json:"adapter"`
+	VID     string `json:"vid"`
+	PID     string `json:"pid"`
+	Serial  string `json:"serial"`
+	Product string `json:"product"`
+}
+
+// FindPorts will return all serial ports with a known USB-UART bridge or
+// native USB interface. USB ports with an unknown adapter and all ports on
+// platforms that do not provide the USB details are matched by name.
+func FindPorts() ([]Port, error) {
+	// get detailed list
+	list, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return findPortsByName()
+	}
+
+	// match ports
+	var ports []Port
+	for _, details := range list {
+		if port, ok := matchPort(details); ok {
+			ports = append(ports, port)
+		}
+	}
+
+	// sort ports
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+
+	return ports, nil
+}
+
+func matchPort(details *enumerator.PortDetails) (Port, bool) {
+	// check USB
+	if !details.IsUSB {
+		return Port{}, false
+	}
+
+	// prepare port
+	port := Port{
+		Name:    details.Name,
+		VID:     strings.ToUpper(details.VID),
+		PID:     strings.ToUpper(details.PID),
+		Serial:  details.SerialNumber,
+		Product: details.Product,
+	}
+
+	// check adapter
+	adapter, ok := knownAdapters[port.VID+":"+port.PID]
+	if ok {
+		port.Adapter = adapter
+		return port, true
+	}
+
+	// otherwise check name
+	return port, matchName(details.Name)
+}
+
+func matchName(name string) bool {
+	// check prefixes
+	for _, prefix := range fallbackPrefixes {
+		if strings.Contains(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func findPortsByName() ([]Port, error) {
 	// get list
 	list, err := serial.GetPortsList()
 	if err != nil {
-		_, _ = fmt.Fprintf(out, "usb: %s\n", err.Error())
-		return ""
+		return nil, err
 	}
 
 	// check names and prefixes
+	var ports []Port
 	for _, name := range list {
-		for _, prefix := range usbPrefixes {
-			if strings.Contains(name, prefix) {
-				return name
-			}
+		if matchName(name) {
+			ports = append(ports, Port{Name: name})
 		}
 	}
 
-	return ""
+	// sort ports
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Name < ports[j].Name
+	})
+
+	return ports, nil
+}
+
+// ChoosePort will return the port of the single attached board. If several
+// boards are attached, the user is asked to choose one if the input is a
+// terminal.
+func ChoosePort(out io.Writer, in *os.File) (string, error) {
+	// find ports
+	ports, err := FindPorts()
+	if err != nil {
+		return "", err
+	}
+
+	// check count
+	switch len(ports) {
+	case 0:
+		return "", ErrNoPort
+	case 1:
+		return ports[0].Name, nil
+	}
+
+	// get names
+	names := make([]string, 0, len(ports))
+	for _, port := range ports {
+		names = append(names, port.Name)
+	}
+
+	// check terminal
+	if out == nil || in == nil || !isTerminal(in) {
+		return "", fmt.Errorf("several boards found (%s), specify the port", strings.Join(names, ", "))
+	}
+
+	// list ports
+	_, _ = fmt.Fprintln(out, "Several boards found:")
+	for i, port := range ports {
+		_, _ = fmt.Fprintf(out, "  %d) %s %s\n", i+1, port.Name, port.Adapter)
+	}
+
+	// ask for choice
+	_, _ = fmt.Fprintf(out, "Choose a port [1-%d]: ", len(ports))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	num, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || num < 1 || num > len(ports) {
+		return "", errors.New("invalid choice")
+	}
+
+	return ports[num-1].Name, nil
+}
+
+func isTerminal(file *os.File) bool {
+	// get info
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
 }
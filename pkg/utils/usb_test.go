@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.bug.st/serial/enumerator"
+)
+
+func TestMatchPort(t *testing.T) {
+	for _, item := range []struct {
+		details enumerator.PortDetails
+		adapter string
+		match   bool
+	}{
+		{
+			details: enumerator.PortDetails{Name: "/dev/ttyUSB0", IsUSB: true, VID: "10c4", PID: "ea60"},
+			adapter: "CP210x",
+			match:   true,
+		},
+		{
+			details: enumerator.PortDetails{Name: "/dev/cu.usbserial-1410", IsUSB: true, VID: "067B", PID: "2303"},
+			adapter: "PL2303",
+			match:   true,
+		},
+		{
+			details: enumerator.PortDetails{Name: "/dev/ttyUSB1", IsUSB: true, VID: "1234", PID: "5678"},
+			match:   true,
+		},
+		{
+			details: enumerator.PortDetails{Name: "/dev/cu.usbserial-A50285BI", IsUSB: true, VID: "1234", PID: "5678"},
+			match:   true,
+		},
+		{
+			details: enumerator.PortDetails{Name: "/dev/cu.Bluetooth-Incoming-Port", IsUSB: true, VID: "1234", PID: "5678"},
+			match:   false,
+		},
+		{
+			details: enumerator.PortDetails{Name: "/dev/ttyS0"},
+			match:   false,
+		},
+	} {
+		details := item.details
+		port, ok := matchPort(&details)
+		assert.Equal(t, item.match, ok, details.Name)
+		if ok {
+			assert.Equal(t, details.Name, port.Name)
+			assert.Equal(t, item.adapter, port.Adapter)
+		}
+	}
+}